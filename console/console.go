@@ -25,12 +25,18 @@ const imsiPattern = `[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9
 
 var imsiRegex = regexp.MustCompile("^" + imsiPattern + "$")
 
-func Run(initItem ussd.ItemWithInputHandler) {
+func Run(initItem ussd.ItemSvcExec) {
 	msisdnPtr := flag.String("msisdn", "27821234567", "MSISDN in international format (10..15 digits)")
 	imsiPtr := flag.String("imsi", "", "IMSI (default: not defined)")
 	maxlPtr := flag.Int("maxl", 182, "Maximum length (valid 50..500)")
 	//builtInServicesPtr := flag.Bool("builtin", false, "Include default built in service for demonstration purposes")
-	//initItemIdPtr := flag.String("init", "builtInRouter", "Init item id to start all services from")
+	filePtr := flag.String("file", "", "Load items from YAML/JSON file (default: none)")
+	catalogPtr := flag.String("catalog", "", "Load text translations from YAML/JSON file (default: none)")
+	codesPtr := flag.String("codes", "", "Load USSD code translations from YAML/JSON file (default: none)")
+	languagePtr := flag.String("language", "", "Initial session language (default: catalog fallback)")
+	initItemIdPtr := flag.String("init", "", "Init item id to start all services from (default: built-in service)")
+	graphPtr := flag.String("graph", "", "Write graph of the init item as \"dot\" or \"mermaid\" to stdout then exit")
+	validatePtr := flag.Bool("validate", false, "Validate all items (using --maxl) then exit, with exit code 1 on errors")
 	flag.Parse()
 
 	if len(*msisdnPtr) < 10 || len(*msisdnPtr) > 15 || (*msisdnPtr)[0] == '0' {
@@ -65,9 +71,80 @@ func Run(initItem ussd.ItemWithInputHandler) {
 	// 	}
 	// }
 
-	//load custom services from file(s)
+	//load translations before items, so that select language items can list the languages
+	if *catalogPtr != "" {
+		if err := ussd.LoadCatalogFile(*catalogPtr); err != nil {
+			panic(fmt.Sprintf("--catalog=%s failed to load: %+v", *catalogPtr, err))
+		}
+	}
+
+	if *codesPtr != "" {
+		codeTable, err := ussd.LoadCodeTableFile(*codesPtr)
+		if err != nil {
+			panic(fmt.Sprintf("--codes=%s failed to load: %+v", *codesPtr, err))
+		}
+		ussd.SetCodeTable(codeTable)
+	}
+
+	//load custom services from file
+	//and reload when changed, so menus can be edited while testing
+	if *filePtr != "" {
+		itemsFile, err := ussd.LoadVersionedFile(*filePtr)
+		if err != nil {
+			panic(fmt.Sprintf("--file=%s failed to load: %+v", *filePtr, err))
+		}
+		if err := itemsFile.Watch(); err != nil {
+			panic(fmt.Sprintf("--file=%s cannot watch: %+v", *filePtr, err))
+		}
+	}
+
+	if *validatePtr {
+		nrErrors := 0
+		for _, problem := range ussd.Validate(ussd.GetRegistry(), *maxlPtr) {
+			fmt.Fprintf(os.Stdout, "%s\n", problem)
+			if problem.Level == ussd.ProblemLevelError {
+				nrErrors++
+			}
+		}
+		if nrErrors > 0 {
+			fmt.Fprintf(os.Stdout, "Validation failed with %d errors.\n", nrErrors)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Validation passed.\n")
+		os.Exit(0)
+	}
 
 	//select init service (typical a ussd.Router)
+	if *initItemIdPtr != "" {
+		item, ok := ussd.ItemByID(*initItemIdPtr)
+		if !ok {
+			panic(fmt.Sprintf("--init=%s not found", *initItemIdPtr))
+		}
+		initItem, ok = item.(ussd.ItemSvcExec)
+		if !ok {
+			panic(fmt.Sprintf("--init=%s of type %T cannot start a session", *initItemIdPtr, item))
+		}
+	}
+
+	switch *graphPtr {
+	case "":
+	case "dot":
+		if err := ussd.WriteDOT(os.Stdout, initItem); err != nil {
+			panic(fmt.Sprintf("failed to write graph: %+v", err))
+		}
+		os.Exit(0)
+	case "mermaid":
+		if err := ussd.WriteMermaid(os.Stdout, initItem); err != nil {
+			panic(fmt.Sprintf("failed to write graph: %+v", err))
+		}
+		os.Exit(0)
+	default:
+		panic(fmt.Sprintf("--graph=%s is not \"dot\" or \"mermaid\"", *graphPtr))
+	}
+
+	//responses are sent to the channel of the current session
+	responder := &consoleResponder{}
+	ussd.AddResponder(responder)
 
 	//create a user input channel used for all console input
 	//so we can constantly read the terminal
@@ -100,6 +177,7 @@ func Run(initItem ussd.ItemWithInputHandler) {
 	//starting a new session with an MSISDN that has an session will hi-jack that
 	//session, as this is not possible in the HLR
 	sessionNr := int64(0)
+	redirectCode := "" //set when a session ended with a redirect
 	for {
 		//start a new session
 		sessionNr++
@@ -111,7 +189,12 @@ func Run(initItem ussd.ItemWithInputHandler) {
 		fmt.Fprintf(os.Stdout, "    ( session: %d )    \n", sessionNr)
 		fmt.Fprintf(os.Stdout, "---------------------------------------\n")
 
-		ussdDialString := ""
+		//a redirect starts the new session without user input, like the HLR does
+		ussdDialString := redirectCode
+		redirectCode = ""
+		if ussdDialString != "" {
+			fmt.Fprintf(os.Stdout, "USSD > %s (redirected)\n", ussdDialString)
+		}
 		for len(ussdDialString) == 0 {
 			fmt.Fprintf(os.Stdout, "USSD > ")
 			ussdDialString = <-userInputChan
@@ -132,9 +215,13 @@ func Run(initItem ussd.ItemWithInputHandler) {
 		if len(*imsiPtr) == 15 {
 			data["imsi"] = *imsiPtr
 		}
+		if *languagePtr != "" {
+			data["language"] = *languagePtr
+		}
 
 		id := "console:" + *msisdnPtr
 		resChan := make(chan consoleResponse)
+		responder.setChan(resChan)
 
 		//USSD started: process all USSD service responses to the user
 		ended := false
@@ -148,14 +235,15 @@ func Run(initItem ussd.ItemWithInputHandler) {
 				fmt.Fprintf(os.Stdout, "-----------------------------(len:%3d)--\n", len(res.resText))
 
 				switch res.resType {
-				case ussd.TypeFinal:
+				case ussd.ResponseTypeRelease:
 					fmt.Fprintf(os.Stdout, "==========[ E N D ]====================\n")
 
 					continue
-				case ussd.TypeRedirect:
+				case ussd.ResponseTypeRedirect:
 					fmt.Fprintf(os.Stdout, "==========[ R E D I R E C T ]==========\n")
+					redirectCode = res.resText
 					continue
-				case ussd.TypePrompt:
+				case ussd.ResponseTypeResponse:
 					log.Debugf("expecting more responses...")
 					continue
 				default:
@@ -163,7 +251,7 @@ func Run(initItem ussd.ItemWithInputHandler) {
 					fmt.Fprintf(os.Stdout, "  UNEXPECTED Type=%s!!!\n", res.resType)
 					fmt.Fprintf(os.Stdout, "  Response: {type:%s, message:%s}\n", res.resType, res.resText)
 					fmt.Fprintf(os.Stdout, "==========[ E R R O R ]================\n")
-					close(resChan)
+					responder.end()
 					continue
 				}
 			} //for all responses
@@ -176,9 +264,10 @@ func Run(initItem ussd.ItemWithInputHandler) {
 
 		ctx := context.Background()
 		log.Debugf("Starting USSD (id:%s)...", id)
-		if err := ussd.UserStart(ctx, id, data, initItem, ussdDialString, consoleResponder{resChan: resChan}); err != nil {
+		if err := ussd.Start(ctx, id, data, initItem, ussdDialString, responder, id); err != nil {
 			fmt.Fprintf(os.Stdout, "  ERROR: USSD failed to start: %+v", err)
 			fmt.Fprintf(os.Stdout, "\n")
+			responder.end()
 			continue
 		}
 		log.Debugf("Started USSD...")
@@ -197,10 +286,10 @@ func Run(initItem ussd.ItemWithInputHandler) {
 			} //if aborted by just hitting <enter>
 
 			//got user input
-			if err := ussd.UserContinue(context.Background(), id, nil, input, consoleResponder{resChan: resChan}); err != nil {
+			if err := ussd.UserInput(context.Background(), id, nil, input, responder, id); err != nil {
 				fmt.Fprintf(os.Stdout, "Continue failed: %+v\n", err)
 				fmt.Fprintf(os.Stdout, "==========[ E R R O R ]================\n")
-				close(resChan)
+				responder.end()
 				break //continue
 			}
 
@@ -217,32 +306,56 @@ func Run(initItem ussd.ItemWithInputHandler) {
 
 }
 
+//consoleResponder is registered once, because sessions find their responder by id,
+//and it sends the responses to the channel of the current console session
 type consoleResponder struct {
+	sync.Mutex
 	resChan chan consoleResponse
 }
 
-func (cr consoleResponder) ID() string { return "console" }
+func (cr *consoleResponder) ID() string { return "console" }
 
-func (cr consoleResponder) Respond(key interface{}, resType ussd.Type, resText string) error {
-	log.Debugf("responder.Respond(%v,%s,%s)", key, resType, resText)
+func (cr *consoleResponder) setChan(resChan chan consoleResponse) {
+	cr.Lock()
+	defer cr.Unlock()
+	cr.resChan = resChan
+}
+
+//end() closes the channel of the current session, unless a final response already closed it
+func (cr *consoleResponder) end() {
+	cr.Lock()
+	defer cr.Unlock()
+	if cr.resChan != nil {
+		close(cr.resChan)
+		cr.resChan = nil
+	}
+}
+
+func (cr *consoleResponder) Respond(ctx context.Context, key interface{}, res ussd.Response) error {
+	cr.Lock()
+	defer cr.Unlock()
+	log.Debugf("responder.Respond(%v,%s,%s)", key, res.Type, res.Message)
+	if cr.resChan == nil {
+		return errors.Errorf("console session ended, cannot respond to %v", key)
+	}
 	cr.resChan <- consoleResponse{
-		resText: resText,
-		resType: resType,
+		resText: res.Message,
+		resType: res.Type,
 	}
-	log.Debugf("responder.Responded(%v,%s,%s)", key, resType, resText)
-	if resType == ussd.TypeFinal || resType == ussd.TypeRedirect {
+	log.Debugf("responder.Responded(%v,%s,%s)", key, res.Type, res.Message)
+	if res.Type == ussd.ResponseTypeRelease || res.Type == ussd.ResponseTypeRedirect {
 		close(cr.resChan)
 		cr.resChan = nil
-		log.Debugf("%s -> Closed res chan", resType)
+		log.Debugf("%s -> Closed res chan", res.Type)
 	} else {
-		log.Debugf("%s -> Not closed chan", resType)
+		log.Debugf("%s -> Not closed chan", res.Type)
 	}
 	return nil
 }
 
 type consoleResponse struct {
 	resText string
-	resType ussd.Type
+	resType ussd.ResponseType
 }
 
 // func builtIn() error {
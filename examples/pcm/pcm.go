@@ -6,7 +6,6 @@ import (
 
 	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
 	"bitbucket.org/vservices/utils/v4/errors"
-	"github.com/google/uuid"
 )
 
 var pcmRouter ussd.ItemSvcExec
@@ -28,6 +27,9 @@ func Item() ussd.ItemSvcExec {
 		panic(fmt.Sprintf("failed to connect to db: %+v", err))
 	}
 
+	//custom items must be registered to be queued in a session
+	deliverItem := ussd.AddItem(deliver{})
+
 	blockMenu := ussd.NewMenu("pcm_block_menu", "-Call Me Messages-").
 		With("Unblock Call Me Messages",
 			ussd.Set("pcm_blocked", false),
@@ -37,7 +39,7 @@ func Item() ussd.ItemSvcExec {
 		With("Block Call Me Messages",
 			ussd.Set("pcm_blocked", true),
 			profileSetItems("pcm_blocked"),
-			ussd.NewFinal("pcm_unblocked", "PCM/PRM Messages blocked."),
+			ussd.NewFinal("pcm_blocked", "PCM/PRM Messages blocked."),
 		)
 
 	advertsMenu := ussd.NewMenu("pcm_block_advert", "-Call Me Adverts-").
@@ -57,25 +59,25 @@ func Item() ussd.ItemSvcExec {
 		With("Send Recharge Me",
 			ussd.Set("type", "PRM"),
 			ussd.NewPrompt("enter_bnumber_prm", "Enter phone number", "bnumber"), //todo: allow NewXxx() without id to use uuid
-			deliver{},
+			deliverItem,
 		).
 		With("Send Call Me",
 			ussd.Set("type", "PCM"),
 			ussd.NewPrompt("enter_bnumber_pcm", "Enter phone number", "bnumber"),
-			deliver{},
+			deliverItem,
 		).
 		With("Change Name",
-			ussd.NewPrompt("enter_name", "Enter your name:", "name"),
+			ussd.NewPrompt("enter_name", "Enter your name:", "pcm_name"),
 			profileSetItems("pcm_name"),
 			ussd.NewFinal("pcm_name_changed", "Your name was changed to <pcm_name>. You may change it again in 1 day."),
 		).
 		With("Display Name",
 			profileGetItems("pcm_name"),
-			ussd.NewFinal("display_name", "Your name is <pcm_name>"), //todo: substitute
+			ussd.NewFinal("display_name", "Your name is <pcm_name|default not set>"),
 		).
 		With("PCM/PRM Balance",
 			profileGetItems("pcm_balance", "prm_balance"),
-			ussd.NewFinal("pcm_balances", "You Call Me balance: <bal>\nYour Recharge Me balance: <bal>"), //todo substitute
+			ussd.NewFinal("pcm_balances", "You Call Me balance: <pcm_balance|default 0>\nYour Recharge Me balance: <prm_balance|default 0>"),
 		).
 		With("Disable/Enable Adverts", advertsMenu)
 
@@ -85,7 +87,7 @@ func Item() ussd.ItemSvcExec {
 	//router is the init item for all pcm ussd requests:
 	pcmRouter = ussd.NewRouter("pcm").
 		WithCode("*140#", mainMenu).
-		WithRegex(`\*140\*([0-9]{10,15})#`, []string{"bnumber"}, deliver{})
+		WithRegex(`\*140\*([0-9]{10,15})#`, []string{"bnumber"}, deliverItem)
 	return pcmRouter
 } //Item()
 
@@ -108,10 +110,10 @@ func (deliver deliver) Exec(ctx context.Context) ([]ussd.Item, error) {
 
 func profileGetItems(names ...string) ussd.Item {
 	//todo: make sure names are snake_case
-	return profileGet{
-		id:    uuid.New().String(),
+	return ussd.AddItem(profileGet{
+		id:    ussd.ContentID("profile_get", names),
 		names: names,
-	}
+	})
 }
 
 type profileGet struct {
@@ -160,12 +162,15 @@ func profileSetItems(names ...string) ussd.Item {
 		panic("missing names")
 	}
 	//todo: make sure names are snake_case
-	return profileSet{
-		id:    uuid.New().String(),
+	return ussd.AddItem(profileSet{
+		id:    ussd.ContentID("profile_set", names),
 		names: names,
-	}
+	})
 }
 
+//profileSet must implement ItemSvcExec to be executed by the session
+var _ ussd.ItemSvcExec = profileSet{}
+
 type profileSet struct {
 	id    string
 	names []string //required
@@ -173,7 +178,7 @@ type profileSet struct {
 
 func (ps profileSet) ID() string { return ps.id }
 
-func (ps profileSet) Exec(ctx context.Context) (string, ussd.Item, error) {
+func (ps profileSet) Exec(ctx context.Context) ([]ussd.Item, error) {
 	s := ctx.Value(ussd.CtxSession{}).(ussd.Session)
 	msisdn := s.Get("msisdn")
 	for _, name := range ps.names {
@@ -188,9 +193,9 @@ func (ps profileSet) Exec(ctx context.Context) (string, ussd.Item, error) {
 			args = []interface{}{msisdn, name, value, value}
 		}
 		if _, err := db.Exec(query, args...); err != nil {
-			return "", nil, errors.Wrapf(err, "failed to set msisdn(%s).%s=%s", msisdn, name, value)
+			return nil, errors.Wrapf(err, "failed to set msisdn(%s).%s=%s", msisdn, name, value)
 		}
 		log.Debugf("Profile set msisdn(%s).(%s=\"%s\")", msisdn, name, value)
 	}
-	return "", nil, nil
+	return nil, nil
 } //profileSet.Exec()
@@ -2,6 +2,7 @@ package soscredit
 
 import (
 	"context"
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -16,21 +17,29 @@ func Item() ussd.ItemSvcExec {
 		return router
 	}
 
-	forAFriend := ussd.NewMenu("for_a_friend", "")
-	fromTelma := ussd.NewMenu("from_telma", "")
-	offerFromTelma := ussd.NewMenu("offer_from_telma", "")
-	reimburse := ussd.NewMenu("reimburse", "")
-	help := ussd.NewMenu("help", "")
+	//soscredit items are defined in their own namespace, so the ids do not clash
+	//with other services in the same process
+	reg := ussd.Namespace("soscredit")
+	if err := ussd.AddCatalog(texts); err != nil {
+		panic(fmt.Sprintf("soscredit texts: %+v", err))
+	}
+
+	forAFriend := reg.NewMenu("for_a_friend", "")
+	fromTelma := reg.NewMenu("from_telma", "")
+	offerFromTelma := reg.NewMenu("offer_from_telma", "")
+	reimburse := reg.NewMenu("reimburse", "")
+	help := reg.NewMenu("help", "")
 
-	mainMenu := ussd.NewMenu("main_menu", "SOS credit").
+	mainMenu := reg.NewMenu("main_menu", "SOS_credit").
 		With("SOS_credit_for_a_friend", forAFriend).
 		With("SOS_credit_from_TELMA", fromTelma).
 		With("SOS_credit_offer_from_TELMA", offerFromTelma).
 		With("SOS_credit_reimburse", reimburse).
 		With("SOS_credit_help", help)
+	mainMenu.With("SOS_credit_language", reg.NewSelectLanguage("select_language", "SOS_credit_select_language"), mainMenu)
 
-	router = ussd.NewRouter("soscredit").
-		WithCode("*130*107#", ussd.NewFunc("init", ussdInit), getAccountDetails{}, mainMenu)
+	router = reg.NewRouter("soscredit").
+		WithCode("*130*107#", reg.NewFunc("init", ussdInit), ussd.AddItem(getAccountDetails{id: reg.ID("get_account_details")}), mainMenu)
 	return router
 }
 
@@ -39,9 +48,7 @@ const msisdnPattern = `[0-9]{9,12}`
 var msisdnRegex = regexp.MustCompile("^" + msisdnPattern + "$")
 
 func cleanMsisdnTelma(s string) (string, error) {
-	if strings.HasPrefix(s, "+") {
-		s = s[1:]
-	}
+	s = ussd.NormaliseStripPlus(s)
 	l := len(s)
 	if l < 9 || l > 12 {
 		return "", errors.Errorf("not_9_to_12_digits")
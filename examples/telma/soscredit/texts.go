@@ -0,0 +1,47 @@
+package soscredit
+
+import "bitbucket.org/vservices/ms-vservices-ussd/ussd"
+
+//texts used in soscredit menus, translated to the subscriber language
+//from UCIP account details (see getAccountDetails)
+var texts = ussd.Catalog{
+	Fallback: "FR",
+	Languages: []ussd.Language{
+		{Code: "FR", Name: "Francais"},
+		{Code: "MG", Name: "Malagasy"},
+	},
+	Texts: map[string]map[string]string{
+		"SOS_credit": {
+			"FR": "SOS credit",
+			"MG": "SOS credit",
+		},
+		"SOS_credit_for_a_friend": {
+			"FR": "SOS credit pour un ami",
+			"MG": "SOS credit ho an'ny namana",
+		},
+		"SOS_credit_from_TELMA": {
+			"FR": "SOS credit de TELMA",
+			"MG": "SOS credit avy amin'ny TELMA",
+		},
+		"SOS_credit_offer_from_TELMA": {
+			"FR": "Offre SOS credit de TELMA",
+			"MG": "Tolotra SOS credit avy amin'ny TELMA",
+		},
+		"SOS_credit_reimburse": {
+			"FR": "Rembourser SOS credit",
+			"MG": "Famerenana SOS credit",
+		},
+		"SOS_credit_help": {
+			"FR": "Aide",
+			"MG": "Fanampiana",
+		},
+		"SOS_credit_language": {
+			"FR": "Langue",
+			"MG": "Fiteny",
+		},
+		"SOS_credit_select_language": {
+			"FR": "Choisissez la langue",
+			"MG": "Safidio ny fiteny",
+		},
+	},
+}
@@ -0,0 +1,201 @@
+package kvsessions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
+	"bitbucket.org/vservices/utils/v4/errors"
+	"bitbucket.org/vservices/utils/v4/logger"
+	"github.com/nats-io/nats.go"
+)
+
+var log = logger.NewLogger()
+
+//New() returns sessions stored in a NATS JetStream key-value bucket,
+//which is created if it does not exist
+//	each session is one JSON value, and the session revision is the KV revision,
+//	so Sync() is compare-and-set with KeyValue.Update()
+//	the bucket TTL is the idle TTL (see ussd.SetSessionExpiry()), and sessions
+//	older than the max TTL are deleted when retrieved
+func New(js nats.JetStreamContext, bucket string) (*Sessions, error) {
+	kv, err := js.KeyValue(bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "USSD sessions",
+			History:     1,
+			TTL:         ussd.DefaultSessionTTL.Idle,
+		})
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot bind to KV bucket(%s)", bucket)
+	}
+	return &Sessions{
+		js:  js,
+		kv:  kv,
+		ttl: ussd.DefaultSessionTTL,
+	}, nil
+}
+
+//Sessions implements ussd.Sessions
+type Sessions struct {
+	sync.Mutex
+	js  nats.JetStreamContext
+	kv  nats.KeyValue
+	ttl ussd.SessionTTL
+}
+
+//kvSession is the value stored in the bucket
+type kvSession struct {
+	StartTime time.Time              `json:"start_time"`
+	LastTime  time.Time              `json:"last_time"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+//Expire() changes the bucket TTL to the idle TTL
+//onExpired is not called, because JetStream removes the data when the value expires
+func (ss *Sessions) Expire(ttl ussd.SessionTTL, onExpired ussd.SessionExpiredFunc) {
+	ss.Lock()
+	ss.ttl = ttl
+	ss.Unlock()
+	if onExpired != nil {
+		log.Errorf("KV sessions do not call onExpired")
+	}
+	//the bucket is a stream and its max age applies to each value since it was last stored
+	stream := "KV_" + ss.kv.Bucket()
+	info, err := ss.js.StreamInfo(stream)
+	if err != nil {
+		log.Errorf("cannot get KV bucket(%s) to set TTL: %+v", ss.kv.Bucket(), err)
+		return
+	}
+	if info.Config.MaxAge == ttl.Idle {
+		return
+	}
+	cfg := info.Config
+	cfg.MaxAge = ttl.Idle
+	if cfg.MaxAge > 0 && cfg.Duplicates > cfg.MaxAge {
+		//the server rejects a duplicates window longer than the max age
+		cfg.Duplicates = cfg.MaxAge
+	}
+	if _, err := ss.js.UpdateStream(&cfg); err != nil {
+		log.Errorf("cannot set KV bucket(%s) TTL %v: %+v", ss.kv.Bucket(), ttl.Idle, err)
+	}
+}
+
+func (ss *Sessions) getTTL() ussd.SessionTTL {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.ttl
+}
+
+func (ss *Sessions) New(id string, initData map[string]interface{}) (ussd.Session, error) {
+	//stored when synced, which replaces any session with the same id
+	t0 := time.Now()
+	return ussd.NewSession(ss, id, 0, t0, t0, initData), nil
+}
+
+func (ss *Sessions) Get(id string) (ussd.Session, error) {
+	s, revision, err := ss.get(id)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if ss.getTTL().Expired(s.StartTime, s.LastTime, time.Now()) {
+		log.Debugf("session(%s) expired", id)
+		if err := ss.kv.Delete(sessionKey(id)); err != nil {
+			log.Errorf("failed to delete expired session(%s): %+v", id, err)
+		}
+		return nil, nil
+	}
+	return ussd.NewSession(ss, id, int64(revision), s.StartTime, s.LastTime, s.Data), nil
+}
+
+//get() returns nil when the session does not exist
+func (ss *Sessions) get(id string) (*kvSession, uint64, error) {
+	entry, err := ss.kv.Get(sessionKey(id))
+	if err == nats.ErrKeyNotFound || err == nats.ErrKeyDeleted {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to get session(%s)", id)
+	}
+	var s kvSession
+	if err := json.Unmarshal(entry.Value(), &s); err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to decode session(%s)", id)
+	}
+	if s.Data == nil {
+		s.Data = map[string]interface{}{}
+	}
+	return &s, entry.Revision(), nil
+}
+
+func (ss *Sessions) Del(id string) error {
+	if err := ss.kv.Delete(sessionKey(id)); err != nil && err != nats.ErrKeyNotFound {
+		return errors.Wrapf(err, "failed to delete session(%s)", id)
+	}
+	return nil
+}
+
+//Sync() applies the updates to the stored session, only if the KV revision is still
+//the session revision, else it returns ussd.StaleSessionError
+func (ss *Sessions) Sync(id string, revision int64, set map[string]interface{}, del map[string]bool) (int64, error) {
+	now := time.Now()
+	s := &kvSession{StartTime: now, Data: map[string]interface{}{}}
+	if revision != 0 {
+		var current uint64
+		var err error
+		if s, current, err = ss.get(id); err != nil {
+			return 0, err
+		}
+		if s == nil || int64(current) != revision {
+			return 0, ussd.StaleSessionError{ID: id, Revision: revision}
+		}
+	}
+	for name := range del {
+		delete(s.Data, name)
+	}
+	for name, value := range set {
+		s.Data[name] = value
+	}
+	s.LastTime = now
+	value, err := json.Marshal(s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to encode session(%s)", id)
+	}
+
+	var newRevision uint64
+	if revision == 0 {
+		//new session replaces a stored session with the same id
+		newRevision, err = ss.kv.Put(sessionKey(id), value)
+	} else {
+		newRevision, err = ss.kv.Update(sessionKey(id), value, uint64(revision))
+		if err != nil {
+			//the JetStream error code is not returned, so check if the session was
+			//updated or deleted by another instance since it was retrieved above
+			if _, current, getErr := ss.get(id); getErr == nil && int64(current) != revision {
+				return 0, ussd.StaleSessionError{ID: id, Revision: revision}
+			}
+		}
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to sync session(%s)", id)
+	}
+	return int64(newRevision), nil
+} //Sessions.Sync()
+
+//sessionKey() escapes characters that are not valid in a KV key, e.g. "nats:2782..." -> "nats=3A2782..."
+func sessionKey(id string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "=%02X", c)
+		}
+	}
+	return b.String()
+}
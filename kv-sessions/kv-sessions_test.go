@@ -0,0 +1,206 @@
+package kvsessions
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+//testSessions() runs an embedded NATS server with JetStream and returns sessions in a new bucket
+func testSessions(t *testing.T) (nats.JetStreamContext, *Sessions) {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create NATS server: %+v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatalf("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("cannot connect to NATS: %+v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("cannot get JetStream: %+v", err)
+	}
+	ss, err := New(js, "sessions")
+	if err != nil {
+		t.Fatalf("cannot create sessions: %+v", err)
+	}
+	return js, ss
+}
+
+func TestSync(t *testing.T) {
+	_, ss := testSessions(t)
+	r1, err := ss.Sync("s1", 0, map[string]interface{}{"a": "1", "b": "2"}, nil)
+	if err != nil || r1 == 0 {
+		t.Fatalf("new -> %d, %+v", r1, err)
+	}
+	r2, err := ss.Sync("s1", r1, map[string]interface{}{"a": "3"}, map[string]bool{"b": true})
+	if err != nil || r2 <= r1 {
+		t.Fatalf("upd -> %d, %+v", r2, err)
+	}
+	s, err := ss.Get("s1")
+	if err != nil || s == nil || s.Revision() != r2 || s.Get("a") != "3" || s.Get("b") != nil {
+		t.Fatalf("get -> %+v, %+v", s, err)
+	}
+
+	//a stale revision is not applied
+	_, err = ss.Sync("s1", r1, map[string]interface{}{"a": "4"}, nil)
+	if staleErr, ok := err.(ussd.StaleSessionError); !ok || staleErr.ID != "s1" || staleErr.Revision != r1 {
+		t.Fatalf("stale -> %T %+v", err, err)
+	}
+	if s, _ := ss.Get("s1"); s == nil || s.Revision() != r2 || s.Get("a") != "3" {
+		t.Fatalf("stale update applied: %+v", s)
+	}
+
+	//revision 0 replaces the session
+	r3, err := ss.Sync("s1", 0, map[string]interface{}{"c": "5"}, nil)
+	if err != nil {
+		t.Fatalf("replace -> %+v", err)
+	}
+	if s, _ := ss.Get("s1"); s == nil || s.Revision() != r3 || s.Get("a") != nil || s.Get("c") != "5" {
+		t.Fatalf("replaced -> %+v", s)
+	}
+
+	//a deleted session is stale
+	if err := ss.Del("s1"); err != nil {
+		t.Fatalf("del: %+v", err)
+	}
+	if _, err := ss.Sync("s1", r3, map[string]interface{}{"a": "6"}, nil); !ussd.IsStaleSession(err) {
+		t.Fatalf("deleted -> %T %+v", err, err)
+	}
+	if s, err := ss.Get("s1"); err != nil || s != nil {
+		t.Fatalf("get deleted -> %+v, %+v", s, err)
+	}
+}
+
+func TestSyncConcurrent(t *testing.T) {
+	_, ss := testSessions(t)
+	revision, err := ss.Sync("s1", 0, map[string]interface{}{"n": 0}, nil)
+	if err != nil {
+		t.Fatalf("new -> %+v", err)
+	}
+	//only one of the updates with the same revision is applied, the others are stale
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for n := 1; n <= 10; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			_, err := ss.Sync("s1", revision, map[string]interface{}{"n": n}, nil)
+			errs <- err
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	nrSynced := 0
+	for err := range errs {
+		if err == nil {
+			nrSynced++
+		} else if !ussd.IsStaleSession(err) {
+			t.Fatalf("sync -> %T %+v", err, err)
+		}
+	}
+	if nrSynced != 1 {
+		t.Fatalf("%d concurrent updates applied", nrSynced)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	for id, key := range map[string]string{
+		"abc-XYZ_09":         "abc-XYZ_09",
+		"nats:27821234567":   "nats=3A27821234567",
+		"a.b*c>d e":          "a=2Eb=2Ac=3Ed=20e",
+		"a=3A":               "a=3D3A",
+		"27821234567/1.2@gw": "27821234567=2F1=2E2=40gw",
+	} {
+		if got := sessionKey(id); got != key {
+			t.Errorf("sessionKey(%s)=%s, expected %s", id, got, key)
+		}
+	}
+
+	//ids that are not valid keys can be stored, and do not clash with the escaped id
+	_, ss := testSessions(t)
+	for _, id := range []string{"nats:1.2", "nats=3A1=2E2"} {
+		if _, err := ss.Sync(id, 0, map[string]interface{}{"id": id}, nil); err != nil {
+			t.Fatalf("sync(%s) -> %+v", id, err)
+		}
+	}
+	for _, id := range []string{"nats:1.2", "nats=3A1=2E2"} {
+		if s, err := ss.Get(id); err != nil || s == nil || s.Get("id") != id {
+			t.Fatalf("get(%s) -> %+v, %+v", id, s, err)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	js, ss := testSessions(t)
+	maxAge := func() time.Duration {
+		info, err := js.StreamInfo("KV_sessions")
+		if err != nil {
+			t.Fatalf("stream info: %+v", err)
+		}
+		return info.Config.MaxAge
+	}
+	if d := maxAge(); d != ussd.DefaultSessionTTL.Idle {
+		t.Fatalf("default max age %v", d)
+	}
+	ss.Expire(ussd.SessionTTL{Idle: time.Minute, Max: 5 * time.Minute}, nil)
+	if d := maxAge(); d != time.Minute {
+		t.Fatalf("max age %v", d)
+	}
+	ss.Expire(ussd.SessionTTL{Max: 5 * time.Minute}, nil)
+	if d := maxAge(); d != 0 {
+		t.Fatalf("max age without idle ttl %v", d)
+	}
+
+	//sessions older than the max ttl are deleted when retrieved
+	t0 := time.Now().Add(-6 * time.Minute)
+	value, _ := json.Marshal(kvSession{StartTime: t0, LastTime: time.Now(), Data: map[string]interface{}{"a": "1"}})
+	if _, err := ss.kv.Put(sessionKey("old"), value); err != nil {
+		t.Fatalf("put: %+v", err)
+	}
+	if s, err := ss.Get("old"); err != nil || s != nil {
+		t.Fatalf("get old -> %+v, %+v", s, err)
+	}
+	if _, err := ss.kv.Get(sessionKey("old")); err != nats.ErrKeyNotFound && err != nats.ErrKeyDeleted {
+		t.Fatalf("old session not deleted: %+v", err)
+	}
+}
+
+func TestSyncRedial(t *testing.T) {
+	_, ss := testSessions(t)
+	//an instance holds the session at its first revision, e.g. while waiting for a service response
+	old, err := ss.Sync("s1", 0, map[string]interface{}{"a": "1"}, nil)
+	if err != nil {
+		t.Fatalf("new -> %+v", err)
+	}
+	//the user dialled again: the session is deleted and a new one started with the same id
+	ss.Del("s1")
+	revision, err := ss.Sync("s1", 0, map[string]interface{}{"a": "2"}, nil)
+	if err != nil || revision == old {
+		t.Fatalf("redial -> %d, %+v (old revision %d)", revision, err, old)
+	}
+	if _, err := ss.Sync("s1", old, map[string]interface{}{"a": "3"}, nil); !ussd.IsStaleSession(err) {
+		t.Fatalf("stale -> %T %+v", err, err)
+	}
+	if s, _ := ss.Get("s1"); s == nil || s.Revision() != revision || s.Get("a") != "2" {
+		t.Fatalf("stale update applied: %+v", s)
+	}
+}
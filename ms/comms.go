@@ -2,8 +2,8 @@ package ms
 
 type Handler interface {
 	Run(s Service) error
-	//	Subscribe(subject string, broadcast bool, callback HandlerFunc) error
-	//	Send(header map[string]string, subject string, data []byte) error
+	Subscribe(subject string, broadcast bool, callback HandlerFunc) error
+	Send(header map[string]string, subject string, data []byte) error
 }
 
 //HandlerFunc is function prototype for queue subscription handler
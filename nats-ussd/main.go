@@ -3,24 +3,71 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"time"
 
 	"bitbucket.org/vservices/ms-vservices-ussd/examples/pcm"
+	kvSessions "bitbucket.org/vservices/ms-vservices-ussd/kv-sessions"
 	"bitbucket.org/vservices/ms-vservices-ussd/ms"
 	"bitbucket.org/vservices/ms-vservices-ussd/ms/nats"
+	redisSessions "bitbucket.org/vservices/ms-vservices-ussd/redis-sessions"
 	httpSessionsClient "bitbucket.org/vservices/ms-vservices-ussd/rest-sessions/client"
 	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
 	"bitbucket.org/vservices/utils/v4/errors"
 	"bitbucket.org/vservices/utils/v4/logger"
 	datatype "bitbucket.org/vservices/utils/v4/type"
+	"github.com/go-redis/redis"
+	natsgo "github.com/nats-io/nats.go"
 )
 
 var log = logger.NewLogger()
 
 func main() {
-	//define session storage
-	ussd.SetSessions(httpSessionsClient.New("http://localhost:8100"))
+	filePtr := flag.String("file", "", "Load items from YAML/JSON file (default: none)")
+	catalogPtr := flag.String("catalog", "", "Load text translations from YAML/JSON file (default: none)")
+	codesPtr := flag.String("codes", "", "Load USSD code translations from YAML/JSON file (default: none)")
+	initItemIdPtr := flag.String("init", "", "Init item id to start all services from (default: pcm)")
+	redisPtr := flag.String("redis", "", "Store sessions in Redis at this address, e.g. localhost:6379 (default: rest-sessions)")
+	redisWatchPtr := flag.Bool("redis-watch", false, "Compare-and-set Redis session updates with WATCH/MULTI")
+	kvPtr := flag.String("kv", "", "Store sessions in this NATS JetStream key-value bucket, e.g. ussd_sessions (default: rest-sessions)")
+	flag.Parse()
+
+	//load items from file, which may refer to pcm items
+	//the file is reloaded when changed, without affecting sessions already started
+	initItem := pcm.Item()
+	if *catalogPtr != "" {
+		if err := ussd.LoadCatalogFile(*catalogPtr); err != nil {
+			panic(fmt.Sprintf("--catalog=%s failed to load: %+v", *catalogPtr, err))
+		}
+	}
+	if *codesPtr != "" {
+		codeTable, err := ussd.LoadCodeTableFile(*codesPtr)
+		if err != nil {
+			panic(fmt.Sprintf("--codes=%s failed to load: %+v", *codesPtr, err))
+		}
+		ussd.SetCodeTable(codeTable)
+	}
+	var itemsFile *ussd.VersionedFile
+	if *filePtr != "" {
+		var err error
+		if itemsFile, err = ussd.LoadVersionedFile(*filePtr); err != nil {
+			panic(fmt.Sprintf("--file=%s failed to load: %+v", *filePtr, err))
+		}
+		if err := itemsFile.Watch(); err != nil {
+			panic(fmt.Sprintf("--file=%s cannot watch: %+v", *filePtr, err))
+		}
+	}
+	if *initItemIdPtr != "" {
+		item, ok := ussd.ItemByID(*initItemIdPtr)
+		if !ok {
+			panic(fmt.Sprintf("--init=%s not found", *initItemIdPtr))
+		}
+		initItem, ok = item.(ussd.ItemSvcExec)
+		if !ok {
+			panic(fmt.Sprintf("--init=%s of type %T cannot start a session", *initItemIdPtr, item))
+		}
+	}
 
 	//define NATS interface
 	nc := nats.Config{
@@ -33,23 +80,73 @@ func main() {
 		MaxReconnects: 10,
 		ReconnectWait: datatype.Duration(time.Second * 5),
 	}
+
+	//define session storage
+	switch {
+	case *redisPtr != "" && *kvPtr != "":
+		panic("use either --redis or --kv")
+	case *redisPtr != "":
+		ussd.SetSessions(redisSessions.New(redis.NewClient(&redis.Options{Addr: *redisPtr})).WithWatch(*redisWatchPtr))
+	case *kvPtr != "":
+		kvConn, err := natsgo.Connect(nc.Url)
+		if err != nil {
+			panic(fmt.Sprintf("--kv=%s cannot connect to NATS: %+v", *kvPtr, err))
+		}
+		js, err := kvConn.JetStream()
+		if err != nil {
+			panic(fmt.Sprintf("--kv=%s cannot use JetStream: %+v", *kvPtr, err))
+		}
+		ss, err := kvSessions.New(js, *kvPtr)
+		if err != nil {
+			panic(fmt.Sprintf("--kv=%s: %+v", *kvPtr, err))
+		}
+		ussd.SetSessions(ss)
+	default:
+		ussd.SetSessions(httpSessionsClient.New("http://localhost:8100"))
+	}
+
 	commsHandler, err := nc.New()
 	if err != nil {
 		panic(fmt.Sprintf("cannot create comms handler: %+v", err))
 	}
 
-	//responder sends responses
-	... no longer needed? remove request and wait ... r := responder{ch: commsHandler}
-	ussd.AddResponder(r)
+	//responder sends responses asynchronously to the responder_key (subject) in the request,
+	//because the response may come from another instance, e.g. after an ItemSvcWait
+	ussd.AddResponder(responder{ch: commsHandler})
 
-	s := service{ch: commsHandler}
-	if err := commsHandler.Run(s); err != nil {
-		panic(err)
+	s := service{ch: commsHandler, initItem: initItem, itemsFile: itemsFile}
+
+	//service responses for ItemSvcWait are queued on a generic subject
+	//so that any instance can continue the session, not only the one that sent the request
+	if err := commsHandler.Subscribe(serviceResponseSubject, false, s.handleServiceResponse); err != nil {
+		panic(fmt.Sprintf("cannot subscribe to service responses: %+v", err))
+	}
+
+	//admin can tell all instances to reload the items file
+	if err := commsHandler.Subscribe(reloadSubject, true, s.handleReload); err != nil {
+		panic(fmt.Sprintf("cannot subscribe to reload: %+v", err))
 	}
+	//requests are sent to "ussd.<any>" with request type START, CONTINUE or ABORT,
+	//and responses are sent to header.reply_address
+	if err := commsHandler.Subscribe(nc.Domain, false, s.handleRequest); err != nil {
+		panic(fmt.Sprintf("cannot subscribe to requests: %+v", err))
+	}
+	log.Debugf("nats-ussd running...")
+	x := make(chan bool)
+	<-x
 }
 
 type service struct {
-	ch ms.Handler
+	ch        ms.Handler
+	initItem  ussd.ItemSvcExec
+	itemsFile *ussd.VersionedFile
+}
+
+//request is the ms.Message request from the USSD gateway
+type request struct {
+	Type   string `json:"type"` //START, CONTINUE or ABORT
+	Msisdn string `json:"msisdn"`
+	Text   string `json:"text"` //dialled USSD code for START, else user input
 }
 
 func (s service) handleRequest(data []byte, replyAddress string) {
@@ -60,10 +157,10 @@ func (s service) handleRequest(data []byte, replyAddress string) {
 			log.Errorf("DEFER err: %+v", err)
 			if replyAddress != "" {
 				log.Errorf("DEFER reply to %s", replyAddress)
-				res := Message{
-					Header: MessageHeader{
-						Timestamp: time.Now().Local().Format(tsformat),
-						Result: &MessageHeaderResult{
+				res := ms.Message{
+					Header: ms.MessageHeader{
+						Timestamp: time.Now().Local().Format(ms.TimestampFormat),
+						Result: &ms.MessageHeaderResult{
 							Code:        -1,
 							Description: "failed",
 							Details:     fmt.Sprintf("%+v", err),
@@ -76,10 +173,14 @@ func (s service) handleRequest(data []byte, replyAddress string) {
 		}
 	}()
 
-	var m Message
+	var m struct {
+		Header   ms.MessageHeader `json:"header"`
+		Request  *request         `json:"request,omitempty"`
+		Response interface{}      `json:"response,omitempty"`
+	}
 	err = json.Unmarshal(data, &m)
 	if err != nil {
-		err = errors.Wrapf(err, "cannot unmarshal JSON", string(data))
+		err = errors.Wrapf(err, "cannot unmarshal JSON: %s", string(data))
 		return
 	}
 
@@ -98,16 +199,17 @@ func (s service) handleRequest(data []byte, replyAddress string) {
 	}
 	ctx := context.Background()
 	id := "nats:" + m.Request.Msisdn
+	r := responder{ch: s.ch}
 	switch m.Request.Type {
 	case "START":
 		log.Debugf("Starting")
-		if err = ussd.Start(ctx, id, ussdData, pcm.Item() /*initItem*/, m.Request.Text, responder{ch: s.ch}, m.Header.ReplyAddress); err != nil {
+		if err = ussd.Start(ctx, id, ussdData, s.initItem, m.Request.Text, r, m.Header.ReplyAddress); err != nil {
 			err = errors.Wrapf(err, "failed to start USSD")
 			return
 		}
 
 	case "CONTINUE":
-		if err = ussd.UserInput(ctx, id, ussdData, m.Request.Text, responder{ch: s.ch}, m.Header.ReplyAddress); err != nil {
+		if err = ussd.UserInput(ctx, id, ussdData, m.Request.Text, r, m.Header.ReplyAddress); err != nil {
 			err = errors.Wrapf(err, "failed to continue USSD")
 			return
 		}
@@ -126,7 +228,45 @@ func (s service) handleRequest(data []byte, replyAddress string) {
 	//handling started successfully
 	//responder will take care of response
 	log.Debugf("processing done")
-	return
+} //service.handleRequest()
+
+//serviceResponseSubject is where ItemSvcWait requests must be answered
+//	send replies to "ussd-response.<any>" with the USSD session id in header.consumer.sid
+//	and the value for ItemSvcWait.Process() in response
+const serviceResponseSubject = "ussd-response"
+
+func (s service) handleServiceResponse(data []byte, replyAddress string) {
+	log.Debugf("Received service response %s", string(data))
+	var m ms.Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Errorf("discard service response: cannot unmarshal JSON: %+v", err)
+		return
+	}
+	if m.Header.Consumer == nil || m.Header.Consumer.Sid == "" {
+		log.Errorf("discard service response without header.consumer.sid: %s", string(data))
+		return
+	}
+	if err := ussd.ServiceResponse(context.Background(), m.Header.Consumer.Sid, m.Response); err != nil {
+		log.Errorf("failed to continue USSD session(%s) with service response: %+v", m.Header.Consumer.Sid, err)
+		return
+	}
+	log.Debugf("service response processed")
+}
+
+//reloadSubject is broadcast to all instances to reload the items file
+//	send any message on "ussd-reload.<any>"
+const reloadSubject = "ussd-reload"
+
+func (s service) handleReload(data []byte, replyAddress string) {
+	if s.itemsFile == nil {
+		log.Errorf("discard reload: no --file loaded")
+		return
+	}
+	if err := s.itemsFile.Reload(); err != nil {
+		log.Errorf("failed to reload items file: %+v", err)
+		return
+	}
+	log.Debugf("items file version %s active", s.itemsFile.Version())
 }
 
 // if len(subject) <= 0 {
@@ -140,11 +280,15 @@ type responder struct {
 
 func (r responder) ID() string { return "nats" }
 
+//Respond() sends the response with type RESPONSE, RELEASE or REDIRECT,
+//and for REDIRECT the message is the USSD code to start a new session with
 func (r responder) Respond(ctx context.Context, key interface{}, res ussd.Response) error {
-	log.Debugf("Respond(%v, %s, %s)...", key, res.Type, res.Text)
+	log.Debugf("Respond(%v, %s, %s)...", key, res.Type, res.Message)
 	subject := key.(string)
-	resMsg := Message{
-		Header:   MessageHeader{},
+	resMsg := ms.Message{
+		Header: ms.MessageHeader{
+			Timestamp: time.Now().Local().Format(ms.TimestampFormat),
+		},
 		Response: &res,
 	}
 	jsonRes, _ := json.Marshal(resMsg)
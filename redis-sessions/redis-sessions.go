@@ -0,0 +1,216 @@
+package redissessions
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
+	"bitbucket.org/vservices/utils/v4/errors"
+	"bitbucket.org/vservices/utils/v4/logger"
+	"github.com/go-redis/redis"
+)
+
+var log = logger.NewLogger()
+
+//New() returns sessions stored in Redis, each session as a hash with key "<prefix><id>":
+//	"_start" and "_last": start and last sync time in unix nanoseconds
+//	"_rev": revision, a new value from the counter in key "<prefix>" for each sync, so that a session
+//	that replaced another with the same id never gets the revision of the old session
+//	"d:<name>": JSON encoded session data value
+//the key expires after the idle TTL (see ussd.SetSessionExpiry()), and sessions older
+//than the max TTL are deleted when retrieved
+func New(client *redis.Client) *Sessions {
+	return &Sessions{
+		client: client,
+		prefix: "ussd:session:",
+		ttl:    ussd.DefaultSessionTTL,
+	}
+}
+
+//Sessions implements ussd.Sessions
+//by default Sync() applies the updates in a MULTI/EXEC pipeline without checking the revision,
+//so the last write wins, see WithWatch() for compare-and-set
+type Sessions struct {
+	sync.Mutex
+	client *redis.Client
+	prefix string
+	watch  bool
+	ttl    ussd.SessionTTL
+}
+
+//WithPrefix() changes the key prefix (default "ussd:session:")
+func (ss *Sessions) WithPrefix(prefix string) *Sessions {
+	ss.prefix = prefix
+	return ss
+}
+
+//WithWatch() enables compare-and-set on the revision with WATCH/MULTI/EXEC,
+//then Sync() fails with ussd.StaleSessionError when the session was updated by another instance
+func (ss *Sessions) WithWatch(enabled bool) *Sessions {
+	ss.watch = enabled
+	return ss
+}
+
+//Expire() sets the TTL, which Redis applies to the session keys
+//onExpired is not called, because Redis deletes the data when the key expires
+func (ss *Sessions) Expire(ttl ussd.SessionTTL, onExpired ussd.SessionExpiredFunc) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.ttl = ttl
+	if onExpired != nil {
+		log.Errorf("redis sessions do not call onExpired")
+	}
+}
+
+func (ss *Sessions) getTTL() ussd.SessionTTL {
+	ss.Lock()
+	defer ss.Unlock()
+	return ss.ttl
+}
+
+const dataPrefix = "d:"
+
+func (ss *Sessions) New(id string, initData map[string]interface{}) (ussd.Session, error) {
+	//stored when synced, which replaces any session with the same id
+	t0 := time.Now()
+	return ussd.NewSession(ss, id, 0, t0, t0, initData), nil
+}
+
+func (ss *Sessions) Get(id string) (ussd.Session, error) {
+	key := ss.prefix + id
+	fields, err := ss.client.HGetAll(key).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get session(%s)", id)
+	}
+	if len(fields) == 0 {
+		return nil, nil //not found
+	}
+	var revision, startNano, lastNano int64
+	data := map[string]interface{}{}
+	for field, value := range fields {
+		switch {
+		case field == "_rev":
+			revision, err = strconv.ParseInt(value, 10, 64)
+		case field == "_start":
+			startNano, err = strconv.ParseInt(value, 10, 64)
+		case field == "_last":
+			lastNano, err = strconv.ParseInt(value, 10, 64)
+		case strings.HasPrefix(field, dataPrefix):
+			var v interface{}
+			err = json.Unmarshal([]byte(value), &v)
+			data[field[len(dataPrefix):]] = v
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "session(%s) has invalid field %s=%s", id, field, value)
+		}
+	}
+	startTime, lastTime := time.Unix(0, startNano), time.Unix(0, lastNano)
+	if revision == 0 {
+		//incomplete, e.g. expired while it was synced without WATCH
+		return nil, nil
+	}
+	if ss.getTTL().Expired(startTime, lastTime, time.Now()) {
+		log.Debugf("session(%s) expired", id)
+		if err := ss.client.Del(key).Err(); err != nil {
+			log.Errorf("failed to delete expired session(%s): %+v", id, err)
+		}
+		return nil, nil
+	}
+	return ussd.NewSession(ss, id, revision, startTime, lastTime, data), nil
+} //Sessions.Get()
+
+func (ss *Sessions) Del(id string) error {
+	if err := ss.client.Del(ss.prefix + id).Err(); err != nil {
+		return errors.Wrapf(err, "failed to delete session(%s)", id)
+	}
+	return nil
+}
+
+//Sync() applies the updates with HSET/HDEL in a MULTI/EXEC pipeline, and with WithWatch()
+//only if the stored revision is still the expected revision
+func (ss *Sessions) Sync(id string, revision int64, set map[string]interface{}, del map[string]bool) (int64, error) {
+	key := ss.prefix + id
+	fields := map[string]interface{}{}
+	for name, value := range set {
+		jsonValue, err := json.Marshal(value)
+		if err != nil {
+			return 0, errors.Wrapf(err, "cannot encode session(%s) value %s=(%T)%v", id, name, value, value)
+		}
+		fields[dataPrefix+name] = string(jsonValue)
+	}
+	delFields := []string{}
+	for name := range del {
+		delFields = append(delFields, dataPrefix+name)
+	}
+	ttl := ss.getTTL()
+	now := time.Now()
+
+	//the counter is not part of the transaction, unused revisions do not matter
+	newRevision, err := ss.client.Incr(ss.prefix).Result()
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get session(%s) revision", id)
+	}
+	var existsCmd *redis.BoolCmd
+	update := func(pipe redis.Pipeliner) error {
+		existsCmd = pipe.HExists(key, "_rev")
+		if revision == 0 {
+			//new session replaces a stored session with the same id
+			pipe.Del(key)
+			pipe.HSet(key, "_start", now.UnixNano())
+		}
+		if len(fields) > 0 {
+			pipe.HMSet(key, fields)
+		}
+		if len(delFields) > 0 {
+			pipe.HDel(key, delFields...)
+		}
+		pipe.HSet(key, "_last", now.UnixNano())
+		pipe.HSet(key, "_rev", newRevision)
+		if ttl.Idle > 0 {
+			pipe.PExpire(key, ttl.Idle)
+		} else if ttl.Max > 0 && revision == 0 {
+			pipe.PExpire(key, ttl.Max)
+		}
+		return nil
+	}
+
+	if !ss.watch {
+		if _, err := ss.client.TxPipelined(update); err != nil {
+			return 0, errors.Wrapf(err, "failed to sync session(%s)", id)
+		}
+		if revision != 0 && !existsCmd.Val() {
+			//the session expired or was deleted, and the update created an incomplete hash
+			ss.client.Del(key)
+			return 0, ussd.StaleSessionError{ID: id, Revision: revision}
+		}
+		return newRevision, nil
+	}
+
+	err = ss.client.Watch(func(tx *redis.Tx) error {
+		if revision != 0 {
+			current, err := tx.HGet(key, "_rev").Int64()
+			if err == redis.Nil || (err == nil && current != revision) {
+				return ussd.StaleSessionError{ID: id, Revision: revision}
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to get session(%s) revision", id)
+			}
+		}
+		_, err := tx.Pipelined(update)
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		//updated by another instance after WATCH
+		return 0, ussd.StaleSessionError{ID: id, Revision: revision}
+	}
+	if err != nil {
+		if ussd.IsStaleSession(err) {
+			return 0, err
+		}
+		return 0, errors.Wrapf(err, "failed to sync session(%s)", id)
+	}
+	return newRevision, nil
+} //Sessions.Sync()
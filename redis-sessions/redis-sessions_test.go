@@ -0,0 +1,169 @@
+package redissessions
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+func testSessions(t *testing.T, ttl ussd.SessionTTL) (*miniredis.Miniredis, *Sessions) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	ss := New(client)
+	ss.Expire(ttl, nil)
+	return mr, ss
+}
+
+func testGet(t *testing.T, ss *Sessions, id string) ussd.Session {
+	s, err := ss.Get(id)
+	if err != nil {
+		t.Fatalf("get(%s): %+v", id, err)
+	}
+	return s
+}
+
+func TestSync(t *testing.T) {
+	for _, watch := range []bool{false, true} {
+		mr, ss := testSessions(t, ussd.SessionTTL{})
+		ss.WithWatch(watch)
+		if revision, err := ss.Sync("s1", 0, map[string]interface{}{"a": "1", "b": 2}, nil); err != nil || revision != 1 {
+			t.Fatalf("watch=%v new -> %d, %+v", watch, revision, err)
+		}
+		if revision, err := ss.Sync("s1", 1, map[string]interface{}{"a": "3"}, map[string]bool{"b": true}); err != nil || revision != 2 {
+			t.Fatalf("watch=%v upd -> %d, %+v", watch, revision, err)
+		}
+		s := testGet(t, ss, "s1")
+		if s == nil || s.Revision() != 2 || s.Get("a") != "3" || s.Get("b") != nil {
+			t.Fatalf("watch=%v get -> %+v", watch, s)
+		}
+
+		//a stale revision is only rejected with watch, else the last write wins
+		revision, err := ss.Sync("s1", 1, map[string]interface{}{"a": "4"}, nil)
+		if watch {
+			if staleErr, ok := err.(ussd.StaleSessionError); !ok || staleErr.ID != "s1" || staleErr.Revision != 1 {
+				t.Fatalf("watch=%v stale -> %d, %T %+v", watch, revision, err, err)
+			}
+			if value := mr.HGet("ussd:session:s1", "d:a"); value != `"3"` {
+				t.Fatalf("watch=%v stale update applied: %s", watch, value)
+			}
+		} else if err != nil || revision != 3 {
+			t.Fatalf("watch=%v stale -> %d, %+v", watch, revision, err)
+		}
+
+		//a deleted session is stale, and no incomplete hash is left
+		if err := ss.Del("s1"); err != nil {
+			t.Fatalf("watch=%v del: %+v", watch, err)
+		}
+		if _, err := ss.Sync("s1", 3, map[string]interface{}{"a": "5"}, nil); !ussd.IsStaleSession(err) {
+			t.Fatalf("watch=%v deleted -> %T %+v", watch, err, err)
+		}
+		if mr.Exists("ussd:session:s1") {
+			t.Fatalf("watch=%v deleted session created: %+v", watch, mr.Keys())
+		}
+	}
+}
+
+func TestSyncNewReplaces(t *testing.T) {
+	for _, watch := range []bool{false, true} {
+		mr, ss := testSessions(t, ussd.SessionTTL{})
+		ss.WithWatch(watch)
+		ss.Sync("s1", 0, map[string]interface{}{"a": "1"}, nil)
+		ss.Sync("s1", 1, map[string]interface{}{"b": "2"}, nil)
+		oldStart := mr.HGet("ussd:session:s1", "_start")
+		time.Sleep(time.Millisecond)
+
+		//revision 0 replaces the existing hash, with a new revision
+		revision, err := ss.Sync("s1", 0, map[string]interface{}{"c": "3"}, nil)
+		if err != nil || revision != 3 {
+			t.Fatalf("watch=%v replace -> %d, %+v", watch, revision, err)
+		}
+		s := testGet(t, ss, "s1")
+		if s == nil || s.Revision() != revision || s.Get("a") != nil || s.Get("b") != nil || s.Get("c") != "3" {
+			t.Fatalf("watch=%v get -> %+v", watch, s)
+		}
+		if mr.HGet("ussd:session:s1", "_start") == oldStart {
+			t.Fatalf("watch=%v start time not replaced", watch)
+		}
+	}
+}
+
+func TestSyncExpire(t *testing.T) {
+	mr, ss := testSessions(t, ussd.SessionTTL{Idle: time.Minute, Max: 10 * time.Minute})
+	ss.Sync("s1", 0, map[string]interface{}{"a": "1"}, nil)
+	if ttl := mr.TTL("ussd:session:s1"); ttl != time.Minute {
+		t.Fatalf("new ttl %v", ttl)
+	}
+	//each sync extends the idle ttl
+	mr.FastForward(50 * time.Second)
+	ss.Sync("s1", 1, map[string]interface{}{"a": "2"}, nil)
+	if ttl := mr.TTL("ussd:session:s1"); ttl != time.Minute {
+		t.Fatalf("upd ttl %v", ttl)
+	}
+	mr.FastForward(61 * time.Second)
+	if s := testGet(t, ss, "s1"); s != nil {
+		t.Fatalf("idle session not expired: %+v", s)
+	}
+
+	//without idle ttl, the key expires after the max ttl from the start
+	ss.Expire(ussd.SessionTTL{Max: 10 * time.Minute}, nil)
+	ss.Sync("s2", 0, map[string]interface{}{"a": "1"}, nil)
+	mr.FastForward(time.Minute)
+	ss.Sync("s2", 1, map[string]interface{}{"a": "2"}, nil)
+	if ttl := mr.TTL("ussd:session:s2"); ttl != 9*time.Minute {
+		t.Fatalf("max ttl %v", ttl)
+	}
+}
+
+func TestGetInvalid(t *testing.T) {
+	mr, ss := testSessions(t, ussd.SessionTTL{Max: 10 * time.Minute})
+
+	//incomplete hash without revision, e.g. updated after it expired
+	mr.HSet("ussd:session:incomplete", "d:a", `"1"`)
+	if s := testGet(t, ss, "incomplete"); s != nil {
+		t.Fatalf("incomplete -> %+v", s)
+	}
+
+	//older than the max ttl is deleted when retrieved
+	now := time.Now()
+	start := strconv.FormatInt(now.Add(-11*time.Minute).UnixNano(), 10)
+	last := strconv.FormatInt(now.UnixNano(), 10)
+	mr.HSet("ussd:session:old", "_start", start, "_last", last, "_rev", "5", "d:a", `"1"`)
+	if s := testGet(t, ss, "old"); s != nil {
+		t.Fatalf("old -> %+v", s)
+	}
+	if mr.Exists("ussd:session:old") {
+		t.Fatalf("old session not deleted")
+	}
+
+	mr.HSet("ussd:session:invalid", "_rev", "x")
+	if _, err := ss.Get("invalid"); err == nil {
+		t.Fatalf("invalid revision accepted")
+	}
+}
+
+func TestSyncRedial(t *testing.T) {
+	_, ss := testSessions(t, ussd.SessionTTL{})
+	ss.WithWatch(true)
+	//an instance holds the session at its first revision, e.g. while waiting for a service response
+	old, err := ss.Sync("s1", 0, map[string]interface{}{"a": "1"}, nil)
+	if err != nil {
+		t.Fatalf("new -> %+v", err)
+	}
+	//the user dialled again: the session is deleted and a new one started with the same id
+	ss.Del("s1")
+	revision, err := ss.Sync("s1", 0, map[string]interface{}{"a": "2"}, nil)
+	if err != nil || revision == old {
+		t.Fatalf("redial -> %d, %+v (old revision %d)", revision, err, old)
+	}
+	if _, err := ss.Sync("s1", old, map[string]interface{}{"a": "3"}, nil); !ussd.IsStaleSession(err) {
+		t.Fatalf("stale -> %T %+v", err, err)
+	}
+	if s := testGet(t, ss, "s1"); s == nil || s.Revision() != revision || s.Get("a") != "2" {
+		t.Fatalf("stale update applied: %+v", s)
+	}
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -12,7 +13,7 @@ import (
 )
 
 func New(addr string) ussd.Sessions {
-	return httpSessions{addr: addr}
+	return &httpSessions{addr: addr, ttl: ussd.DefaultSessionTTL}
 }
 
 var log = logger.NewLogger()
@@ -20,12 +21,27 @@ var log = logger.NewLogger()
 //implements ussd.Sessions
 type httpSessions struct {
 	addr string
+	ttl  ussd.SessionTTL
 }
 
-func (c httpSessions) New(id string, initData map[string]interface{}) (ussd.Session, error) {
+//Expire() sets the ttl sent to the server for new sessions
+//the server deletes expired sessions and notifies the service (see rest-sessions --notify),
+//so onExpired is not called in this process
+func (c *httpSessions) Expire(ttl ussd.SessionTTL, onExpired ussd.SessionExpiredFunc) {
+	c.ttl = ttl
+	if onExpired != nil {
+		log.Errorf("rest-sessions client does not call onExpired, use rest-sessions --notify=<url>")
+	}
+}
+
+func (c *httpSessions) New(id string, initData map[string]interface{}) (ussd.Session, error) {
 	hs := httpSession{
 		ID:   id,
 		Data: initData,
+		TTL: &httpSessionTTL{
+			Idle: int(c.ttl.Idle / time.Second),
+			Max:  int(c.ttl.Max / time.Second),
+		},
 	}
 	buf := bytes.NewBuffer(nil)
 	json.NewEncoder(buf).Encode(hs)
@@ -50,6 +66,7 @@ func (c httpSessions) New(id string, initData map[string]interface{}) (ussd.Sess
 		return ussd.NewSession(
 			c,
 			id,
+			hs.Revision,
 			*hs.StartTime,
 			*hs.LastTime,
 			initData,
@@ -59,7 +76,7 @@ func (c httpSessions) New(id string, initData map[string]interface{}) (ussd.Sess
 	}
 }
 
-func (c httpSessions) Get(id string) (ussd.Session, error) {
+func (c *httpSessions) Get(id string) (ussd.Session, error) {
 	httpReq, _ := http.NewRequest(
 		http.MethodGet,
 		c.addr+"/session/"+id,
@@ -82,6 +99,7 @@ func (c httpSessions) Get(id string) (ussd.Session, error) {
 		return ussd.NewSession(
 			c,
 			id,
+			hs.Revision,
 			*hs.StartTime,
 			*hs.LastTime,
 			hs.Data,
@@ -93,7 +111,7 @@ func (c httpSessions) Get(id string) (ussd.Session, error) {
 	}
 }
 
-func (c httpSessions) Del(id string) error {
+func (c *httpSessions) Del(id string) error {
 	httpReq, _ := http.NewRequest(
 		http.MethodDelete,
 		c.addr+"/session/"+id,
@@ -110,10 +128,27 @@ func (c httpSessions) Del(id string) error {
 	}
 }
 
-func (c httpSessions) Sync(id string, set map[string]interface{}, del map[string]bool) error {
+//SessionNotFoundError is returned by Sync() when the server responds 404 Not Found,
+//i.e. the session expired or was deleted, so it cannot continue
+type SessionNotFoundError struct {
+	ID string
+}
+
+func (e SessionNotFoundError) Error() string {
+	return fmt.Sprintf("session(%s) not found", e.ID)
+}
+
+//Sync() fails with ussd.StaleSessionError when the server responds 409 Conflict,
+//i.e. the session was updated by another instance, or with SessionNotFoundError
+//when the server responds 404 Not Found
+func (c *httpSessions) Sync(id string, revision int64, set map[string]interface{}, del map[string]bool) (int64, error) {
 	hs := httpSession{
-		ID:   id,
-		Data: set,
+		ID:       id,
+		Data:     map[string]interface{}{}, //not set, which the session keeps when sync failed
+		Revision: revision,
+	}
+	for n, v := range set {
+		hs.Data[n] = v
 	}
 	for n := range del {
 		hs.Data[n] = nil
@@ -126,17 +161,21 @@ func (c httpSessions) Sync(id string, set map[string]interface{}, del map[string
 		buf)
 	httpRes, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
-		return errors.Wrapf(err, "failed to access HTTP session")
+		return 0, errors.Wrapf(err, "failed to access HTTP session")
 	}
 	switch httpRes.StatusCode {
 	case http.StatusOK:
 		if err := json.NewDecoder(httpRes.Body).Decode(&hs); err != nil {
-			return errors.Wrapf(err, "failed to decode HTTP session")
+			return 0, errors.Wrapf(err, "failed to decode HTTP session")
 		}
 		log.Debugf("Synced: %+v", hs)
-		return nil
+		return hs.Revision, nil
+	case http.StatusConflict:
+		return 0, ussd.StaleSessionError{ID: id, Revision: revision}
+	case http.StatusNotFound:
+		return 0, SessionNotFoundError{ID: id}
 	default:
-		return errors.Errorf("failed to sync session: %+v", httpRes.Status)
+		return 0, errors.Errorf("failed to sync session: %+v", httpRes.Status)
 	}
 }
 
@@ -145,4 +184,12 @@ type httpSession struct {
 	Data      map[string]interface{} `json:"data,omitempty"`
 	StartTime *time.Time             `json:"start_time,omitempty"`
 	LastTime  *time.Time             `json:"last_time,omitempty"`
+	TTL       *httpSessionTTL        `json:"ttl,omitempty"`
+	Revision  int64                  `json:"revision,omitempty"`
+}
+
+//httpSessionTTL is in seconds, 0 for no limit
+type httpSessionTTL struct {
+	Idle int `json:"idle"`
+	Max  int `json:"max"`
 }
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
+)
+
+func TestSyncStatus(t *testing.T) {
+	//the server responds with the status in the session data
+	server := httptest.NewServer(http.HandlerFunc(func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		var hs httpSession
+		json.NewDecoder(httpReq.Body).Decode(&hs)
+		switch hs.Data["status"] {
+		case "conflict":
+			http.Error(httpRes, "session revision is stale", http.StatusConflict)
+		case "not_found":
+			http.Error(httpRes, "session not found", http.StatusNotFound)
+		case "fail":
+			http.Error(httpRes, "failed to store session", http.StatusInternalServerError)
+		default:
+			hs.Revision++
+			json.NewEncoder(httpRes).Encode(hs)
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL)
+
+	if revision, err := c.Sync("s1", 3, map[string]interface{}{"status": "ok"}, nil); err != nil || revision != 4 {
+		t.Fatalf("sync -> %d, %+v", revision, err)
+	}
+	_, err := c.Sync("s1", 3, map[string]interface{}{"status": "conflict"}, nil)
+	if staleErr, ok := err.(ussd.StaleSessionError); !ok || staleErr.ID != "s1" || staleErr.Revision != 3 {
+		t.Fatalf("conflict -> %T %+v", err, err)
+	}
+	_, err = c.Sync("s1", 3, map[string]interface{}{"status": "not_found"}, nil)
+	if _, ok := err.(SessionNotFoundError); !ok || ussd.IsStaleSession(err) {
+		t.Fatalf("not found -> %T %+v", err, err)
+	}
+	_, err = c.Sync("s1", 3, map[string]interface{}{"status": "fail"}, nil)
+	if _, ok := err.(SessionNotFoundError); err == nil || ok || ussd.IsStaleSession(err) {
+		t.Fatalf("fail -> %T %+v", err, err)
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -12,13 +15,34 @@ import (
 var log = logger.NewLogger()
 
 func main() {
+	listenPtr := flag.String("listen", ":8100", "HTTP listen address")
+	filePtr := flag.String("file", "", "Append-only file to store sessions in, loaded at startup (default: memory only)")
+	idlePtr := flag.Duration("idle", 3*time.Minute, "Default time after last update when a session expires (0 for no limit)")
+	maxPtr := flag.Duration("max", 10*time.Minute, "Default time after start when a session expires (0 for no limit)")
+	notifyPtr := flag.String("notify", "", "URL to POST each expired session to (default: none)")
+	flag.Parse()
+	defaultTTL = sessionTTL{Idle: int(*idlePtr / time.Second), Max: int(*maxPtr / time.Second)}
+	notifyURL = *notifyPtr
+	var err error
+	if sessions, err = openStore(*filePtr); err != nil {
+		panic(fmt.Sprintf("--file=%s: %+v", *filePtr, err))
+	}
+	go reaper()
+	go notifier()
+
+	http.Handle("/", router())
+	if err := http.ListenAndServe(*listenPtr, nil); err != nil {
+		panic(fmt.Sprintf("--listen=%s: %+v", *listenPtr, err))
+	}
+}
+
+func router() *mux.Router {
 	mux := mux.NewRouter()
 	mux.HandleFunc("/session/{id}", handleNewSession).Methods(http.MethodPost)
 	mux.HandleFunc("/session/{id}", handleGetSession).Methods(http.MethodGet)
 	mux.HandleFunc("/session/{id}", handleUpdSession).Methods(http.MethodPut)
 	mux.HandleFunc("/session/{id}", handleDelSession).Methods(http.MethodDelete)
-	http.Handle("/", mux)
-	http.ListenAndServe(":8100", nil)
+	return mux
 }
 
 type session struct {
@@ -26,12 +50,101 @@ type session struct {
 	Data      map[string]interface{} `json:"data,omitempty"`
 	StartTime *time.Time             `json:"start_time,omitempty"`
 	LastTime  *time.Time             `json:"last_time,omitempty"`
+	TTL       *sessionTTL            `json:"ttl,omitempty"`
+	Revision  int64                  `json:"revision,omitempty"`
+}
+
+//sessionTTL is in seconds, 0 for no limit
+//it is specified when the session is created, else the --idle and --max values apply
+type sessionTTL struct {
+	Idle int `json:"idle"`
+	Max  int `json:"max"`
+}
+
+func (s session) expired(now time.Time) bool {
+	ttl := defaultTTL
+	if s.TTL != nil {
+		ttl = *s.TTL
+	}
+	return (ttl.Idle > 0 && s.LastTime != nil && now.Sub(*s.LastTime) > time.Duration(ttl.Idle)*time.Second) ||
+		(ttl.Max > 0 && s.StartTime != nil && now.Sub(*s.StartTime) > time.Duration(ttl.Max)*time.Second)
 }
 
 var (
-	sessions = map[string]session{}
+	sessions   *store
+	defaultTTL sessionTTL
+	notifyURL  string
 )
 
+//reaper() deletes expired sessions, so sessions that were never deleted
+//(e.g. the user dropped mid-menu or the gateway never sent RELEASE) do not stay forever
+func reaper() {
+	for {
+		time.Sleep(time.Second)
+		for _, s := range reap(time.Now()) {
+			if notifyURL == "" {
+				continue
+			}
+			//notify in the background, so a slow --notify URL does not delay the reaper
+			select {
+			case notifyQueue <- s:
+			default:
+				log.Errorf("notify queue full, expired session(%s) not notified", s.ID)
+			}
+		}
+	}
+}
+
+//reap() deletes the sessions that expired at time now and returns them
+func reap(now time.Time) []session {
+	expired := []session{}
+	sessions.Lock()
+	defer sessions.Unlock()
+	for id, s := range sessions.sessions {
+		if s.expired(now) {
+			if err := sessions.del(id); err != nil {
+				log.Errorf("failed to delete expired session(%s): %+v", id, err)
+				continue
+			}
+			log.Debugf("expired session(%s): %+v", s.ID, s)
+			expired = append(expired, s)
+		}
+	}
+	return expired
+} //reap()
+
+var (
+	//notifyQueue holds expired sessions to post to --notify
+	notifyQueue = make(chan session, 1000)
+	//notifyClient limits the time a --notify request may take
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+//notifier() posts the sessions in notifyQueue one by one
+func notifier() {
+	for s := range notifyQueue {
+		notifyExpired(s)
+	}
+}
+
+//notifyExpired() posts the expired session to --notify, e.g. for the service to write a CDR
+func notifyExpired(s session) {
+	if notifyURL == "" {
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	json.NewEncoder(buf).Encode(s)
+	httpRes, err := notifyClient.Post(notifyURL, "application/json", buf)
+	if err != nil {
+		log.Errorf("failed to notify expired session(%s): %+v", s.ID, err)
+		return
+	}
+	httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		log.Errorf("failed to notify expired session(%s): %s", s.ID, httpRes.Status)
+	}
+}
+
 func handleNewSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 	id := mux.Vars(httpReq)["id"]
 	if id == "" {
@@ -39,13 +152,16 @@ func handleNewSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 	var s session
-	json.NewDecoder(httpReq.Body).Decode(&s)
+	if err := json.NewDecoder(httpReq.Body).Decode(&s); err != nil {
+		http.Error(httpRes, "invalid JSON session: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	if s.ID != "" && s.ID != id {
 		http.Error(httpRes, "id in URL and body does not match", http.StatusBadRequest)
 		return
 	}
-	if s.StartTime != nil || s.LastTime != nil {
-		http.Error(httpRes, "start_time and last_time may not be specified for new session", http.StatusBadRequest)
+	if s.StartTime != nil || s.LastTime != nil || s.Revision != 0 {
+		http.Error(httpRes, "start_time, last_time and revision may not be specified for new session", http.StatusBadRequest)
 		return
 	}
 	s.ID = id
@@ -54,10 +170,23 @@ func handleNewSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 			delete(s.Data, n)
 		}
 	}
+	if s.TTL != nil && (s.TTL.Idle < 0 || s.TTL.Max < 0) {
+		http.Error(httpRes, "ttl may not be negative", http.StatusBadRequest)
+		return
+	}
 	t0 := time.Now()
 	s.StartTime = &t0
 	s.LastTime = &t0
-	sessions[id] = s
+	sessions.Lock()
+	//a new revision, also when it replaces an existing session, so updates with the old revision fail
+	s.Revision = sessions.nextRevision()
+	err := sessions.set(s)
+	sessions.Unlock()
+	if err != nil {
+		log.Errorf("failed to store session(%s): %+v", id, err)
+		http.Error(httpRes, "failed to store session", http.StatusInternalServerError)
+		return
+	}
 	log.Debugf("new session(%s): %+v", id, s)
 	httpRes.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(httpRes).Encode(s)
@@ -70,7 +199,9 @@ func handleGetSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 	names := httpReq.URL.Query()["names"]
-	if s, ok := sessions[id]; ok {
+	sessions.RLock()
+	defer sessions.RUnlock()
+	if s, ok := sessions.sessions[id]; ok && !s.expired(time.Now()) {
 		//found the session
 		httpRes.Header().Set("Content-Type", "application/json")
 		//return whole session or selected names only
@@ -83,6 +214,8 @@ func handleGetSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 				Data:      map[string]interface{}{},
 				StartTime: s.StartTime,
 				LastTime:  s.LastTime,
+				TTL:       s.TTL,
+				Revision:  s.Revision,
 			}
 			for _, name := range names {
 				if value, ok := s.Data[name]; ok {
@@ -97,44 +230,66 @@ func handleGetSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 	http.Error(httpRes, "session not found", http.StatusNotFound)
 }
 
+//handleUpdSession() applies the update if the revision in the request is the current revision,
+//else it responds with 409 Conflict, so that concurrent updates are not lost
+//the revision is required: requests without revision are rejected with 400 Bad Request
 func handleUpdSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 	id := mux.Vars(httpReq)["id"]
 	if id == "" {
 		http.Error(httpRes, "missing id", http.StatusBadRequest)
 		return
 	}
-	s, ok := sessions[id]
-	if !ok {
-		http.Error(httpRes, "session not found", http.StatusNotFound)
+	var upd session
+	if err := json.NewDecoder(httpReq.Body).Decode(&upd); err != nil {
+		http.Error(httpRes, "invalid JSON session: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	var upd session
-	json.NewDecoder(httpReq.Body).Decode(&upd)
 	if upd.ID != "" && upd.ID != id {
 		http.Error(httpRes, "id in URL and body does not match", http.StatusBadRequest)
 		return
 	}
-	if upd.StartTime != nil || upd.LastTime != nil {
-		http.Error(httpRes, "start_time and last_time may not be specified in request", http.StatusBadRequest)
+	if upd.StartTime != nil || upd.LastTime != nil || upd.TTL != nil {
+		http.Error(httpRes, "start_time, last_time and ttl may not be specified in request", http.StatusBadRequest)
 		return
 	}
+	if upd.Revision <= 0 {
+		http.Error(httpRes, "missing revision", http.StatusBadRequest)
+		return
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.sessions[id]
+	if !ok || s.expired(time.Now()) {
+		http.Error(httpRes, "session not found", http.StatusNotFound)
+		return
+	}
+	if upd.Revision != s.Revision {
+		log.Debugf("upd session(%s) revision %d is stale, current revision %d", id, upd.Revision, s.Revision)
+		http.Error(httpRes, "session revision is stale", http.StatusConflict)
+		return
+	}
+
+	//update a copy, so the stored session is unchanged when it cannot be written to the file
+	data := make(map[string]interface{}, len(s.Data)+len(upd.Data))
+	for n, v := range s.Data {
+		data[n] = v
+	}
 	for n, v := range upd.Data {
 		if v != nil {
-			if s.Data == nil {
-				s.Data = map[string]interface{}{n: v}
-			} else {
-				s.Data[n] = v
-			}
+			data[n] = v
 		} else {
-			if s.Data != nil {
-				delete(s.Data, n)
-			}
+			delete(data, n)
 		}
 	}
+	s.Data = data
 	t1 := time.Now()
 	s.LastTime = &t1
-	sessions[id] = s
+	s.Revision = sessions.nextRevision()
+	if err := sessions.set(s); err != nil {
+		log.Errorf("failed to store session(%s): %+v", id, err)
+		http.Error(httpRes, "failed to store session", http.StatusInternalServerError)
+		return
+	}
 	log.Debugf("upd session(%s): %+v", id, s)
 	httpRes.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(httpRes).Encode(s)
@@ -147,5 +302,11 @@ func handleDelSession(httpRes http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 	log.Debugf("delete session(%s)", id)
-	delete(sessions, id)
+	sessions.Lock()
+	err := sessions.del(id)
+	sessions.Unlock()
+	if err != nil {
+		log.Errorf("failed to delete session(%s): %+v", id, err)
+		http.Error(httpRes, "failed to delete session", http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testSession() returns a session that started and was last updated at the times before now
+func testSession(id string, start, last time.Duration, ttl *sessionTTL) session {
+	now := time.Now()
+	startTime := now.Add(-start)
+	lastTime := now.Add(-last)
+	return session{ID: id, Data: map[string]interface{}{"a": "1"}, StartTime: &startTime, LastTime: &lastTime, TTL: ttl, Revision: 1}
+}
+
+func TestReap(t *testing.T) {
+	sessions, _ = openStore("")
+	defaultTTL = sessionTTL{Idle: 60, Max: 600}
+	for _, s := range []session{
+		testSession("active", 5*time.Minute, 10*time.Second, nil),
+		testSession("idle", 5*time.Minute, 2*time.Minute, nil),
+		testSession("max", 11*time.Minute, 10*time.Second, nil),
+		testSession("own_ttl", 5*time.Minute, 2*time.Minute, &sessionTTL{Idle: 180}),
+		testSession("own_ttl_idle", 5*time.Minute, 4*time.Minute, &sessionTTL{Idle: 180}),
+	} {
+		sessions.set(s)
+	}
+
+	expired := map[string]bool{}
+	for _, s := range reap(time.Now()) {
+		expired[s.ID] = true
+	}
+	if len(expired) != 3 || !expired["idle"] || !expired["max"] || !expired["own_ttl_idle"] {
+		t.Fatalf("expired %+v", expired)
+	}
+	if len(sessions.sessions) != 2 {
+		t.Fatalf("remaining %+v", sessions.sessions)
+	}
+	if _, ok := sessions.sessions["own_ttl"]; !ok {
+		t.Fatalf("session with own ttl reaped")
+	}
+	if expired := reap(time.Now()); len(expired) != 0 {
+		t.Fatalf("reaped again: %+v", expired)
+	}
+}
+
+func TestNotifyExpired(t *testing.T) {
+	posted := make(chan session, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		var s session
+		if httpReq.Method != http.MethodPost || json.NewDecoder(httpReq.Body).Decode(&s) != nil {
+			http.Error(httpRes, "bad request", http.StatusBadRequest)
+		}
+		posted <- s
+	}))
+	defer server.Close()
+	notifyURL = server.URL
+	defer func() { notifyURL = "" }()
+
+	notifyExpired(testSession("notified", time.Minute, time.Minute, nil))
+	select {
+	case s := <-posted:
+		if s.ID != "notified" || s.Data["a"] != "1" || s.Revision != 1 {
+			t.Fatalf("posted %+v", s)
+		}
+	default:
+		t.Fatalf("not posted")
+	}
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	notifyURL = server.URL
+	defer func() { notifyURL = "" }()
+	timeout := notifyClient.Timeout
+	notifyClient.Timeout = 100 * time.Millisecond
+	defer func() { notifyClient.Timeout = timeout }()
+
+	t0 := time.Now()
+	notifyExpired(testSession("slow", time.Minute, time.Minute, nil))
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("notify took %v", d)
+	}
+}
+
+//testRequest() sends the request to the server handlers and returns the status and decoded session
+func testRequest(t *testing.T, method, id string, body interface{}) (int, session) {
+	var reqBody io.Reader
+	if s, ok := body.(string); ok {
+		reqBody = strings.NewReader(s)
+	} else if body != nil {
+		buf := bytes.NewBuffer(nil)
+		json.NewEncoder(buf).Encode(body)
+		reqBody = buf
+	}
+	httpRes := httptest.NewRecorder()
+	router().ServeHTTP(httpRes, httptest.NewRequest(method, "/session/"+id, reqBody))
+	var s session
+	if httpRes.Code == http.StatusOK && httpRes.Body.Len() > 0 {
+		if err := json.NewDecoder(httpRes.Body).Decode(&s); err != nil {
+			t.Fatalf("%s %s: cannot decode response: %+v", method, id, err)
+		}
+	}
+	return httpRes.Code, s
+}
+
+func TestUpdSessionRevision(t *testing.T) {
+	sessions, _ = openStore("")
+	defaultTTL = sessionTTL{}
+	if status, s := testRequest(t, http.MethodPost, "upd", session{Data: map[string]interface{}{"a": "1"}}); status != http.StatusOK || s.Revision != 1 {
+		t.Fatalf("new -> %d %+v", status, s)
+	}
+	if status, s := testRequest(t, http.MethodPut, "upd", session{Data: map[string]interface{}{"a": "2"}, Revision: 1}); status != http.StatusOK || s.Revision != 2 || s.Data["a"] != "2" {
+		t.Fatalf("upd -> %d %+v", status, s)
+	}
+
+	//a stale revision or no revision is not applied
+	if status, _ := testRequest(t, http.MethodPut, "upd", session{Data: map[string]interface{}{"a": "3"}, Revision: 1}); status != http.StatusConflict {
+		t.Fatalf("stale upd -> %d", status)
+	}
+	if status, _ := testRequest(t, http.MethodPut, "upd", session{Data: map[string]interface{}{"a": "4"}}); status != http.StatusBadRequest {
+		t.Fatalf("upd without revision -> %d", status)
+	}
+	if status, _ := testRequest(t, http.MethodPut, "upd", `{"data":{"a":"5"},"revision":0}`); status != http.StatusBadRequest {
+		t.Fatalf("upd with revision 0 -> %d", status)
+	}
+	if status, s := testRequest(t, http.MethodGet, "upd", nil); status != http.StatusOK || s.Revision != 2 || s.Data["a"] != "2" {
+		t.Fatalf("get -> %d %+v", status, s)
+	}
+
+	//a new session with the same id replaces it, so the old revision is stale
+	testRequest(t, http.MethodPost, "upd", session{})
+	if status, _ := testRequest(t, http.MethodPut, "upd", session{Data: map[string]interface{}{"a": "6"}, Revision: 2}); status != http.StatusConflict {
+		t.Fatalf("upd replaced session -> %d", status)
+	}
+	if status, _ := testRequest(t, http.MethodPut, "unknown", session{Revision: 1}); status != http.StatusNotFound {
+		t.Fatalf("upd unknown session -> %d", status)
+	}
+}
+
+func TestInvalidJSON(t *testing.T) {
+	sessions, _ = openStore("")
+	defaultTTL = sessionTTL{}
+	if status, _ := testRequest(t, http.MethodPost, "bad", `{"data":`); status != http.StatusBadRequest {
+		t.Fatalf("new -> %d", status)
+	}
+	if _, ok := sessions.sessions["bad"]; ok {
+		t.Fatalf("invalid session stored")
+	}
+	testRequest(t, http.MethodPost, "bad", session{Data: map[string]interface{}{"a": "1"}})
+	if status, _ := testRequest(t, http.MethodPut, "bad", `{"data":{"a":2},"revision":"1"}`); status != http.StatusBadRequest {
+		t.Fatalf("upd -> %d", status)
+	}
+	if s := sessions.sessions["bad"]; s.Revision != 1 || s.Data["a"] != "1" {
+		t.Fatalf("updated with invalid request: %+v", s)
+	}
+}
+
+func TestRedialRevision(t *testing.T) {
+	sessions, _ = openStore("")
+	defaultTTL = sessionTTL{}
+	//an instance holds the session at its first revision, e.g. while waiting for a service response
+	_, old := testRequest(t, http.MethodPost, "redial", session{Data: map[string]interface{}{"a": "1"}})
+	//the user dialled again: the session is deleted and a new one started with the same id
+	testRequest(t, http.MethodDelete, "redial", nil)
+	if status, s := testRequest(t, http.MethodPost, "redial", session{Data: map[string]interface{}{"a": "2"}}); status != http.StatusOK || s.Revision == old.Revision {
+		t.Fatalf("new -> %d %+v (old revision %d)", status, s, old.Revision)
+	}
+	if status, _ := testRequest(t, http.MethodPut, "redial", session{Data: map[string]interface{}{"a": "3"}, Revision: old.Revision}); status != http.StatusConflict {
+		t.Fatalf("stale upd -> %d", status)
+	}
+	if _, s := testRequest(t, http.MethodGet, "redial", nil); s.Data["a"] != "2" {
+		t.Fatalf("stale update applied: %+v", s)
+	}
+}
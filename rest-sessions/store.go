@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//store keeps sessions in memory, and when a file is specified also in an append-only
+//file of JSON records, which is loaded when the server starts, so sessions survive a restart
+//	every new/updated session is appended as {"session":{...}} and deleted as {"del":"<id>"}
+//	the file is compacted (rewritten with only the current sessions) when loaded and when
+//	it holds many more records than sessions, and then starts with {"last_revision":<n>}
+//revisions are unique in the store, so a session that replaced another with the same id
+//never gets the revision of the old session
+//callers must hold the lock: RLock() to read sessions, Lock() to call set() or del()
+type store struct {
+	sync.RWMutex
+	sessions  map[string]session
+	filename  string
+	file         *os.File
+	nrRecords    int   //in the file
+	lastRevision int64 //of any session
+}
+
+type storeRecord struct {
+	Session      *session `json:"session,omitempty"`
+	Del          string   `json:"del,omitempty"`
+	LastRevision int64    `json:"last_revision,omitempty"`
+}
+
+//compact when the file has this many records and 10 times more records than sessions
+const storeCompactRecords = 10000
+
+//openStore() loads the sessions from the file, or returns an empty store when filename is ""
+func openStore(filename string) (*store, error) {
+	st := &store{
+		sessions: map[string]session{},
+		filename: filename,
+	}
+	if filename == "" {
+		return st, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "cannot open file %s", filename)
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		lineNr := 0
+		for scanner.Scan() {
+			lineNr++
+			var r storeRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				//last record may be incomplete when the server stopped while writing it
+				log.Errorf("file %s line %d ignored: %+v", filename, lineNr, err)
+				continue
+			}
+			if r.LastRevision > st.lastRevision {
+				st.lastRevision = r.LastRevision
+			}
+			if r.Session != nil {
+				st.sessions[r.Session.ID] = *r.Session
+				if r.Session.Revision > st.lastRevision {
+					st.lastRevision = r.Session.Revision
+				}
+			} else if r.Del != "" {
+				delete(st.sessions, r.Del)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrapf(err, "cannot read file %s", filename)
+		}
+	}
+	now := time.Now()
+	for id, s := range st.sessions {
+		if s.expired(now) {
+			delete(st.sessions, id)
+		}
+	}
+	if err := st.compact(); err != nil {
+		return nil, err
+	}
+	log.Debugf("loaded %d sessions from file %s", len(st.sessions), filename)
+	return st, nil
+} //openStore()
+
+//nextRevision() returns the revision for a new or updated session
+func (st *store) nextRevision() int64 {
+	st.lastRevision++
+	return st.lastRevision
+}
+
+//set() stores the new or updated session
+func (st *store) set(s session) error {
+	if err := st.write(storeRecord{Session: &s}); err != nil {
+		return err
+	}
+	st.sessions[s.ID] = s
+	if s.Revision > st.lastRevision {
+		st.lastRevision = s.Revision
+	}
+	return nil
+}
+
+//del() deletes the session if it exists
+func (st *store) del(id string) error {
+	if _, ok := st.sessions[id]; !ok {
+		return nil
+	}
+	if err := st.write(storeRecord{Del: id}); err != nil {
+		return err
+	}
+	delete(st.sessions, id)
+	return nil
+}
+
+func (st *store) write(r storeRecord) error {
+	if st.file == nil {
+		return nil
+	}
+	if st.nrRecords >= storeCompactRecords && st.nrRecords > 10*len(st.sessions) {
+		if err := st.compact(); err != nil {
+			//keep appending to the current file
+			log.Errorf("%+v", err)
+		}
+	}
+	jsonRecord, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode session")
+	}
+	if _, err := st.file.Write(append(jsonRecord, '\n')); err != nil {
+		return errors.Wrapf(err, "cannot write to file %s", st.filename)
+	}
+	st.nrRecords++
+	return nil
+}
+
+//compact() replaces the file with one that contains only the current sessions
+func (st *store) compact() error {
+	tmpFilename := st.filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create file %s", tmpFilename)
+	}
+	w := bufio.NewWriter(f)
+	nrRecords := len(st.sessions)
+	if st.lastRevision > 0 {
+		//keep the last revision, which may be of a deleted session
+		jsonRecord, _ := json.Marshal(storeRecord{LastRevision: st.lastRevision})
+		w.Write(append(jsonRecord, '\n'))
+		nrRecords++
+	}
+	for _, s := range st.sessions {
+		s := s
+		jsonRecord, err := json.Marshal(storeRecord{Session: &s})
+		if err != nil {
+			f.Close()
+			return errors.Wrapf(err, "cannot encode session(%s)", s.ID)
+		}
+		w.Write(append(jsonRecord, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "cannot write file %s", tmpFilename)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "cannot write file %s", tmpFilename)
+	}
+	if err := os.Rename(tmpFilename, st.filename); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "cannot replace file %s", st.filename)
+	}
+	//continue appending to the new file
+	if st.file != nil {
+		st.file.Close()
+	}
+	st.file = f
+	st.nrRecords = nrRecords
+	return nil
+} //store.compact()
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testLines(t *testing.T, filename string) []string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("cannot open %s: %+v", filename, err)
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func testStoreSession(id string, revision int64, value string) session {
+	t0 := time.Now()
+	return session{ID: id, Data: map[string]interface{}{"value": value}, StartTime: &t0, LastTime: &t0, Revision: revision}
+}
+
+func TestStoreReplay(t *testing.T) {
+	defaultTTL = sessionTTL{}
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	st, err := openStore(filename)
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+	st.set(testStoreSession("s1", 1, "a"))
+	st.set(testStoreSession("s2", 7, "b"))
+	st.set(testStoreSession("s1", 2, "c"))
+	st.del("s2")
+	st.set(testStoreSession("s3", 1, "d"))
+	st.file.Close()
+	if lines := testLines(t, filename); len(lines) != 5 {
+		t.Fatalf("appended %d records: %+v", len(lines), lines)
+	}
+
+	st, err = openStore(filename)
+	if err != nil {
+		t.Fatalf("reopen: %+v", err)
+	}
+	if len(st.sessions) != 2 || st.sessions["s1"].Revision != 2 || st.sessions["s1"].Data["value"] != "c" || st.sessions["s3"].Data["value"] != "d" {
+		t.Fatalf("replayed %+v", st.sessions)
+	}
+	//compacted when loaded, keeping the last revision of the deleted session
+	if lines := testLines(t, filename); len(lines) != 3 || st.nrRecords != 3 || lines[0] != `{"last_revision":7}` {
+		t.Fatalf("compacted to %d records (%d): %+v", len(lines), st.nrRecords, lines)
+	}
+	st.file.Close()
+	if st, err = openStore(filename); err != nil {
+		t.Fatalf("reopen: %+v", err)
+	}
+	defer st.file.Close()
+	if revision := st.nextRevision(); revision != 8 {
+		t.Fatalf("next revision %d after reopen", revision)
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	defaultTTL = sessionTTL{}
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	st, err := openStore(filename)
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+	defer func() { st.file.Close() }()
+	for n := 0; n < 10; n++ {
+		st.set(testStoreSession("keep", 1, "a"))
+	}
+	//not compacted before storeCompactRecords
+	for n := 10; n < storeCompactRecords; n++ {
+		st.set(testStoreSession("upd", int64(n), "b"))
+	}
+	if lines := testLines(t, filename); len(lines) != storeCompactRecords || st.nrRecords != storeCompactRecords {
+		t.Fatalf("%d records (%d) before compaction", len(lines), st.nrRecords)
+	}
+	//compacted on the next write, then the record is appended to the new file
+	st.set(testStoreSession("upd", storeCompactRecords, "c"))
+	if lines := testLines(t, filename); len(lines) != 4 || st.nrRecords != 4 {
+		t.Fatalf("%d records (%d) after compaction", len(lines), st.nrRecords)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("tmp file not renamed: %+v", err)
+	}
+
+	st.file.Close()
+	st, err = openStore(filename)
+	if err != nil {
+		t.Fatalf("reopen: %+v", err)
+	}
+	if len(st.sessions) != 2 || st.sessions["upd"].Data["value"] != "c" || st.sessions["upd"].Revision != storeCompactRecords {
+		t.Fatalf("replayed %+v", st.sessions)
+	}
+}
+
+func TestStoreNoCompactManySessions(t *testing.T) {
+	defaultTTL = sessionTTL{}
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	st, err := openStore(filename)
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+	defer st.file.Close()
+	//not compacted while there are not 10 times more records than sessions
+	nrSessions := storeCompactRecords/10 + 100
+	for n := 0; n < nrSessions; n++ {
+		st.set(testStoreSession(fmt.Sprintf("s%d", n), 1, "a"))
+	}
+	for st.nrRecords <= 10*nrSessions {
+		st.set(testStoreSession("s0", int64(st.nrRecords), "b"))
+	}
+	if lines := testLines(t, filename); len(lines) != 10*nrSessions+1 {
+		t.Fatalf("compacted with %d sessions: %d records", nrSessions, len(lines))
+	}
+	//compacted when more than 10 times
+	st.set(testStoreSession("s0", int64(st.nrRecords), "c"))
+	if lines := testLines(t, filename); len(lines) != nrSessions+2 {
+		t.Fatalf("%d records after compaction", len(lines))
+	}
+}
+
+func TestStoreTruncatedLastLine(t *testing.T) {
+	defaultTTL = sessionTTL{}
+	filename := filepath.Join(t.TempDir(), "sessions.json")
+	st, err := openStore(filename)
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+	st.set(testStoreSession("s1", 1, "a"))
+	st.set(testStoreSession("s2", 1, "b"))
+	//the server stopped while writing the update
+	st.file.Write([]byte(`{"session":{"id":"s1","data":{"value":"c"`))
+	st.file.Close()
+
+	st, err = openStore(filename)
+	if err != nil {
+		t.Fatalf("reopen: %+v", err)
+	}
+	defer st.file.Close()
+	if len(st.sessions) != 2 || st.sessions["s1"].Data["value"] != "a" || st.sessions["s1"].Revision != 1 {
+		t.Fatalf("replayed %+v", st.sessions)
+	}
+	//the incomplete record is removed by compaction, so the next record starts on its own line
+	st.set(testStoreSession("s1", 2, "d"))
+	lines := testLines(t, filename)
+	if len(lines) != 4 {
+		t.Fatalf("%d records: %+v", len(lines), lines)
+	}
+	st.file.Close()
+	if st, err = openStore(filename); err != nil || st.sessions["s1"].Data["value"] != "d" {
+		t.Fatalf("reopen -> %+v, %+v", st, err)
+	}
+}
@@ -9,7 +9,9 @@ import (
 
 	httpSessionsClient "bitbucket.org/vservices/ms-vservices-ussd/rest-sessions/client"
 	"bitbucket.org/vservices/ms-vservices-ussd/ussd"
+	"bitbucket.org/vservices/utils/v4/errors"
 	"bitbucket.org/vservices/utils/v4/logger"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
@@ -17,22 +19,23 @@ var log = logger.NewLogger()
 
 func main() {
 	ussd.SetSessions(httpSessionsClient.New("http://localhost:8100"))
+	ussd.AddResponder(ussdResponder)
 	mux := mux.NewRouter()
 	mux.HandleFunc("/ussd/{msisdn}", handleUSSDBegin).Methods(http.MethodPost)
 	mux.HandleFunc("/ussd/{msisdn}", handleUSSDCont).Methods(http.MethodPut)
-	mux.HandleFunc("/ussd/{msisdn}", handleUSSDAbort).Methods(http.MethodPost)
+	mux.HandleFunc("/ussd/{msisdn}", handleUSSDAbort).Methods(http.MethodDelete)
 	http.Handle("/", mux)
 	http.ListenAndServe(":8080", nil)
 }
 
-var initItem ussd.ItemWithInputHandler
+var initItem ussd.ItemSvcExec
 
 func init() {
 	menu123 := ussd.NewMenu("123", "*** MAIN MENU ***").
-		With("one", nil).
-		With("two", nil).
-		With("three", nil).
-		With("four", nil).
+		With("one").
+		With("two").
+		With("three").
+		With("four").
 		With("Exit", ussd.NewFinal("exit", "Goodbye."))
 
 	initItem = ussd.NewRouter("mainRouter").
@@ -57,31 +60,18 @@ func handleUSSDBegin(httpRes http.ResponseWriter, httpReq *http.Request) {
 	}
 	log.Debugf("req: %+v", req)
 
-	resChan := make(chan ussdResponse)
-	var res ussdResponse
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		select {
-		case res = <-resChan:
-		case <-time.After(15 * time.Second):
-			res = ussdResponse{Type: ussd.TypeFinal, Text: "Timeout. Please try again later"}
-		}
-		wg.Done()
-	}()
-
+	key, resChan := ussdResponder.open()
+	defer ussdResponder.close(key)
 	ctx := context.Background()
 	id := "http:" + msisdn
 	data := map[string]interface{}{
 		"msisdn": msisdn,
 	}
-	if err := ussd.UserStart(ctx, id, data, initItem, req.Text, responder{resChan: resChan}); err != nil {
+	if err := ussd.Start(ctx, id, data, initItem, req.Text, ussdResponder, key); err != nil {
 		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	wg.Wait()
-	httpRes.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(httpRes).Encode(res)
+	writeResponse(httpRes, resChan)
 }
 
 type contRequest struct {
@@ -101,26 +91,26 @@ func handleUSSDCont(httpRes http.ResponseWriter, httpReq *http.Request) {
 	}
 	log.Debugf("req: %+v", req)
 
-	resChan := make(chan ussdResponse)
-	var res ussdResponse
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		select {
-		case res = <-resChan:
-		case <-time.After(15 * time.Second):
-			res = ussdResponse{Type: ussd.TypeFinal, Text: "Timeout. Please try again later"}
-		}
-		wg.Done()
-	}()
+	key, resChan := ussdResponder.open()
+	defer ussdResponder.close(key)
 	id := "http:" + msisdn
 	ctx := context.Background()
-	if err := ussd.UserContinue(ctx, id, nil, req.Text, responder{resChan: resChan}); err != nil {
+	if err := ussd.UserInput(ctx, id, nil, req.Text, ussdResponder, key); err != nil {
 		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeResponse(httpRes, resChan)
+}
 
-	wg.Wait()
+//writeResponse() waits for the USSD response to the request,
+//which may be sent from another goroutine, e.g. after a service response
+func writeResponse(httpRes http.ResponseWriter, resChan chan ussdResponse) {
+	var res ussdResponse
+	select {
+	case res = <-resChan:
+	case <-time.After(15 * time.Second):
+		res = ussdResponse{Type: ussd.ResponseTypeRelease, Text: "Timeout. Please try again later"}
+	}
 	httpRes.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(httpRes).Encode(res)
 }
@@ -140,21 +130,54 @@ func handleUSSDAbort(httpRes http.ResponseWriter, httpReq *http.Request) {
 	}
 }
 
+//responder is registered once, because sessions find their responder by id,
+//and it sends each response to the HTTP request that is waiting with the responder key
 type responder struct {
-	resChan chan ussdResponse
+	sync.Mutex
+	resChanByKey map[string]chan ussdResponse
 }
 
-func (r responder) ID() string { return "<no id>" }
+var ussdResponder = &responder{resChanByKey: map[string]chan ussdResponse{}}
+
+func (r *responder) ID() string { return "rest-ussd" }
+
+//open() returns a new responder key with the channel for its response
+func (r *responder) open() (string, chan ussdResponse) {
+	r.Lock()
+	defer r.Unlock()
+	key := uuid.New().String()
+	resChan := make(chan ussdResponse, 1)
+	r.resChanByKey[key] = resChan
+	return key, resChan
+}
 
-func (r responder) Respond(key interface{}, resType ussd.Type, resText string) error {
-	r.resChan <- ussdResponse{
-		Type: resType,
-		Text: resText,
+//close() discards the key when the HTTP request returns
+func (r *responder) close(key string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.resChanByKey, key)
+}
+
+func (r *responder) Respond(ctx context.Context, key interface{}, res ussd.Response) error {
+	r.Lock()
+	defer r.Unlock()
+	resChan, ok := r.resChanByKey[key.(string)]
+	if !ok {
+		return errors.Errorf("responder key(%v) not found, request already returned", key)
+	}
+	select {
+	case resChan <- ussdResponse{Type: res.Type, Text: res.Message}:
+	default:
+		return errors.Errorf("responder key(%v) already responded", key)
 	}
 	return nil
 }
 
+//ussdResponse is the HTTP response body
+//	type RESPONSE: text is displayed and the user may continue with PUT
+//	type RELEASE: text is displayed and the session ended
+//	type REDIRECT: text is the USSD code to start a new session with, the session ended
 type ussdResponse struct {
-	Type ussd.Type `json:"type"`
-	Text string    `json:"text"`
+	Type ussd.ResponseType `json:"type"`
+	Text string            `json:"text"`
 }
@@ -0,0 +1,201 @@
+package ussd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+	"gopkg.in/yaml.v2"
+)
+
+//Catalog defines translations of texts shown to the user
+//	menu titles, options, prompts and finals are looked up by their text as text id
+//	in the language of session data "language", then in the fallback language
+//	texts without translation are displayed as is, so literal texts still work
+//	translated texts may use <name> etc, see RenderText()
+//
+//example file:
+//	fallback: FR
+//	languages:
+//	- code: FR
+//	  name: Francais
+//	- code: MG
+//	  name: Malagasy
+//	texts:
+//	  SOS_credit_help:
+//	    FR: "Aide"
+//	    MG: "Fanampiana"
+type Catalog struct {
+	Fallback  string                       `json:"fallback,omitempty" yaml:"fallback,omitempty" doc:"Language used when a text is not translated to the session language"`
+	Languages []Language                   `json:"languages,omitempty" yaml:"languages,omitempty" doc:"Languages in the order they are listed by a select language item"`
+	Texts     map[string]map[string]string `json:"texts,omitempty" yaml:"texts,omitempty" doc:"Text by language by text id"`
+}
+
+type Language struct {
+	Code string `json:"code" yaml:"code" doc:"Value stored in session data \"language\", e.g. \"FR\""`
+	Name string `json:"name" yaml:"name" doc:"Name listed by a select language item, e.g. \"Francais\""`
+}
+
+var (
+	catalogMutex sync.Mutex
+	catalog      = Catalog{Texts: map[string]map[string]string{}}
+)
+
+//AddCatalog() adds languages and translations to the catalog used by all items
+//translations of the same text id and language replace the previous translation
+func AddCatalog(c Catalog) error {
+	for _, language := range c.Languages {
+		if language.Code == "" {
+			return errors.Errorf("language(%s) without code", language.Name)
+		}
+	}
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	if c.Fallback != "" {
+		catalog.Fallback = c.Fallback
+	}
+	for _, language := range c.Languages {
+		found := false
+		for i, existing := range catalog.Languages {
+			if existing.Code == language.Code {
+				catalog.Languages[i] = language
+				found = true
+				break
+			}
+		}
+		if !found {
+			catalog.Languages = append(catalog.Languages, language)
+		}
+	}
+	for textID, textByLanguage := range c.Texts {
+		if _, ok := catalog.Texts[textID]; !ok {
+			catalog.Texts[textID] = map[string]string{}
+		}
+		for language, text := range textByLanguage {
+			catalog.Texts[textID][language] = text
+		}
+	}
+	return nil
+} //AddCatalog()
+
+//LoadCatalogFile() adds the catalog from a YAML or JSON file,
+//files with extension .json are parsed as JSON, all others as YAML
+func LoadCatalogFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read file %s", filename)
+	}
+	var c Catalog
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &c)
+	} else {
+		err = yaml.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse file %s", filename)
+	}
+	if err := AddCatalog(c); err != nil {
+		return errors.Wrapf(err, "invalid catalog in file %s", filename)
+	}
+	return nil
+}
+
+//GetLanguages() returns the languages defined in the catalog
+func GetLanguages() []Language {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	return append([]Language{}, catalog.Languages...)
+}
+
+func getFallbackLanguage() string {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	return catalog.Fallback
+}
+
+//Translate() returns the text in the session language, or in the fallback language,
+//or the text itself when it is not translated
+func Translate(ctx context.Context, text string) string {
+	language := ""
+	if s, ok := ctx.Value(CtxSession{}).(Session); ok && s != nil {
+		language, _ = s.Get("language").(string)
+	}
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	textByLanguage, ok := catalog.Texts[text]
+	if !ok {
+		return text
+	}
+	if translated, ok := textByLanguage[language]; ok {
+		return translated
+	}
+	if translated, ok := textByLanguage[catalog.Fallback]; ok {
+		return translated
+	}
+	return text
+}
+
+//translations() returns the translated texts by language of a text id
+func translations(text string) map[string]string {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	textByLanguage := map[string]string{}
+	for language, translated := range catalog.Texts[text] {
+		textByLanguage[language] = translated
+	}
+	return textByLanguage
+}
+
+//NewSelectLanguage() returns a menu listing the languages, see Registry.NewSelectLanguage()
+func NewSelectLanguage(id string, title string, codes ...string) *Menu {
+	return registry.NewSelectLanguage(id, title, codes...)
+}
+
+//NewSelectLanguage() returns a menu listing the languages with their names
+//the selected language is stored in session data "language", then the session
+//continues with the items following this item
+//when no codes are specified, all languages in the catalog are listed,
+//so define the catalog before this item
+func (r *Registry) NewSelectLanguage(id string, title string, codes ...string) *Menu {
+	m := newMenu(r.ID(id), title)
+	if err := r.addLanguageOptions(m, codes); err != nil {
+		panic(fmt.Sprintf("select language(%s): %+v", id, err))
+	}
+	r.mustAdd(m, false)
+	return m
+}
+
+func (r *Registry) addLanguageOptions(m *Menu, codes []string) error {
+	languages := GetLanguages()
+	if len(codes) == 0 {
+		for _, language := range languages {
+			codes = append(codes, language.Code)
+		}
+	}
+	if len(codes) == 0 {
+		return errors.Errorf("no languages defined")
+	}
+	for _, code := range codes {
+		name, found := code, false
+		for _, language := range languages {
+			if language.Code == code {
+				if language.Name != "" {
+					name = language.Name
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("unknown language(%s)", code)
+		}
+		m.With(name, r.Set("language", code))
+	}
+	m.continues = true
+	return nil
+} //Registry.addLanguageOptions()
@@ -0,0 +1,138 @@
+package ussd
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testCatalogYAML = `
+fallback: FR
+languages:
+- code: FR
+  name: Francais
+- code: MG
+  name: Malagasy
+texts:
+  test_catalog_name:
+    FR: "Votre nom?"
+    MG: "Anarana?"
+  test_catalog_hello:
+    FR: "Bonjour <name>"
+    MG: "Manao ahoana <name>"
+  test_catalog_only_mg:
+    MG: "Misaotra"
+`
+
+//testCatalog() loads testCatalogYAML into the global catalog
+//and restores the previous catalog when the test ends
+func testCatalog(t *testing.T) {
+	t.Helper()
+	catalogMutex.Lock()
+	saved := Catalog{Fallback: catalog.Fallback, Languages: catalog.Languages, Texts: catalog.Texts}
+	catalog = Catalog{Texts: map[string]map[string]string{}}
+	catalogMutex.Unlock()
+	t.Cleanup(func() {
+		catalogMutex.Lock()
+		defer catalogMutex.Unlock()
+		catalog = saved
+	})
+
+	filename := filepath.Join(t.TempDir(), "catalog.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testCatalogYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCatalogFile(filename); err != nil {
+		t.Fatalf("failed to load catalog: %+v", err)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	testCatalog(t)
+
+	tests := []struct {
+		language string
+		text     string
+		expected string
+	}{
+		{"MG", "test_catalog_name", "Anarana?"},
+		{"FR", "test_catalog_name", "Votre nom?"},
+		//not translated to the session language: fallback language
+		{"EN", "test_catalog_name", "Votre nom?"},
+		{"", "test_catalog_name", "Votre nom?"},
+		//not translated to the session or fallback language: text as is
+		{"FR", "test_catalog_only_mg", "test_catalog_only_mg"},
+		{"MG", "test_catalog_only_mg", "Misaotra"},
+		{"MG", "Literal text", "Literal text"},
+	}
+	for _, test := range tests {
+		s := validateSession()
+		if test.language != "" {
+			s.Set("language", test.language)
+		}
+		ctx := context.WithValue(context.Background(), CtxSession{}, s)
+		if translated := Translate(ctx, test.text); translated != test.expected {
+			t.Fatalf("language(%s) text(%s) -> %q instead of %q", test.language, test.text, translated, test.expected)
+		}
+	}
+
+	//without a session
+	if translated := Translate(context.Background(), "test_catalog_name"); translated != "Votre nom?" {
+		t.Fatalf("got %q", translated)
+	}
+
+	//translated texts are rendered with session values
+	s := validateSession()
+	s.Set("language", "MG")
+	s.Set("name", "Jan")
+	ctx := context.WithValue(context.Background(), CtxSession{}, s)
+	if text := RenderText(ctx, "test_catalog_hello"); text != "Manao ahoana Jan" {
+		t.Fatalf("got %q", text)
+	}
+} //TestTranslate()
+
+func TestSelectLanguage(t *testing.T) {
+	testCatalog(t)
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	router := r.NewRouter("test_language_router").
+		WithCode("*9#",
+			r.NewSelectLanguage("test_language_select", "Language"),
+			r.NewPrompt("test_language_name", "test_catalog_name", "name"),
+			r.NewFinal("test_language_done", "test_catalog_hello"),
+		)
+
+	//without a session language the fallback is displayed
+	if res := testStart(t, ctx, "language1", router, "*9#"); res.Message != "Language\n1. Francais\n2. Malagasy" {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testInput(t, ctx, "language1", "2"); res.Type != ResponseTypeResponse || res.Message != "Anarana?" {
+		t.Fatalf("got %+v", res)
+	}
+	if data := testJSONRoundTrip(t, "language1"); data["language"] != "MG" {
+		t.Fatalf("language=%v", data["language"])
+	}
+	if res := testInput(t, ctx, "language1", "Jan"); res.Type != ResponseTypeRelease || res.Message != "Manao ahoana Jan" {
+		t.Fatalf("got %+v", res)
+	}
+
+	testStart(t, ctx, "language2", router, "*9#")
+	if res := testInput(t, ctx, "language2", "1"); res.Message != "Votre nom?" {
+		t.Fatalf("got %+v", res)
+	}
+
+	//only the listed codes, which must be in the catalog
+	menu := r.NewSelectLanguage("test_language_mg", "Language", "MG")
+	if text := menu.pages(ctx, DefaultMaxl)[0].text; text != "Language\n1. Malagasy" {
+		t.Fatalf("got %q", text)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("unknown language did not panic")
+			}
+		}()
+		r.NewSelectLanguage("test_language_unknown", "Language", "EN")
+	}()
+} //TestSelectLanguage()
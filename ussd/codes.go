@@ -0,0 +1,174 @@
+package ussd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+	"gopkg.in/yaml.v2"
+)
+
+//CodeTable translates a dialled USSD code to another code before routing,
+//e.g. when a short code is added or a service moved to a new code
+//	rules are matched like routes: exact code, then longest prefix, then regex in order
+//	only one rule is applied, the result is not translated again
+//	Start() stores the translated code in session data "init_request" and
+//	the dialled code in "original_request"
+type CodeTable struct {
+	byCode   map[string]string
+	byPrefix map[string]string
+	prefixes []string //longest first
+	byRegex  []codeRegex
+}
+
+type codeRegex struct {
+	regex *regexp.Regexp
+	to    string
+}
+
+func NewCodeTable() *CodeTable {
+	return &CodeTable{
+		byCode:   map[string]string{},
+		byPrefix: map[string]string{},
+		prefixes: []string{},
+		byRegex:  []codeRegex{},
+	}
+}
+
+//WithCode() translates an exact code, e.g. "*123#" to "*140#"
+func (t *CodeTable) WithCode(code string, to string) *CodeTable {
+	t.byCode[code] = to
+	return t
+}
+
+//WithPrefix() replaces the prefix and keeps the rest of the code,
+//e.g. prefix "*123*" to "*140*" translates "*123*1#" to "*140*1#"
+func (t *CodeTable) WithPrefix(prefix string, to string) *CodeTable {
+	if _, ok := t.byPrefix[prefix]; !ok {
+		t.prefixes = append(t.prefixes, prefix)
+		sort.Slice(t.prefixes, func(i, j int) bool {
+			if len(t.prefixes[i]) != len(t.prefixes[j]) {
+				return len(t.prefixes[i]) > len(t.prefixes[j])
+			}
+			return t.prefixes[i] < t.prefixes[j]
+		})
+	}
+	t.byPrefix[prefix] = to
+	return t
+}
+
+//WithRegex() translates codes that match the pattern (anchored at both ends)
+//to a template with $1 or ${name} for subexpressions, e.g.
+//	WithRegex(`\*150\*([0-9]+)#`, "*140*$1#")
+func (t *CodeTable) WithRegex(pattern string, to string) *CodeTable {
+	regex, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		panic(fmt.Sprintf("invalid code regex pattern: %s: %+v", pattern, err))
+	}
+	t.byRegex = append(t.byRegex, codeRegex{regex: regex, to: to})
+	return t
+}
+
+//Translate() returns the translated code, or false when no rule matched
+func (t *CodeTable) Translate(code string) (string, bool) {
+	if to, ok := t.byCode[code]; ok {
+		return to, true
+	}
+	for _, prefix := range t.prefixes {
+		if strings.HasPrefix(code, prefix) {
+			return t.byPrefix[prefix] + code[len(prefix):], true
+		}
+	}
+	for _, r := range t.byRegex {
+		if subMatches := r.regex.FindStringSubmatchIndex(code); subMatches != nil {
+			return string(r.regex.ExpandString(nil, r.to, code, subMatches)), true
+		}
+	}
+	return code, false
+} //CodeTable.Translate()
+
+var (
+	codeTableMutex sync.Mutex
+	codeTable      *CodeTable
+)
+
+//SetCodeTable() sets the table used by Start() to translate codes, nil to not translate
+//it can be replaced while sessions are running, e.g. after the file changed
+func SetCodeTable(t *CodeTable) {
+	codeTableMutex.Lock()
+	defer codeTableMutex.Unlock()
+	codeTable = t
+}
+
+//translateCode() applies the current code table
+func translateCode(code string) string {
+	codeTableMutex.Lock()
+	t := codeTable
+	codeTableMutex.Unlock()
+	if t == nil {
+		return code
+	}
+	if to, ok := t.Translate(code); ok {
+		log.Debugf("translated code(%s) -> (%s)", code, to)
+		return to
+	}
+	return code
+}
+
+//CodeDef is a rule in a code table file, with one of code, prefix or regex, e.g.
+//	- code: "*123#"
+//	  to: "*140#"
+//	- prefix: "*123*"
+//	  to: "*140*"
+//	- regex: '\*150\*([0-9]+)#'
+//	  to: '*140*$1#'
+type CodeDef struct {
+	Code   string `json:"code,omitempty" yaml:"code,omitempty" doc:"Exact USSD code"`
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty" doc:"USSD code prefix, replaced with to"`
+	Regex  string `json:"regex,omitempty" yaml:"regex,omitempty" doc:"USSD code pattern"`
+	To     string `json:"to" yaml:"to" doc:"Translated code, with $1 or ${name} for regex subexpressions"`
+}
+
+//LoadCodeTableFile() loads a list of CodeDef from a YAML or JSON file,
+//files with extension .json are parsed as JSON, all others as YAML
+func LoadCodeTableFile(filename string) (*CodeTable, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read file %s", filename)
+	}
+	var defs []CodeDef
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &defs)
+	} else {
+		err = yaml.Unmarshal(data, &defs)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse file %s", filename)
+	}
+	t := NewCodeTable()
+	for i, def := range defs {
+		if def.To == "" {
+			return nil, errors.Errorf("file %s [%d] without to", filename, i)
+		}
+		switch {
+		case def.Code != "":
+			t.WithCode(def.Code, def.To)
+		case def.Prefix != "":
+			t.WithPrefix(def.Prefix, def.To)
+		case def.Regex != "":
+			if _, err := regexp.Compile("^" + def.Regex + "$"); err != nil {
+				return nil, errors.Wrapf(err, "file %s [%d] invalid regex(%s)", filename, i, def.Regex)
+			}
+			t.WithRegex(def.Regex, def.To)
+		default:
+			return nil, errors.Errorf("file %s [%d] without code, prefix or regex", filename, i)
+		}
+	}
+	return t, nil
+} //LoadCodeTableFile()
@@ -0,0 +1,114 @@
+package ussd
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testCodesYAML = `
+- code: "*123#"
+  to: "*140#"
+- prefix: "*123*"
+  to: "*140*"
+- prefix: "*123*9"
+  to: "*199*"
+- regex: '\*1[0-9]{2}\*([0-9]+)#'
+  to: '*141*$1#'
+- regex: '\*150\*(?P<bnumber>[0-9]+)\*(?P<amount>[0-9]+)#'
+  to: '*140*${amount}*${bnumber}#'
+`
+
+func TestCodeTableTranslate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "codes.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testCodesYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileTable, err := LoadCodeTableFile(filename)
+	if err != nil {
+		t.Fatalf("failed to load: %+v", err)
+	}
+	codeTable := NewCodeTable().
+		WithCode("*123#", "*140#").
+		WithPrefix("*123*", "*140*").
+		WithPrefix("*123*9", "*199*").
+		WithRegex(`\*1[0-9]{2}\*([0-9]+)#`, "*141*$1#").
+		WithRegex(`\*150\*(?P<bnumber>[0-9]+)\*(?P<amount>[0-9]+)#`, "*140*${amount}*${bnumber}#")
+
+	tests := []struct {
+		code     string
+		expected string
+		ok       bool
+	}{
+		//exact code before prefix
+		{"*123#", "*140#", true},
+		//longest prefix first, and prefix before regex
+		{"*123*1#", "*140*1#", true},
+		{"*123*91#", "*199*1#", true},
+		//regex in order, anchored at both ends
+		{"*150*5#", "*141*5#", true},
+		{"*150*0821234567*50#", "*140*50*0821234567#", true},
+		{"*150*5#1", "*150*5#1", false},
+		//only one rule is applied
+		{"*140#", "*140#", false},
+		{"*124#", "*124#", false},
+		{"", "", false},
+	}
+	for name, table := range map[string]*CodeTable{"code": codeTable, "file": fileTable} {
+		for _, test := range tests {
+			to, ok := table.Translate(test.code)
+			if to != test.expected || ok != test.ok {
+				t.Fatalf("%s table: Translate(%s)=%s,%v instead of %s,%v", name, test.code, to, ok, test.expected, test.ok)
+			}
+		}
+	}
+} //TestCodeTableTranslate()
+
+func TestLoadCodeTableFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"no_to.yaml":     `[{"code":"*123#"}]`,
+		"no_rule.yaml":   `[{"to":"*140#"}]`,
+		"bad_regex.json": `[{"regex":"*(","to":"*140#"}]`,
+		"bad_json.json":  `{"code":"*123#"`,
+	}
+	for name, content := range tests {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadCodeTableFile(filename); err == nil {
+			t.Fatalf("%s loaded without error", name)
+		}
+	}
+	if _, err := LoadCodeTableFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Fatalf("missing file loaded without error")
+	}
+}
+
+func TestStartTranslatesCode(t *testing.T) {
+	SetCodeTable(NewCodeTable().WithCode("*123#", "*140#"))
+	defer SetCodeTable(nil)
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	router := r.NewRouter("test_codes_router").
+		WithCode("*140#",
+			r.NewPrompt("test_codes_name", "Name?", "name"),
+			r.NewFinal("test_codes_done", "<original_request> <init_request>"),
+		)
+
+	testStart(t, ctx, "codes1", router, "*123#")
+	if data := testJSONRoundTrip(t, "codes1"); data["original_request"] != "*123#" || data["init_request"] != "*140#" {
+		t.Fatalf("original_request=%v init_request=%v", data["original_request"], data["init_request"])
+	}
+	if res := testInput(t, ctx, "codes1", "Jan"); res.Type != ResponseTypeRelease || res.Message != "*123# *140#" {
+		t.Fatalf("got %+v", res)
+	}
+
+	//codes that are not translated are stored as dialled
+	testStart(t, ctx, "codes2", router, "*140#")
+	if data := testJSONRoundTrip(t, "codes2"); data["original_request"] != "*140#" || data["init_request"] != "*140#" {
+		t.Fatalf("original_request=%v init_request=%v", data["original_request"], data["init_request"])
+	}
+} //TestStartTranslatesCode()
@@ -0,0 +1,751 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//Expr is an expression evaluated on session data, e.g. Set("balance", Expr("balance - amount"))
+//	names          session values, nil when not defined, e.g. balance or account.type
+//	literals       123, 1.5, "text", 'text', true, false, nil
+//	arithmetic     + - * / % and unary -, on numbers or strings that are numbers, e.g. prompt input
+//	               + joins strings when either side is not a number
+//	comparison     == != < <= > >= compare numbers when both sides are numbers, else strings,
+//	               a number is not equal to a value that is not a number and cannot be ordered with it,
+//	               < <= > >= are false when either side is nil
+//	regex          =~ and !~ match the left side with the pattern on the right, e.g. input =~ "^[0-9]+$"
+//	logic          && || ! (or: and, or, not), using the same truth as <if name> in texts
+//	functions      len upper lower trim contains prefix suffix substr replace
+//	               number string int round min max default now, and custom functions, see AddExprFunc()
+//	grouping       ( )
+//integer results are int64, other numbers float64
+type Expr string
+
+//Eval() evaluates the expression on the session in the context
+func (e Expr) Eval(ctx context.Context) (interface{}, error) {
+	node, err := parseExpr(string(e))
+	if err != nil {
+		return nil, err
+	}
+	s, _ := ctx.Value(CtxSession{}).(Session)
+	value, err := node.eval(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to evaluate expr(%s)", string(e))
+	}
+	return value, nil
+}
+
+//Check() returns an error if the expression cannot be parsed
+func (e Expr) Check() error {
+	_, err := parseExpr(string(e))
+	return err
+}
+
+//names() returns the session value names used in the expression
+func (e Expr) names() []string {
+	node, err := parseExpr(string(e))
+	if err != nil {
+		return nil
+	}
+	return node.names()
+}
+
+//ExprFunc is a function that can be called in an expression
+type ExprFunc func(args []interface{}) (interface{}, error)
+
+var (
+	exprFuncMutex  sync.Mutex
+	exprFuncByName = map[string]ExprFunc{
+		"len":      exprLen,
+		"upper":    exprStringFunc(strings.ToUpper),
+		"lower":    exprStringFunc(strings.ToLower),
+		"trim":     exprStringFunc(strings.TrimSpace),
+		"contains": exprStringTest(strings.Contains),
+		"prefix":   exprStringTest(strings.HasPrefix),
+		"suffix":   exprStringTest(strings.HasSuffix),
+		"substr":   exprSubstr,
+		"replace":  exprReplace,
+		"number":   exprNumberFunc,
+		"string":   exprStringConv,
+		"int":      exprInt,
+		"round":    exprRound,
+		"min":      exprMinMax(-1),
+		"max":      exprMinMax(1),
+		"default":  exprDefault,
+		"now":      exprNow,
+	}
+)
+
+//AddExprFunc() defines a custom function that can be called in expressions
+func AddExprFunc(name string, fnc ExprFunc) {
+	exprFuncMutex.Lock()
+	defer exprFuncMutex.Unlock()
+	if _, ok := exprFuncByName[name]; ok {
+		panic(fmt.Sprintf("expr function(%s) already defined", name))
+	}
+	exprFuncByName[name] = fnc
+}
+
+func getExprFunc(name string) (ExprFunc, bool) {
+	exprFuncMutex.Lock()
+	defer exprFuncMutex.Unlock()
+	fnc, ok := exprFuncByName[name]
+	return fnc, ok
+}
+
+var (
+	//parsed expressions are cached, because they are evaluated in every session
+	parsedExprMutex sync.Mutex
+	parsedExpr      = map[string]exprNode{}
+)
+
+func parseExpr(expr string) (exprNode, error) {
+	parsedExprMutex.Lock()
+	defer parsedExprMutex.Unlock()
+	if node, ok := parsedExpr[expr]; ok {
+		return node, nil
+	}
+	tokens, err := exprTokens(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid expr(%s)", expr)
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = errors.Errorf("unexpected \"%s\"", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid expr(%s)", expr)
+	}
+	parsedExpr[expr] = node
+	return node, nil
+} //parseExpr()
+
+type exprTokenKind int
+
+const (
+	exprTokenName exprTokenKind = iota
+	exprTokenNumber
+	exprTokenString
+	exprTokenOperator
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	text  string
+	value interface{} //for number and string
+}
+
+//operators with two characters are listed first, so they match before their first character
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+func exprTokens(expr string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(runes) && ((runes[i] >= '0' && runes[i] <= '9') || runes[i] == '.') {
+				i++
+			}
+			f, err := strconv.ParseFloat(string(runes[start:i]), 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid number \"%s\"", string(runes[start:i]))
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenNumber, text: string(runes[start:i]), value: exprResult(f)})
+		case c == '"' || c == '\'':
+			quote := c
+			b := strings.Builder{}
+			i++
+			for ; i < len(runes) && runes[i] != quote; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.Errorf("string without closing %c", quote)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: exprTokenString, text: b.String(), value: b.String()})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '.' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			name := string(runes[start:i])
+			switch name {
+			case "and":
+				tokens = append(tokens, exprToken{kind: exprTokenOperator, text: "&&"})
+			case "or":
+				tokens = append(tokens, exprToken{kind: exprTokenOperator, text: "||"})
+			case "not":
+				tokens = append(tokens, exprToken{kind: exprTokenOperator, text: "!"})
+			default:
+				tokens = append(tokens, exprToken{kind: exprTokenName, text: name})
+			}
+		default:
+			found := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, exprToken{kind: exprTokenOperator, text: op})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errors.Errorf("unexpected \"%c\"", c)
+			}
+		}
+	}
+	return tokens, nil
+} //exprTokens()
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+//accept() consumes the next token if it is one of the operators
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != exprTokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary(p.parseNot, "&&")
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!"); ok {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op: "!", x: x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	x, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">", "=~", "!~"); ok {
+		y, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		return exprBinary{op: op, x: x, y: y}, nil
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseAdd() (exprNode, error) {
+	return p.parseBinary(p.parseMul, "+", "-")
+}
+
+func (p *exprParser) parseMul() (exprNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+//parseBinary() parses left associative operators of the same precedence
+func (p *exprParser) parseBinary(next func() (exprNode, error), ops ...string) (exprNode, error) {
+	x, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return x, nil
+		}
+		y, err := next()
+		if err != nil {
+			return nil, err
+		}
+		x = exprBinary{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.Errorf("unexpected end")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case exprTokenNumber, exprTokenString:
+		return exprLiteral{value: t.value}, nil
+	case exprTokenName:
+		switch t.text {
+		case "true":
+			return exprLiteral{value: true}, nil
+		case "false":
+			return exprLiteral{value: false}, nil
+		case "nil":
+			return exprLiteral{value: nil}, nil
+		}
+		if _, ok := p.accept("("); !ok {
+			return exprName{name: t.text}, nil
+		}
+		fnc, ok := getExprFunc(t.text)
+		if !ok {
+			return nil, errors.Errorf("unknown function(%s)", t.text)
+		}
+		call := exprCall{name: t.text, fnc: fnc}
+		if _, ok := p.accept(")"); ok {
+			return call, nil
+		}
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.accept(")"); ok {
+				return call, nil
+			}
+			if _, ok := p.accept(","); !ok {
+				return nil, errors.Errorf("%s() expects \",\" or \")\"", t.text)
+			}
+		}
+	}
+	if t.text == "(" {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, errors.Errorf("missing \")\"")
+		}
+		return x, nil
+	}
+	return nil, errors.Errorf("unexpected \"%s\"", t.text)
+} //exprParser.parsePrimary()
+
+type exprNode interface {
+	eval(s Session) (interface{}, error)
+	names() []string
+}
+
+type exprLiteral struct {
+	value interface{}
+}
+
+func (l exprLiteral) eval(s Session) (interface{}, error) { return l.value, nil }
+func (l exprLiteral) names() []string                     { return nil }
+
+type exprName struct {
+	name string
+}
+
+func (n exprName) eval(s Session) (interface{}, error) {
+	if s == nil {
+		return nil, nil
+	}
+	return s.Get(n.name), nil
+}
+
+func (n exprName) names() []string { return []string{n.name} }
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+func (u exprUnary) eval(s Session) (interface{}, error) {
+	x, err := u.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.op == "!" {
+		return !textTrue(x), nil
+	}
+	f, ok := exprNumber(x)
+	if !ok {
+		return nil, errors.Errorf("-(%v) is not a number", x)
+	}
+	return exprResult(-f), nil
+}
+
+func (u exprUnary) names() []string { return u.x.names() }
+
+type exprBinary struct {
+	op string
+	x  exprNode
+	y  exprNode
+}
+
+func (b exprBinary) names() []string { return append(b.x.names(), b.y.names()...) }
+
+func (b exprBinary) eval(s Session) (interface{}, error) {
+	x, err := b.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	//logic only evaluates the right side when needed
+	switch b.op {
+	case "&&":
+		if !textTrue(x) {
+			return false, nil
+		}
+		y, err := b.y.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		return textTrue(y), nil
+	case "||":
+		if textTrue(x) {
+			return true, nil
+		}
+		y, err := b.y.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		return textTrue(y), nil
+	}
+	y, err := b.y.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.op {
+	case "==", "!=":
+		c, err := exprCompare(x, y)
+		equal := err == nil && c == 0
+		if x == nil || y == nil {
+			equal = x == nil && y == nil
+		}
+		return equal == (b.op == "=="), nil
+	case "<", "<=", ">", ">=":
+		if x == nil || y == nil {
+			return false, nil
+		}
+		c, err := exprCompare(x, y)
+		if err != nil {
+			return nil, err
+		}
+		switch b.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "=~", "!~":
+		regex, err := exprRegex(textString(y))
+		if err != nil {
+			return nil, err
+		}
+		return regex.MatchString(textString(x)) == (b.op == "=~"), nil
+	}
+
+	fx, xok := exprNumber(x)
+	fy, yok := exprNumber(y)
+	if b.op == "+" && (!xok || !yok) {
+		return textString(x) + textString(y), nil
+	}
+	if !xok || !yok {
+		return nil, errors.Errorf("%v %s %v needs numbers", x, b.op, y)
+	}
+	switch b.op {
+	case "+":
+		return exprResult(fx + fy), nil
+	case "-":
+		return exprResult(fx - fy), nil
+	case "*":
+		return exprResult(fx * fy), nil
+	case "/":
+		if fy == 0 {
+			return nil, errors.Errorf("%v / %v divide by zero", x, y)
+		}
+		return exprResult(fx / fy), nil
+	case "%":
+		if fy == 0 {
+			return nil, errors.Errorf("%v %% %v divide by zero", x, y)
+		}
+		return exprResult(math.Mod(fx, fy)), nil
+	}
+	return nil, errors.Errorf("unknown operator %s", b.op)
+} //exprBinary.eval()
+
+type exprCall struct {
+	name string
+	fnc  ExprFunc
+	args []exprNode
+}
+
+func (c exprCall) eval(s Session) (interface{}, error) {
+	args := make([]interface{}, len(c.args))
+	for i, arg := range c.args {
+		var err error
+		if args[i], err = arg.eval(s); err != nil {
+			return nil, err
+		}
+	}
+	value, err := c.fnc(args)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s() failed", c.name)
+	}
+	return value, nil
+}
+
+func (c exprCall) names() []string {
+	names := []string{}
+	for _, arg := range c.args {
+		names = append(names, arg.names()...)
+	}
+	return names
+}
+
+//exprNumber() converts numbers and strings that are numbers, not bool or nil
+func exprNumber(value interface{}) (float64, bool) {
+	switch value.(type) {
+	case nil, bool:
+		return 0, false
+	}
+	f, err := textFloat(value)
+	return f, err == nil
+}
+
+//exprResult() returns int64 for integer values so they display without decimals
+func exprResult(f float64) interface{} {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return int64(f)
+	}
+	return f
+}
+
+//exprCompare() returns -1, 0 or 1
+//	numbers and strings that are numbers compare as numbers, other values as strings,
+//	but a number cannot be compared with a value that is not a number, e.g. 5 < "abc"
+func exprCompare(x, y interface{}) (int, error) {
+	fx, xok := exprNumber(x)
+	fy, yok := exprNumber(y)
+	if xok && yok {
+		switch {
+		case fx < fy:
+			return -1, nil
+		case fx > fy:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	_, xstr := x.(string)
+	_, ystr := y.(string)
+	if (xok && !xstr) || (yok && !ystr) {
+		return 0, errors.Errorf("cannot compare %v with %v", x, y)
+	}
+	return strings.Compare(textString(x), textString(y)), nil
+}
+
+var (
+	exprRegexMutex     sync.Mutex
+	exprRegexByPattern = map[string]*regexp.Regexp{}
+)
+
+func exprRegex(pattern string) (*regexp.Regexp, error) {
+	exprRegexMutex.Lock()
+	defer exprRegexMutex.Unlock()
+	if regex, ok := exprRegexByPattern[pattern]; ok {
+		return regex, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid regex(%s)", pattern)
+	}
+	exprRegexByPattern[pattern] = regex
+	return regex, nil
+}
+
+func exprArgs(args []interface{}, min, max int) error {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return errors.Errorf("expects %d arguments, got %d", min, len(args))
+		}
+		return errors.Errorf("expects %d..%d arguments, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+func exprLen(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return int64(len([]rune(textString(args[0])))), nil
+}
+
+func exprStringFunc(fnc func(string) string) ExprFunc {
+	return func(args []interface{}) (interface{}, error) {
+		if err := exprArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		return fnc(textString(args[0])), nil
+	}
+}
+
+func exprStringTest(fnc func(string, string) bool) ExprFunc {
+	return func(args []interface{}) (interface{}, error) {
+		if err := exprArgs(args, 2, 2); err != nil {
+			return nil, err
+		}
+		return fnc(textString(args[0]), textString(args[1])), nil
+	}
+}
+
+//substr(s, start[, length]) with start from 0, counting characters
+func exprSubstr(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 2, 3); err != nil {
+		return nil, err
+	}
+	runes := []rune(textString(args[0]))
+	start, ok := exprNumber(args[1])
+	if !ok || start < 0 {
+		return nil, errors.Errorf("invalid start(%v)", args[1])
+	}
+	from := int(math.Min(start, float64(len(runes))))
+	to := len(runes)
+	if len(args) > 2 {
+		length, ok := exprNumber(args[2])
+		if !ok || length < 0 {
+			return nil, errors.Errorf("invalid length(%v)", args[2])
+		}
+		to = int(math.Min(float64(from)+length, float64(len(runes))))
+	}
+	return string(runes[from:to]), nil
+}
+
+func exprReplace(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	return strings.Replace(textString(args[0]), textString(args[1]), textString(args[2]), -1), nil
+}
+
+func exprNumberFunc(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	f, ok := exprNumber(args[0])
+	if !ok {
+		return nil, errors.Errorf("%v is not a number", args[0])
+	}
+	return exprResult(f), nil
+}
+
+func exprStringConv(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return textString(args[0]), nil
+}
+
+func exprInt(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	f, ok := exprNumber(args[0])
+	if !ok {
+		return nil, errors.Errorf("%v is not a number", args[0])
+	}
+	return int64(f), nil
+}
+
+//round(x[, decimals])
+func exprRound(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	f, ok := exprNumber(args[0])
+	if !ok {
+		return nil, errors.Errorf("%v is not a number", args[0])
+	}
+	decimals := 0.0
+	if len(args) > 1 {
+		if decimals, ok = exprNumber(args[1]); !ok || decimals < 0 {
+			return nil, errors.Errorf("invalid decimals(%v)", args[1])
+		}
+	}
+	p := math.Pow(10, math.Trunc(decimals))
+	return exprResult(math.Round(f*p) / p), nil
+}
+
+//exprMinMax() returns min (sign=-1) or max (sign=1) of one or more numbers
+func exprMinMax(sign int) ExprFunc {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, errors.Errorf("expects at least one argument")
+		}
+		var result float64
+		for i, arg := range args {
+			f, ok := exprNumber(arg)
+			if !ok {
+				return nil, errors.Errorf("%v is not a number", arg)
+			}
+			if i == 0 || (sign < 0 && f < result) || (sign > 0 && f > result) {
+				result = f
+			}
+		}
+		return exprResult(result), nil
+	}
+}
+
+//default(x, value) returns value when x is nil or ""
+func exprDefault(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	if textString(args[0]) == "" {
+		return args[1], nil
+	}
+	return args[0], nil
+}
+
+//now() returns the current time in unix seconds, e.g. to display with <value|date>
+func exprNow(args []interface{}) (interface{}, error) {
+	if err := exprArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return time.Now().Unix(), nil
+}
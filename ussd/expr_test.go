@@ -0,0 +1,107 @@
+package ussd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestExprEval(t *testing.T) {
+	s := validateSession()
+	s.Set("balance", 100)
+	s.Set("amount", "25")
+	s.Set("name", "Jan")
+	s.Set("yes", true)
+	ctx := context.WithValue(context.Background(), CtxSession{}, s)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		//precedence
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 4 - 3", int64(3)},
+		{"-2 * 3", int64(-6)},
+		{"7 % 4 + 1", int64(4)},
+		{"1 + 2 == 3", true},
+		{"1 < 2 && 2 < 1 || true", true},
+		{"!yes || 1 == 1 && false", false},
+		{"not yes or balance > 50", true},
+		{"balance - amount * 2", int64(50)},
+		{"5 / 2", 2.5},
+		//strings
+		{"name + \" \" + amount", "Jan 25"},
+		{"name == 'Jan'", true},
+		{"\"abc\" < \"abd\"", true},
+		{"amount == 25", true},
+		{"amount < 100", true},
+		{"\"9\" < \"10\"", true},
+		{"name =~ \"^J\"", true},
+		{"name !~ \"^J\"", false},
+		{"upper(name) + len(name)", "JAN3"},
+		//nil
+		{"missing == nil", true},
+		{"missing != 0", true},
+		{"missing < 1", false},
+		{"missing >= 1", false},
+		{"1 > missing", false},
+		//number and non-numeric string are not equal
+		{"balance == name", false},
+		{"balance != name", true},
+	}
+	for _, test := range tests {
+		value, err := Expr(test.expr).Eval(ctx)
+		if err != nil {
+			t.Errorf("expr(%s) failed: %+v", test.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("expr(%s)=(%T)%v, expected (%T)%v", test.expr, value, value, test.expected, test.expected)
+		}
+	}
+
+	for _, expr := range []string{
+		"balance < name",
+		"name >= 1",
+		"yes > 1",
+		"1 / 0",
+		"name * 2",
+		"unknown_func(1)",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"\"unterminated",
+		"name =~ \"[\"",
+	} {
+		if value, err := Expr(expr).Eval(ctx); err == nil {
+			t.Errorf("expr(%s)=%v did not fail", expr, value)
+		}
+	}
+}
+
+func TestExprCache(t *testing.T) {
+	cached := func(expr string) bool {
+		parsedExprMutex.Lock()
+		defer parsedExprMutex.Unlock()
+		_, ok := parsedExpr[expr]
+		return ok
+	}
+	if err := Expr("cache_test + 1").Check(); err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if !cached("cache_test + 1") {
+		t.Fatalf("expr not cached")
+	}
+	node1, _ := parseExpr("cache_test + 1")
+	node2, _ := parseExpr("cache_test + 1")
+	if !reflect.DeepEqual(node1, node2) {
+		t.Fatalf("cached expr changed")
+	}
+	if err := Expr("cache_test +").Check(); err == nil {
+		t.Fatalf("invalid expr passed")
+	}
+	if cached("cache_test +") {
+		t.Fatalf("invalid expr cached")
+	}
+}
@@ -0,0 +1,220 @@
+package ussd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+//itemLink is a reference from an item to a sequence of next items,
+//e.g. a router route or a menu option
+type itemLink struct {
+	kind  string //"code", "prefix", "regex", "option", "then", "else", "case", "default", "fail" or "active"
+	label string //code, prefix, pattern or caption
+	next  []Item
+}
+
+//itemLinks() returns the links of items that define their next items statically
+//custom ItemSvcExec and ItemSvcWait items return next items at runtime, so they have no links
+func itemLinks(item Item) []itemLink {
+	links := []itemLink{}
+	switch i := item.(type) {
+	case *Router:
+		codes := []string{}
+		for code := range i.byCode {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			links = append(links, itemLink{kind: "code", label: code, next: i.byCode[code]})
+		}
+		for _, prefix := range i.prefixes {
+			links = append(links, itemLink{kind: "prefix", label: prefix, next: i.byPrefix[prefix]})
+		}
+		for _, route := range i.byRegex {
+			links = append(links, itemLink{kind: "regex", label: strings.TrimSuffix(strings.TrimPrefix(route.regex.String(), "^"), "$"), next: []Item{route.item}})
+		}
+	case *Menu:
+		for _, option := range i.options {
+			links = append(links, itemLink{kind: "option", label: option.caption, next: option.nextItems})
+		}
+	case *Prompt:
+		if i.maxAttempts > 0 {
+			links = append(links, itemLink{kind: "fail", label: fmt.Sprintf("%d attempts", i.maxAttempts), next: i.failItems})
+		}
+	case *If:
+		links = append(links, itemLink{kind: "then", label: string(i.expr), next: i.thenItems})
+		links = append(links, itemLink{kind: "else", label: string(i.expr), next: i.elseItems})
+	case *Switch:
+		for _, c := range i.cases {
+			links = append(links, itemLink{kind: "case", label: c.String(), next: c.nextItems})
+		}
+		links = append(links, itemLink{kind: "default", label: "", next: i.defaultItems})
+	case activeItem:
+		if _, activeItem, ok := i.vf.active(i.itemID); ok {
+			links = append(links, itemLink{kind: "active", label: i.vf.Version(), next: []Item{activeItem}})
+		}
+	}
+	return links
+} //itemLinks()
+
+//walkItems() calls fnc once for each item reachable from the start items
+func walkItems(start []Item, fnc func(item Item)) {
+	visited := map[string]bool{} //by id, because not all items are comparable
+	var walk func(item Item)
+	walk = func(item Item) {
+		if item == nil || visited[item.ID()] {
+			return
+		}
+		visited[item.ID()] = true
+		fnc(item)
+		for _, link := range itemLinks(item) {
+			for _, next := range link.next {
+				walk(next)
+			}
+		}
+	}
+	for _, item := range start {
+		walk(item)
+	}
+} //walkItems()
+
+//graphEdge connects two items in an exported graph
+type graphEdge struct {
+	from  Item
+	to    Item
+	label string
+	then  bool //true between items in a sequence, false from a route or menu option to the first item
+}
+
+//graph() returns the reachable items and edges between them
+func graph(start []Item) ([]Item, []graphEdge) {
+	items := []Item{}
+	edges := []graphEdge{}
+	walkItems(start, func(item Item) {
+		items = append(items, item)
+		for _, link := range itemLinks(item) {
+			label := link.label
+			if link.kind != "option" {
+				label = strings.TrimSpace(link.kind + " " + link.label)
+			}
+			prev := item
+			for i, next := range link.next {
+				edges = append(edges, graphEdge{from: prev, to: next, label: label, then: i > 0})
+				prev = next
+				label = ""
+			}
+		}
+	})
+	return items, edges
+} //graph()
+
+//graphLabel() describes an item with its type, id and the text shown to the user
+func graphLabel(item Item) []string {
+	switch i := item.(type) {
+	case *Router:
+		return []string{"Router", i.id}
+	case *Menu:
+		return []string{"Menu", i.id, i.title}
+	case *Prompt:
+		return []string{"Prompt", i.id, i.text, "-> <" + i.name + ">"}
+	case *Final:
+		return []string{"Final", i.id, i.text}
+	case *Redirect:
+		if i.expr != "" {
+			return []string{"Redirect", i.id, string(i.expr)}
+		}
+		return []string{"Redirect", i.id, i.code}
+	case set:
+		return []string{"Set", fmt.Sprintf("%s=%v", i.name, i.value)}
+	case *If:
+		return []string{"If", i.id, string(i.expr)}
+	case *Switch:
+		return []string{"Switch", i.id}
+	case ussdFunc:
+		return []string{"Func", i.id}
+	case activeItem:
+		return []string{"Active", i.id}
+	}
+	return []string{fmt.Sprintf("%T", item), item.ID()}
+} //graphLabel()
+
+//WriteDOT() writes the items reachable from the start items, e.g. a router,
+//as a Graphviz DOT graph, which can be rendered with e.g. "dot -Tpng"
+func WriteDOT(w io.Writer, start ...Item) error {
+	items, edges := graph(start)
+	dotQuote := func(s string) string {
+		return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(s) + "\""
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "digraph ussd {\n")
+	fmt.Fprintf(b, "\tnode [shape=box];\n")
+	for _, item := range items {
+		shape := "box"
+		switch item.(type) {
+		case *Router, *If, *Switch:
+			shape = "diamond"
+		case *Final, *Redirect:
+			shape = "doubleoctagon"
+		case *Prompt:
+			shape = "parallelogram"
+		case *Menu:
+			shape = "box3d"
+		}
+		fmt.Fprintf(b, "\t%s [shape=%s,label=%s];\n", dotQuote(item.ID()), shape, dotQuote(strings.Join(graphLabel(item), "\n")))
+	}
+	for _, edge := range edges {
+		attrs := []string{}
+		if edge.label != "" {
+			attrs = append(attrs, "label="+dotQuote(edge.label))
+		}
+		if edge.then {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(b, "\t%s -> %s [%s];\n", dotQuote(edge.from.ID()), dotQuote(edge.to.ID()), strings.Join(attrs, ","))
+	}
+	fmt.Fprintf(b, "}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+} //WriteDOT()
+
+//WriteMermaid() writes the items reachable from the start items, e.g. a router,
+//as a Mermaid flowchart, which can be embedded in markdown documentation
+func WriteMermaid(w io.Writer, start ...Item) error {
+	items, edges := graph(start)
+	mermaidQuote := func(s string) string {
+		return "\"" + strings.NewReplacer("#", "#35;", "\"", "#quot;", "<", "#lt;", ">", "#gt;", "\n", "<br/>").Replace(s) + "\""
+	}
+	//mermaid node ids must be simple names
+	nodeID := map[string]string{}
+	for n, item := range items {
+		nodeID[item.ID()] = fmt.Sprintf("n%d", n+1)
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "flowchart TD\n")
+	for _, item := range items {
+		open, close := "[", "]"
+		switch item.(type) {
+		case *Router, *If, *Switch:
+			open, close = "{", "}"
+		case *Final, *Redirect:
+			open, close = "([", "])"
+		case *Prompt:
+			open, close = "[/", "/]"
+		}
+		fmt.Fprintf(b, "\t%s%s%s%s\n", nodeID[item.ID()], open, mermaidQuote(strings.Join(graphLabel(item), "\n")), close)
+	}
+	for _, edge := range edges {
+		arrow := "-->"
+		if edge.then {
+			arrow = "-.->"
+		}
+		if edge.label != "" {
+			arrow += "|" + mermaidQuote(edge.label) + "|"
+		}
+		fmt.Fprintf(b, "\t%s %s %s\n", nodeID[edge.from.ID()], arrow, nodeID[edge.to.ID()])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+} //WriteMermaid()
@@ -0,0 +1,53 @@
+package ussd
+
+import (
+	"strings"
+	"testing"
+)
+
+func testGraphItems() Item {
+	r := NewRegistry()
+	menu := r.NewMenu("menu", `Main "menu" [1]`).
+		With(`Say "hi" [x]`, r.NewPrompt("ask", "Name #?", "name"), r.NewFinal("bye", "Bye\n<name>"))
+	return r.NewRouter("router").WithCode("*1#", menu)
+}
+
+func TestWriteDOT(t *testing.T) {
+	b := &strings.Builder{}
+	if err := WriteDOT(b, testGraphItems()); err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	expected := `digraph ussd {
+	node [shape=box];
+	"router" [shape=diamond,label="Router\nrouter"];
+	"menu" [shape=box3d,label="Menu\nmenu\nMain \"menu\" [1]"];
+	"ask" [shape=parallelogram,label="Prompt\nask\nName #?\n-> <name>"];
+	"bye" [shape=doubleoctagon,label="Final\nbye\nBye\n<name>"];
+	"router" -> "menu" [label="code *1#"];
+	"menu" -> "ask" [label="Say \"hi\" [x]"];
+	"ask" -> "bye" [style=dashed];
+}
+`
+	if b.String() != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestWriteMermaid(t *testing.T) {
+	b := &strings.Builder{}
+	if err := WriteMermaid(b, testGraphItems()); err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	expected := `flowchart TD
+	n1{"Router<br/>router"}
+	n2["Menu<br/>menu<br/>Main #quot;menu#quot; [1]"]
+	n3[/"Prompt<br/>ask<br/>Name #35;?<br/>-#gt; #lt;name#gt;"/]
+	n4(["Final<br/>bye<br/>Bye<br/>#lt;name#gt;"])
+	n1 -->|"code *1#35;"| n2
+	n2 -->|"Say #quot;hi#quot; [x]"| n3
+	n3 -.-> n4
+`
+	if b.String() != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
@@ -3,11 +3,15 @@ package ussd
 import "context"
 
 func NewFinal(id string, text string) *Final {
+	return registry.NewFinal(id, text)
+}
+
+func (r *Registry) NewFinal(id string, text string) *Final {
 	f := &Final{
-		id:   id,
+		id:   r.ID(id),
 		text: text,
 	}
-	itemByID[id] = f
+	r.mustAdd(f, false)
 	return f
 }
 
@@ -20,5 +24,5 @@ type Final struct {
 func (f Final) ID() string { return f.id }
 
 func (f Final) Render(ctx context.Context) string {
-	return f.text
+	return RenderText(ctx, f.text)
 }
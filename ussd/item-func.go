@@ -7,10 +7,16 @@ import (
 )
 
 func NewFunc(id string, fnc func(context.Context) error) ItemSvcExec {
-	return ussdFunc{
-		id:  id,
+	return registry.NewFunc(id, fnc)
+}
+
+func (r *Registry) NewFunc(id string, fnc func(context.Context) error) ItemSvcExec {
+	f := ussdFunc{
+		id:  r.ID(id),
 		fnc: fnc,
 	}
+	r.mustAdd(f, false)
+	return f
 }
 
 type ussdFunc struct {
@@ -0,0 +1,58 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+)
+
+//NewIf() returns an item that continues with the then or else items
+//depending on an expression evaluated on the session, see Expr
+func NewIf(id string, expr string) *If {
+	return registry.NewIf(id, expr)
+}
+
+func (r *Registry) NewIf(id string, expr string) *If {
+	if err := Expr(expr).Check(); err != nil {
+		panic(fmt.Sprintf("if(%s): %+v", id, err))
+	}
+	i := &If{
+		id:   r.ID(id),
+		expr: Expr(expr),
+	}
+	r.mustAdd(i, false)
+	return i
+}
+
+//If implements ussd.ItemSvcExec
+//when the expression is true, the then items are processed, else the else items,
+//followed by items that were queued after the if
+type If struct {
+	id        string
+	expr      Expr
+	thenItems []Item
+	elseItems []Item
+}
+
+func (i If) ID() string { return i.id }
+
+func (i *If) Then(nextItems ...Item) *If {
+	i.thenItems = nextItems
+	return i
+}
+
+func (i *If) Else(nextItems ...Item) *If {
+	i.elseItems = nextItems
+	return i
+}
+
+func (i If) Exec(ctx context.Context) ([]Item, error) {
+	value, err := i.expr.Eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("if(%s): (%s) = %v", i.id, i.expr, value)
+	if textTrue(value) {
+		return i.thenItems, nil
+	}
+	return i.elseItems, nil
+}
@@ -4,16 +4,25 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"bitbucket.org/vservices/utils/v4/errors"
 )
 
 //Menu implements ussd.ItemUsrPrompt
+//	when all options do not fit in the session's "maxl", the menu is split into pages
+//	with the title on each page, options numbered from 1 on the first page to N on the last page,
+//	and more/back options to select another page
 type Menu struct {
-	id       string
-	title    string
-	options  []MenuOption
-	rendered bool
+	id          string
+	title       string
+	options     []MenuOption
+	moreKey     string
+	moreCaption string
+	backKey     string
+	backCaption string
+	continues   bool //options continue with the items queued after the menu, e.g. select language
+	normalisers []InputNormaliser
 }
 
 type MenuOption struct {
@@ -22,13 +31,54 @@ type MenuOption struct {
 }
 
 func NewMenu(id string, title string) *Menu {
-	m := &Menu{
-		id:       id,
-		title:    title,
-		options:  []MenuOption{},
-		rendered: false,
+	return registry.NewMenu(id, title)
+}
+
+func (r *Registry) NewMenu(id string, title string) *Menu {
+	m := newMenu(r.ID(id), title)
+	r.mustAdd(m, false)
+	return m
+}
+
+const (
+	DefaultMaxl            = 182 //used when session does not specify "maxl"
+	DefaultMenuMoreKey     = "98"
+	DefaultMenuMoreCaption = "More"
+	DefaultMenuBackKey     = "99"
+	DefaultMenuBackCaption = "Back"
+)
+
+func newMenu(id string, title string) *Menu {
+	return &Menu{
+		id:          id,
+		title:       title,
+		options:     []MenuOption{},
+		moreKey:     DefaultMenuMoreKey,
+		moreCaption: DefaultMenuMoreCaption,
+		backKey:     DefaultMenuBackKey,
+		backCaption: DefaultMenuBackCaption,
 	}
-	itemByID[id] = m
+}
+
+//WithNormalisers() replaces the global input normalisers for this menu
+func (m *Menu) WithNormalisers(normalisers ...InputNormaliser) *Menu {
+	m.normalisers = append([]InputNormaliser{}, normalisers...)
+	return m
+}
+
+func (m *Menu) InputNormalisers() []InputNormaliser {
+	return m.normalisers
+}
+
+//WithPageKeys() changes the input keys and captions used to select the next/previous page
+func (m *Menu) WithPageKeys(moreKey, moreCaption, backKey, backCaption string) *Menu {
+	if moreKey == "" || backKey == "" || moreKey == backKey {
+		panic(fmt.Sprintf("menu(%s).WithPageKeys(%s,%s) requires two different keys", m.id, moreKey, backKey))
+	}
+	m.moreKey = moreKey
+	m.moreCaption = moreCaption
+	m.backKey = backKey
+	m.backCaption = backCaption
 	return m
 }
 
@@ -50,40 +100,121 @@ func (m *Menu) With(caption string, nextItems ...Item) *Menu {
 }
 
 func (m *Menu) Render(ctx context.Context) string {
-	//s := ctx.Value(CtxSession{}).(Session)
-	if !m.rendered {
-		//first time:
-		//substitute values into text
-		//todo...
-
-		//break into pages
-		//todo...
-
-		m.rendered = true
+	s := ctx.Value(CtxSession{}).(Session)
+	pages := m.pages(ctx, sessionMaxl(s))
+	page := menuPage(s)
+	if page >= len(pages) {
+		page = len(pages) - 1
 	}
-
-	//see which page to render
-	//todo...
-
-	//todo: set in session menu option map -> next item
-
-	menuPage := m.title
-	for n, i := range m.options {
-		menuPage += fmt.Sprintf("\n%d. %s", n+1, i.caption)
-	}
-
-	//prompt user for input showing this page
-	return menuPage
+	return pages[page].text
 }
 
 func (m *Menu) Process(ctx context.Context, input string) ([]Item, error) {
 	log.Debugf("menu(%s) got input(%s) ...", m.id, input)
-	if i64, err := strconv.ParseInt(input, 10, 64); err == nil && i64 >= 1 && int(i64) <= len(m.options) {
+	s := ctx.Value(CtxSession{}).(Session)
+	pages := m.pages(ctx, sessionMaxl(s))
+	page := menuPage(s)
+	if page >= len(pages) {
+		page = len(pages) - 1
+	}
+	switch {
+	case input == m.moreKey && page < len(pages)-1:
+		s.Set("menu_page", page+1)
+		return []Item{m}, nil
+	case input == m.backKey && page > 0:
+		s.Set("menu_page", page-1)
+		return []Item{m}, nil
+	}
+	//only accept options displayed on this page
+	if i64, err := strconv.ParseInt(input, 10, 64); err == nil && int(i64) >= pages[page].first && int(i64) <= pages[page].last {
 		nextItems := m.options[i64-1].nextItems
 		if len(nextItems) == 0 {
 			return []Item{m}, errors.Errorf("not yet implemented") //display same item with error
 		}
+		s.Del("menu_page")
 		return nextItems, nil
 	}
 	return []Item{m}, nil //redisplay without error
 }
+
+//menuPageText is a rendered page with options first..last (1=first option)
+type menuPageText struct {
+	text  string
+	first int
+	last  int
+}
+
+//pages() renders the menu into pages that are each not longer than maxl
+//with navigation options (see Router.WithNavigation()) on every page
+//a single option that does not fit is still displayed on its own page
+func (m *Menu) pages(ctx context.Context, maxl int) []menuPageText {
+	title := RenderText(ctx, m.title)
+	lines := make([]string, len(m.options))
+	for n, i := range m.options {
+		lines[n] = fmt.Sprintf("\n%d. %s", n+1, RenderText(ctx, i.caption))
+	}
+	moreLine := fmt.Sprintf("\n%s. %s", m.moreKey, RenderText(ctx, m.moreCaption))
+	backLine := fmt.Sprintf("\n%s. %s", m.backKey, RenderText(ctx, m.backCaption))
+	navLine := strings.Join(navLines(ctx), "")
+	textLen := func(s string) int { return len([]rune(s)) }
+
+	pages := []menuPageText{}
+	n := 0
+	for {
+		p := menuPageText{text: title, first: n + 1, last: n}
+		navLen := textLen(navLine)
+		if len(pages) > 0 {
+			navLen += textLen(backLine)
+		}
+		for n < len(lines) {
+			//reserve space for more, unless this is the last option
+			moreLen := 0
+			if n < len(lines)-1 {
+				moreLen = textLen(moreLine)
+			}
+			if p.last >= p.first && textLen(p.text)+textLen(lines[n])+navLen+moreLen > maxl {
+				break
+			}
+			p.text += lines[n]
+			p.last = n + 1
+			n++
+		}
+		if n < len(lines) {
+			p.text += moreLine
+		}
+		if len(pages) > 0 {
+			p.text += backLine
+		}
+		p.text += navLine
+		pages = append(pages, p)
+		if n >= len(lines) {
+			break
+		}
+	}
+	return pages
+} //Menu.pages()
+
+func menuPage(s Session) int {
+	switch page := s.Get("menu_page").(type) {
+	case int:
+		return page
+	case float64:
+		return int(page) //after JSON encoding in central storage
+	}
+	return 0
+}
+
+//sessionMaxl() returns the maximum length of text that can be displayed to the user
+func sessionMaxl(s Session) int {
+	switch maxl := s.Get("maxl").(type) {
+	case int:
+		return maxl
+	case float64:
+		return int(maxl) //after JSON encoding in central storage
+	case string:
+		if i, err := strconv.Atoi(maxl); err == nil {
+			return i
+		}
+	}
+	return DefaultMaxl
+}
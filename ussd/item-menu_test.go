@@ -0,0 +1,119 @@
+package ussd
+
+import (
+	"context"
+	"testing"
+)
+
+func testPagedMenu(r *Registry, prefix string) *Menu {
+	return r.NewMenu(prefix+"_menu", "Menu").
+		With("Option A", r.NewFinal(prefix+"_a", "A")).
+		With("Option B", r.NewFinal(prefix+"_b", "B")).
+		With("Option C", r.NewFinal(prefix+"_c", "C")).
+		With("Option D", r.NewFinal(prefix+"_d", "D")).
+		With("Option E", r.NewFinal(prefix+"_e", "E"))
+}
+
+func TestMenuPages(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	menu := testPagedMenu(r, "test_pages")
+
+	tests := []struct {
+		maxl  int
+		texts []string
+	}{
+		{DefaultMaxl, []string{"Menu\n1. Option A\n2. Option B\n3. Option C\n4. Option D\n5. Option E"}},
+		//the last option does not reserve space for more
+		{64, []string{"Menu\n1. Option A\n2. Option B\n3. Option C\n4. Option D\n5. Option E"}},
+		{63, []string{
+			"Menu\n1. Option A\n2. Option B\n3. Option C\n4. Option D\n98. More",
+			"Menu\n5. Option E\n99. Back",
+		}},
+		{40, []string{
+			"Menu\n1. Option A\n2. Option B\n98. More",
+			"Menu\n3. Option C\n98. More\n99. Back",
+			"Menu\n4. Option D\n5. Option E\n99. Back",
+		}},
+		//an option that does not fit is still displayed on its own page
+		{10, []string{
+			"Menu\n1. Option A\n98. More",
+			"Menu\n2. Option B\n98. More\n99. Back",
+			"Menu\n3. Option C\n98. More\n99. Back",
+			"Menu\n4. Option D\n98. More\n99. Back",
+			"Menu\n5. Option E\n99. Back",
+		}},
+	}
+	for _, test := range tests {
+		pages := menu.pages(ctx, test.maxl)
+		if len(pages) != len(test.texts) {
+			t.Fatalf("maxl=%d: %d pages instead of %d: %+v", test.maxl, len(pages), len(test.texts), pages)
+		}
+		next := 1
+		for i, p := range pages {
+			if p.text != test.texts[i] {
+				t.Fatalf("maxl=%d: page[%d]=%q instead of %q", test.maxl, i, p.text, test.texts[i])
+			}
+			if p.first != next || p.last < p.first {
+				t.Fatalf("maxl=%d: page[%d] has options %d..%d after %d", test.maxl, i, p.first, p.last, next-1)
+			}
+			if p.last > p.first && len([]rune(p.text)) > test.maxl {
+				t.Fatalf("maxl=%d: page[%d] len %d is too long", test.maxl, i, len([]rune(p.text)))
+			}
+			next = p.last + 1
+		}
+		if next != 6 {
+			t.Fatalf("maxl=%d: pages end with option %d", test.maxl, next-1)
+		}
+	}
+} //TestMenuPages()
+
+func TestMenuPaging(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	router := r.NewRouter("test_paging_router").WithCode("*8#", testPagedMenu(r, "test_paging"))
+	page1 := "Menu\n1. Option A\n2. Option B\n98. More"
+	page2 := "Menu\n3. Option C\n98. More\n99. Back"
+	page3 := "Menu\n4. Option D\n5. Option E\n99. Back"
+
+	testResponses.reset("paging1")
+	if err := Start(ctx, "paging1", map[string]interface{}{"maxl": 40}, router, "*8#", testResponses, "paging1"); err != nil {
+		t.Fatalf("Start failed: %+v", err)
+	}
+	if res, _ := testResponses.last("paging1"); res.Type != ResponseTypeResponse || res.Message != page1 {
+		t.Fatalf("got %+v", res)
+	}
+
+	//back on the first page and options on other pages redisplay the page
+	for _, input := range []string{"99", "3", "0", "6"} {
+		if res := testInput(t, ctx, "paging1", input); res.Type != ResponseTypeResponse || res.Message != page1 {
+			t.Fatalf("input(%s) got %+v", input, res)
+		}
+	}
+	if res := testInput(t, ctx, "paging1", "98"); res.Message != page2 {
+		t.Fatalf("got %+v", res)
+	}
+
+	//the page is stored as float64 in central storage
+	if data := testJSONRoundTrip(t, "paging1"); data["menu_page"] != float64(1) || data["maxl"] != float64(40) {
+		t.Fatalf("menu_page=(%T)%v maxl=(%T)%v", data["menu_page"], data["menu_page"], data["maxl"], data["maxl"])
+	}
+	if res := testInput(t, ctx, "paging1", "98"); res.Message != page3 {
+		t.Fatalf("got %+v", res)
+	}
+	testJSONRoundTrip(t, "paging1")
+	//more on the last page redisplays the page
+	if res := testInput(t, ctx, "paging1", "98"); res.Message != page3 {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testInput(t, ctx, "paging1", "99"); res.Message != page2 {
+		t.Fatalf("got %+v", res)
+	}
+	testJSONRoundTrip(t, "paging1")
+	if res := testInput(t, ctx, "paging1", "1"); res.Message != page2 {
+		t.Fatalf("option on another page got %+v", res)
+	}
+	if res := testInput(t, ctx, "paging1", "3"); res.Type != ResponseTypeRelease || res.Message != "C" {
+		t.Fatalf("got %+v", res)
+	}
+} //TestMenuPaging()
@@ -1,46 +1,127 @@
 package ussd
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
 //Prompt implements ussd.ItemWithInputHandler
 type Prompt struct {
-	id         string
-	text       string
-	name       string
-	validators []InputValidator
+	id          string
+	text        string
+	name        string
+	validators  []InputValidator
+	maxAttempts int
+	failItems   []Item
+	normalisers []InputNormaliser
 }
 
+//InputValidator returns an error to display before the prompt is repeated,
+//see InputError and the standard validators like ValidateNumeric()
 type InputValidator interface {
 	Validate(input string) error
 }
 
 func NewPrompt(id string, text string, name string) *Prompt {
+	return registry.NewPrompt(id, text, name)
+}
+
+func (r *Registry) NewPrompt(id string, text string, name string) *Prompt {
 	p := &Prompt{
-		id:         id,
+		id:         r.ID(id),
 		text:       text,
 		name:       name,
 		validators: nil,
 	}
-	itemByID[id] = p
+	r.mustAdd(p, false)
+	return p
+}
+
+//WithValidator() adds validators that are applied in order, the first error is displayed
+func (p *Prompt) WithValidator(validators ...InputValidator) *Prompt {
+	for _, v := range validators {
+		if v == nil {
+			panic(fmt.Sprintf("prompt(%s).WithValidator(nil)", p.id))
+		}
+	}
+	p.validators = append(p.validators, validators...)
+	return p
+}
+
+//WithMaxAttempts() limits the number of invalid inputs,
+//then the session continues with the fail items instead of repeating the prompt,
+//and the items queued after the prompt are discarded,
+//e.g. a final "Too many attempts." to end the session
+func (p *Prompt) WithMaxAttempts(maxAttempts int, failItems ...Item) *Prompt {
+	if maxAttempts < 1 || len(failItems) == 0 {
+		panic(fmt.Sprintf("prompt(%s).WithMaxAttempts(%d) requires maxAttempts>=1 and fail items", p.id, maxAttempts))
+	}
+	p.maxAttempts = maxAttempts
+	p.failItems = failItems
+	return p
+}
+
+//WithNormalisers() replaces the global input normalisers for this prompt,
+//e.g. to keep spaces in a name, or to uppercase a voucher code
+func (p *Prompt) WithNormalisers(normalisers ...InputNormaliser) *Prompt {
+	p.normalisers = append([]InputNormaliser{}, normalisers...)
 	return p
 }
 
+func (p *Prompt) InputNormalisers() []InputNormaliser {
+	return p.normalisers
+}
+
 func (p Prompt) ID() string {
 	return p.id
 }
 
 func (p *Prompt) Render(ctx context.Context) string {
-	return p.text
+	return RenderText(ctx, p.text)
 }
 
 func (p *Prompt) Process(ctx context.Context, input string) ([]Item, error) {
 	s := ctx.Value(CtxSession{}).(Session)
 	for _, v := range p.validators {
 		if err := v.Validate(input); err != nil {
+			if p.maxAttempts > 0 {
+				attempts := promptAttempts(s, p.id) + 1
+				if attempts >= p.maxAttempts {
+					log.Debugf("prompt(%s) failed %d attempts", p.id, attempts)
+					s.Del(promptAttemptsName(p.id))
+					return []Item{replaceNextItems{items: p.failItems}}, nil
+				}
+				s.Set(promptAttemptsName(p.id), attempts)
+			}
 			return []Item{p}, err //repeat prompt with error message
 		}
 	}
-	//todo: optional validator + invalid message
+	s.Del(promptAttemptsName(p.id))
 	s.Set(p.name, input)
 	return nil, nil
 }
+
+//promptAttemptsName() is the session value name to count invalid inputs of a prompt,
+//so that prompts do not count each other's attempts
+func promptAttemptsName(id string) string {
+	return "prompt_attempts:" + id
+}
+
+func promptAttempts(s Session, id string) int {
+	switch attempts := s.Get(promptAttemptsName(id)).(type) {
+	case int:
+		return attempts
+	case float64:
+		return int(attempts) //after JSON encoding in central storage
+	}
+	return 0
+}
+
+//replaceNextItems is returned by Process() to continue with its items
+//instead of the items that are queued in the session, see proceed()
+//it is never queued, so it is not registered
+type replaceNextItems struct {
+	items []Item
+}
+
+func (r replaceNextItems) ID() string { return "replace_next_items" }
@@ -0,0 +1,89 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//NewRedirect() returns an item that ends the session with a redirect to another USSD code,
+//then the HLR starts a new session with that code, e.g. NewRedirect("to_airtime", "*141#")
+func NewRedirect(id string, code string) *Redirect {
+	return registry.NewRedirect(id, code)
+}
+
+func (r *Registry) NewRedirect(id string, code string) *Redirect {
+	if err := checkRedirectCode(code); err != nil {
+		panic(fmt.Sprintf("redirect(%s): %+v", id, err))
+	}
+	rd := &Redirect{
+		id:   r.ID(id),
+		code: code,
+	}
+	r.mustAdd(rd, false)
+	return rd
+}
+
+//NewRedirectExpr() returns a redirect to the code that results from the expression,
+//e.g. NewRedirectExpr("to_service", `"*140*" + service + "#"`)
+func NewRedirectExpr(id string, expr string) *Redirect {
+	return registry.NewRedirectExpr(id, expr)
+}
+
+func (r *Registry) NewRedirectExpr(id string, expr string) *Redirect {
+	if err := Expr(expr).Check(); err != nil {
+		panic(fmt.Sprintf("redirect(%s): %+v", id, err))
+	}
+	rd := &Redirect{
+		id:   r.ID(id),
+		expr: Expr(expr),
+	}
+	r.mustAdd(rd, false)
+	return rd
+}
+
+//Redirect implements ussd.ItemUsr
+//like a final response it ends the session, but responds with ResponseTypeRedirect
+//and the USSD code as message, items queued after the redirect are not processed
+type Redirect struct {
+	id   string
+	code string
+	expr Expr
+}
+
+func (rd Redirect) ID() string { return rd.id }
+
+//Code() returns the USSD code to redirect to
+func (rd Redirect) Code(ctx context.Context) (string, error) {
+	if rd.expr == "" {
+		return rd.code, nil
+	}
+	value, err := rd.expr.Eval(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "redirect(%s) cannot evaluate code", rd.id)
+	}
+	code := fmt.Sprintf("%v", value)
+	if err := checkRedirectCode(code); err != nil {
+		return "", errors.Wrapf(err, "redirect(%s) expr(%s)", rd.id, rd.expr)
+	}
+	return code, nil
+}
+
+//Render() returns the code, so the redirect can be displayed like other responses
+func (rd Redirect) Render(ctx context.Context) string {
+	code, err := rd.Code(ctx)
+	if err != nil {
+		log.Errorf("%+v", err)
+		return ""
+	}
+	return code
+}
+
+func checkRedirectCode(code string) error {
+	if len(code) < 2 || (code[0] != '*' && code[0] != '#') || !strings.HasSuffix(code, "#") {
+		return errors.Errorf("redirect code(%s) must start with '*' or '#' and end with '#'", code)
+	}
+	return nil
+}
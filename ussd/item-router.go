@@ -4,28 +4,61 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 
 	"bitbucket.org/vservices/utils/v4/errors"
 )
 
 func NewRouter(id string) *Router {
+	return registry.NewRouter(id)
+}
+
+func (reg *Registry) NewRouter(id string) *Router {
 	r := &Router{
-		id:       id,
-		byCode:   map[string][]Item{},
-		byPrefix: map[string][]Item{},
-		byRegex:  []regexRoute{},
+		id:        reg.ID(id),
+		byCode:    map[string][]Item{},
+		byPrefix:  map[string][]Item{},
+		byRegex:   []regexRoute{},
+		shortcuts: true,
 	}
-	itemByID[id] = r
-	log.Debugf("defined item: %T(%s)", r, id)
+	reg.mustAdd(r, false)
 	return r
 }
 
-//Router implements ItemWithInputHandler
+//Router implements ItemSvcExec to select next items from the USSD code (session "init_request")
+//routes are matched in this order, see Route():
+//	1. exact code
+//	2. longest matching prefix
+//	3. regex in the order they were added
+//	4. shortcut: when nothing matched, the longest base code that matches, e.g. "*140*2*1#"
+//	   routes as "*140#" and then "2" and "1" are processed by the first prompts or menus
 type Router struct {
-	id       string
-	byCode   map[string][]Item
-	byPrefix map[string][]Item //todo: check longest first - not reliable as it is here!
-	byRegex  []regexRoute
+	id        string
+	byCode    map[string][]Item
+	byPrefix  map[string][]Item
+	prefixes  []string //longest first
+	byRegex   []regexRoute
+	nav       navigation
+	shortcuts bool
+}
+
+//WithShortcuts() enables (default) or disables shortcut dialling
+func (r *Router) WithShortcuts(enabled bool) *Router {
+	r.shortcuts = enabled
+	return r
+}
+
+//WithNavigation() enables keys that the user can enter in any prompt or menu
+//to go back to the previous prompt or home to the first prompt of the session,
+//e.g. DefaultNavBackKey "0" and DefaultNavHomeKey "00", use "" to disable a key
+//navigation is off by default, because the keys are not passed to prompts, see navigation
+func (r *Router) WithNavigation(backKey, backCaption, homeKey, homeCaption string) *Router {
+	if backKey != "" && backKey == homeKey {
+		panic(fmt.Sprintf("router(%s).WithNavigation(%s,%s) requires different keys", r.id, backKey, homeKey))
+	}
+	r.nav = navigation{backKey: backKey, backCaption: backCaption, homeKey: homeKey, homeCaption: homeCaption}
+	return r
 }
 
 func (r *Router) WithCode(code string, nextItems ...Item) *Router {
@@ -34,10 +67,23 @@ func (r *Router) WithCode(code string, nextItems ...Item) *Router {
 }
 
 func (r *Router) WithPrefix(prefix string, nextItem ...Item) *Router {
+	if _, ok := r.byPrefix[prefix]; !ok {
+		r.prefixes = append(r.prefixes, prefix)
+		sort.Slice(r.prefixes, func(i, j int) bool {
+			if len(r.prefixes[i]) != len(r.prefixes[j]) {
+				return len(r.prefixes[i]) > len(r.prefixes[j])
+			}
+			return r.prefixes[i] < r.prefixes[j]
+		})
+	}
 	r.byPrefix[prefix] = nextItem
 	return r
 }
 
+//WithRegex() routes codes that match the pattern (anchored at both ends),
+//and stores each subexpression in session data using the names, e.g.
+//	WithRegex(`\*140\*([0-9]+)#`, []string{"bnumber"}, deliver)
+//use name "" to not store a subexpression
 func (r *Router) WithRegex(pattern string, regexNames []string, item Item) *Router {
 	regex, err := regexp.Compile("^" + pattern + "$")
 	if err != nil {
@@ -63,28 +109,55 @@ func (r Router) ID() string {
 func (r Router) Exec(ctx context.Context) ([]Item, error) {
 	s := ctx.Value(CtxSession{}).(Session)
 	input := s.Get("init_request").(string)
+	r.nav.start(s)
 
-	//routing: select a service based on the USSD code
+	items, values, ok := r.Route(input)
+	if !ok && r.shortcuts {
+		bases, inputs := splitShortcut(input)
+		for i, base := range bases {
+			if items, values, ok = r.Route(base); ok {
+				log.Debugf("code(%s) routed as shortcut(%s) with inputs %v", input, base, inputs[i])
+				s.Set("shortcut_inputs", inputs[i])
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, errors.Errorf("unknown USSD code(%s)", input)
+	}
+	for name, value := range values {
+		s.Set(name, value)
+	}
+	return items, nil
+} //Router.Exec()
+
+//Route() selects the next items for a USSD code without changing the session
+//and returns the named regex subexpressions that Exec() stores in the session
+func (r Router) Route(code string) ([]Item, map[string]string, bool) {
 	//start by looking up the exact code match, which uses a map hash
 	//and will be the quickest match
-	if items, ok := r.byCode[input]; ok {
-		return items, nil //found exact match
-	} else {
-		//run through prefix matches, e.g. *123* and *123# both go to xyz
-		for prefix, items := range r.byPrefix {
-			if len(input) >= len(prefix) && input[0:len(prefix)] == prefix {
-				return items, nil //match prefix
-			}
+	if items, ok := r.byCode[code]; ok {
+		return items, nil, true
+	}
+	//then prefix matches, longest first, e.g. *123*1 before *123*
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(code, prefix) {
+			return r.byPrefix[prefix], nil, true
 		}
 	}
 	for _, route := range r.byRegex {
-		if route.regex.MatchString(input) {
-			if len(route.names) > 0 {
-				subMatches := route.regex.FindStringSubmatchIndex(input)
-				log.Debugf("matched(%s) -> %+v", input, subMatches)
+		subMatches := route.regex.FindStringSubmatch(code)
+		if subMatches == nil {
+			continue
+		}
+		values := map[string]string{}
+		for i, name := range route.names {
+			if name != "" {
+				values[name] = subMatches[i+1]
 			}
-			return []Item{route.item}, nil
 		}
+		log.Debugf("code(%s) matched regex(%s) -> %+v", code, route.regex.String(), values)
+		return []Item{route.item}, values, true
 	}
-	return nil, errors.Errorf("unknown USSD code")
-} //Router.Exec()
+	return nil, nil, false
+} //Router.Route()
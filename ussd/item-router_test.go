@@ -0,0 +1,103 @@
+package ussd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	r := NewRegistry()
+	exact := r.NewFinal("exact", "exact")
+	short := r.NewFinal("short", "short")
+	long := r.NewFinal("long", "long")
+	regex := r.NewFinal("regex", "regex")
+	router := r.NewRouter("router").
+		WithCode("*123#", exact).
+		WithPrefix("*123*", short).
+		WithPrefix("*123*1", long).
+		WithRegex(`\*140\*([0-9]+)#`, []string{"bnumber"}, regex).
+		WithRegex(`\*141\*([0-9]+)\*([0-9]+)#`, []string{"", "amount"}, regex)
+
+	tests := []struct {
+		code   string
+		item   Item
+		values map[string]string
+	}{
+		{"*123#", exact, nil},
+		{"*123*2#", short, nil},
+		{"*123*1#", long, nil},
+		{"*123*12#", long, nil},
+		{"*140*0821234567#", regex, map[string]string{"bnumber": "0821234567"}},
+		{"*141*0821234567*50#", regex, map[string]string{"amount": "50"}},
+		//regex is anchored
+		{"*140*0821234567#1", nil, nil},
+		{"1*140*0821234567#", nil, nil},
+		{"*140*abc#", nil, nil},
+		{"*124#", nil, nil},
+	}
+	for _, test := range tests {
+		items, values, ok := router.Route(test.code)
+		if test.item == nil {
+			if ok {
+				t.Errorf("code(%s) routed to %v", test.code, items)
+			}
+			continue
+		}
+		if !ok || len(items) != 1 || items[0] != test.item {
+			t.Errorf("code(%s) routed to %v, expected %s", test.code, items, test.item.ID())
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("code(%s) values %v, expected %v", test.code, values, test.values)
+		}
+	}
+}
+
+func TestRouteShortcut(t *testing.T) {
+	r := NewRegistry()
+	menu := r.NewMenu("menu", "Menu")
+	regex := r.NewFinal("regex", "regex")
+	router := r.NewRouter("router").
+		WithCode("*140#", menu).
+		WithCode("*140*2#", menu).
+		WithRegex(`\*140\*9\*([0-9]+)#`, []string{"bnumber"}, regex)
+	noShortcuts := r.NewRouter("no_shortcuts").
+		WithCode("*140#", menu).
+		WithShortcuts(false)
+
+	tests := []struct {
+		router *Router
+		code   string
+		item   Item
+		inputs []string
+	}{
+		{router, "*140#", menu, nil},
+		//longest base code first
+		{router, "*140*2*1#", menu, []string{"1"}},
+		{router, "*140*3*1#", menu, []string{"3", "1"}},
+		//routes match before shortcuts
+		{router, "*140*9*123#", regex, nil},
+		{router, "*141*1#", nil, nil},
+		{noShortcuts, "*140*1#", nil, nil},
+	}
+	for _, test := range tests {
+		s := validateSession()
+		s.Set("init_request", test.code)
+		ctx := context.WithValue(context.Background(), CtxSession{}, s)
+		items, err := test.router.Exec(ctx)
+		if test.item == nil {
+			if err == nil {
+				t.Errorf("code(%s) routed to %v", test.code, items)
+			}
+			continue
+		}
+		if err != nil || len(items) != 1 || items[0] != test.item {
+			t.Errorf("code(%s) routed to %v (err=%v), expected %s", test.code, items, err, test.item.ID())
+			continue
+		}
+		if inputs, _ := s.Get("shortcut_inputs").([]string); !reflect.DeepEqual(inputs, test.inputs) {
+			t.Errorf("code(%s) shortcut inputs %v, expected %v", test.code, inputs, test.inputs)
+		}
+	}
+}
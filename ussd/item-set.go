@@ -2,22 +2,81 @@ package ussd
 
 import (
 	"context"
+	"fmt"
+	"reflect"
 
-	"github.com/google/uuid"
+	"bitbucket.org/vservices/utils/v4/errors"
 )
 
+//Set() returns an item to set a session value
+//the value may be an Expr that is evaluated on the session, e.g. Set("balance", Expr("balance - amount"))
+//the id is derived from the name and the value with its type, e.g. "set(x=int:1)" or "set(x=expr:a+1)",
+//so the same item is defined in every instance and it can be queued in a suspended session
+//the value must be nil, bool, a number, a string or an Expr, else Set() panics
 func Set(name string, value interface{}) Item {
+	return registry.Set(name, value)
+}
+
+func (r *Registry) Set(name string, value interface{}) Item {
+	s, err := r.newSet(name, value)
+	if err != nil {
+		panic(fmt.Sprintf("%+v", err))
+	}
+	r.mustAdd(s, true)
+	return s
+}
+
+//newSet() returns the set item without defining it
+func (r *Registry) newSet(name string, value interface{}) (set, error) {
+	if err := checkSetValue(value); err != nil {
+		return set{}, errors.Wrapf(err, "set(%s)", name)
+	}
+	if expr, ok := value.(Expr); ok {
+		if err := expr.Check(); err != nil {
+			return set{}, errors.Wrapf(err, "set(%s)", name)
+		}
+	}
 	return set{
-		id:    uuid.New().String(),
+		id:    r.ID(fmt.Sprintf("set(%s=%s)", name, setValueID(value))),
 		name:  name,
 		value: value,
+	}, nil
+}
+
+//setValueID() includes the type, so that e.g. 1, int64(1), 1.0 and Expr("1") give different ids
+func setValueID(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case Expr:
+		return "expr:" + string(v) //not quoted like a string value
 	}
+	return fmt.Sprintf("%T:%#v", value, value)
+}
+
+//checkSetValue() only allows scalar values, because the value is part of the item id,
+//where %#v of maps, slices or pointers would not give the same id in every instance
+func checkSetValue(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if _, ok := value.(Expr); ok {
+		return nil
+	}
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return nil
+	}
+	return errors.Errorf("value (%T)%v is not a bool, number or string", value, value)
 }
 
 type set struct {
 	id    string
 	name  string
-	value interface{} //todo: replace with expression from session data
+	value interface{} //Expr is evaluated, other values are set as is
 }
 
 func (set set) ID() string {
@@ -26,6 +85,13 @@ func (set set) ID() string {
 
 func (set set) Exec(ctx context.Context) ([]Item, error) {
 	s := ctx.Value(CtxSession{}).(Session)
-	s.Set(set.name, set.value)
+	value := set.value
+	if expr, ok := value.(Expr); ok {
+		var err error
+		if value, err = expr.Eval(ctx); err != nil {
+			return nil, errors.Wrapf(err, "failed to set %s", set.name)
+		}
+	}
+	s.Set(set.name, value)
 	return nil, nil
 }
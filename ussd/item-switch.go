@@ -0,0 +1,151 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+//NewSwitch() returns an item that continues with the next items of the first matching case
+//or the default items when no case matches, see Switch
+func NewSwitch(id string) *Switch {
+	return registry.NewSwitch(id)
+}
+
+func (r *Registry) NewSwitch(id string) *Switch {
+	sw := &Switch{
+		id:    r.ID(id),
+		cases: []switchCase{},
+	}
+	r.mustAdd(sw, false)
+	return sw
+}
+
+//Switch implements ussd.ItemSvcExec
+//cases are evaluated in the order they were added, e.g.
+//	ussd.NewSwitch("by_type").
+//		WithValue("type", "prepaid", prepaidMenu).
+//		WithRegex("msisdn", "^2782", vodacomMenu).
+//		WithRange("balance", 0, 10, lowBalance).
+//		WithExpr("balance - amount < 0", insufficient).
+//		WithDefault(mainMenu)
+//the selected items are processed before the items that were queued after the switch
+type Switch struct {
+	id           string
+	cases        []switchCase
+	defaultItems []Item
+}
+
+type switchCase struct {
+	name      string         //session value name, not used for expr
+	value     interface{}    //equals value (as number if both are numbers)
+	regex     *regexp.Regexp //value matches regex
+	min, max  float64        //value is a number in range min..max
+	isRange   bool
+	expr      Expr //expr is true
+	nextItems []Item
+}
+
+func (sw Switch) ID() string { return sw.id }
+
+//WithValue() adds a case for session value name equal to value
+func (sw *Switch) WithValue(name string, value interface{}, nextItems ...Item) *Switch {
+	sw.cases = append(sw.cases, switchCase{name: name, value: value, nextItems: nextItems})
+	return sw
+}
+
+//WithRegex() adds a case for session value name that matches the pattern
+func (sw *Switch) WithRegex(name string, pattern string, nextItems ...Item) *Switch {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("switch(%s) invalid regex(%s): %+v", sw.id, pattern, err))
+	}
+	sw.cases = append(sw.cases, switchCase{name: name, regex: regex, nextItems: nextItems})
+	return sw
+}
+
+//WithRange() adds a case for session value name that is a number in the range min..max (inclusive)
+//use math.Inf() for an open range
+func (sw *Switch) WithRange(name string, min, max float64, nextItems ...Item) *Switch {
+	if min > max {
+		panic(fmt.Sprintf("switch(%s) invalid range %v..%v", sw.id, min, max))
+	}
+	sw.cases = append(sw.cases, switchCase{name: name, min: min, max: max, isRange: true, nextItems: nextItems})
+	return sw
+}
+
+//WithExpr() adds a case for an expression that is true, see Expr
+func (sw *Switch) WithExpr(expr string, nextItems ...Item) *Switch {
+	if err := Expr(expr).Check(); err != nil {
+		panic(fmt.Sprintf("switch(%s): %+v", sw.id, err))
+	}
+	sw.cases = append(sw.cases, switchCase{expr: Expr(expr), nextItems: nextItems})
+	return sw
+}
+
+//WithDefault() sets the items processed when no case matches
+func (sw *Switch) WithDefault(nextItems ...Item) *Switch {
+	sw.defaultItems = nextItems
+	return sw
+}
+
+func (sw Switch) Exec(ctx context.Context) ([]Item, error) {
+	s := ctx.Value(CtxSession{}).(Session)
+	for n, c := range sw.cases {
+		match, err := c.match(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			log.Debugf("switch(%s) case %d: %s", sw.id, n+1, c)
+			return c.nextItems, nil
+		}
+	}
+	log.Debugf("switch(%s) default", sw.id)
+	return sw.defaultItems, nil
+}
+
+func (c switchCase) match(ctx context.Context, s Session) (bool, error) {
+	if c.expr != "" {
+		value, err := c.expr.Eval(ctx)
+		if err != nil {
+			return false, err
+		}
+		return textTrue(value), nil
+	}
+	value := s.Get(c.name)
+	switch {
+	case c.regex != nil:
+		return value != nil && c.regex.MatchString(textString(value)), nil
+	case c.isRange:
+		f, ok := exprNumber(value)
+		return ok && f >= c.min && f <= c.max, nil
+	}
+	if value == nil || c.value == nil {
+		return value == nil && c.value == nil, nil
+	}
+	cmp, err := exprCompare(value, c.value)
+	return err == nil && cmp == 0, nil
+}
+
+//String() describes the case for logs and graphs
+func (c switchCase) String() string {
+	switch {
+	case c.expr != "":
+		return string(c.expr)
+	case c.regex != nil:
+		return fmt.Sprintf("%s =~ %s", c.name, c.regex.String())
+	case c.isRange:
+		s := ""
+		if !math.IsInf(c.min, -1) {
+			s += fmt.Sprintf("%v <= ", c.min)
+		}
+		s += c.name
+		if !math.IsInf(c.max, 1) {
+			s += fmt.Sprintf(" <= %v", c.max)
+		}
+		return s
+	}
+	return fmt.Sprintf("%s == %v", c.name, c.value)
+}
@@ -0,0 +1,124 @@
+package ussd
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestSwitchCaseMatch(t *testing.T) {
+	r := NewRegistry()
+	sw := r.NewSwitch("test_match_switch").
+		WithValue("one", 1).
+		WithValue("text", "1").
+		WithValue("none", nil).
+		WithRegex("msisdn", "^2782").
+		WithRange("balance", 0, 10).
+		WithRange("debt", math.Inf(-1), 0).
+		WithExpr("balance - amount < 0")
+	one, text, none, regex, balance, debt, expr := sw.cases[0], sw.cases[1], sw.cases[2], sw.cases[3], sw.cases[4], sw.cases[5], sw.cases[6]
+
+	tests := []struct {
+		c        switchCase
+		values   map[string]interface{}
+		expected bool
+	}{
+		//value: numbers and strings that are numbers compare as numbers
+		{one, map[string]interface{}{"one": 1}, true},
+		{one, map[string]interface{}{"one": "1"}, true},
+		{one, map[string]interface{}{"one": float64(1)}, true}, //after JSON encoding
+		{one, map[string]interface{}{"one": "1.0"}, true},
+		{one, map[string]interface{}{"one": 2}, false},
+		{one, map[string]interface{}{"one": "one"}, false},
+		{one, nil, false},
+		{text, map[string]interface{}{"text": 1}, true},
+		{text, map[string]interface{}{"text": "1"}, true},
+		{text, map[string]interface{}{"text": "a"}, false},
+		{none, nil, true},
+		{none, map[string]interface{}{"none": ""}, false},
+		//regex
+		{regex, map[string]interface{}{"msisdn": "27821234567"}, true},
+		{regex, map[string]interface{}{"msisdn": 27821234567}, true},
+		{regex, map[string]interface{}{"msisdn": "27831234567"}, false},
+		{regex, nil, false},
+		//range is inclusive and needs a number
+		{balance, map[string]interface{}{"balance": 0}, true},
+		{balance, map[string]interface{}{"balance": "10"}, true},
+		{balance, map[string]interface{}{"balance": 10.5}, false},
+		{balance, map[string]interface{}{"balance": -1}, false},
+		{balance, map[string]interface{}{"balance": "abc"}, false},
+		{balance, map[string]interface{}{"balance": true}, false},
+		{balance, nil, false},
+		{debt, map[string]interface{}{"debt": -1e9}, true},
+		{debt, map[string]interface{}{"debt": 1}, false},
+		//expression
+		{expr, map[string]interface{}{"balance": 5, "amount": "10"}, true},
+		{expr, map[string]interface{}{"balance": 50, "amount": 10}, false},
+	}
+	for n, test := range tests {
+		s := validateSession()
+		for name, value := range test.values {
+			s.Set(name, value)
+		}
+		ctx := context.WithValue(context.Background(), CtxSession{}, s)
+		match, err := test.c.match(ctx, s)
+		if err != nil {
+			t.Fatalf("test[%d] case(%s) %v failed: %+v", n, test.c, test.values, err)
+		}
+		if match != test.expected {
+			t.Fatalf("test[%d] case(%s) %v -> %v", n, test.c, test.values, match)
+		}
+	}
+} //TestSwitchCaseMatch()
+
+func TestSwitchExec(t *testing.T) {
+	r := NewRegistry()
+	prepaid := r.NewFinal("test_exec_prepaid", "prepaid")
+	low := r.NewFinal("test_exec_low", "low")
+	insufficient := r.NewFinal("test_exec_insufficient", "insufficient")
+	main := r.NewFinal("test_exec_main", "main")
+	sw := r.NewSwitch("test_exec_switch").
+		WithValue("type", "prepaid", prepaid).
+		WithRange("balance", 0, 10, low).
+		WithExpr("balance - amount < 0", insufficient).
+		WithDefault(main)
+
+	tests := []struct {
+		values   map[string]interface{}
+		expected Item
+	}{
+		//first matching case in the order they were added
+		{map[string]interface{}{"type": "prepaid", "balance": 5}, prepaid},
+		{map[string]interface{}{"type": "contract", "balance": 5}, low},
+		{map[string]interface{}{"balance": 20, "amount": 30}, insufficient},
+		{map[string]interface{}{"balance": 20, "amount": 10}, main},
+	}
+	for n, test := range tests {
+		s := validateSession()
+		for name, value := range test.values {
+			s.Set(name, value)
+		}
+		ctx := context.WithValue(context.Background(), CtxSession{}, s)
+		items, err := sw.Exec(ctx)
+		if err != nil {
+			t.Fatalf("test[%d] %v failed: %+v", n, test.values, err)
+		}
+		if len(items) != 1 || items[0].ID() != test.expected.ID() {
+			t.Fatalf("test[%d] %v -> %v instead of %s", n, test.values, items, test.expected.ID())
+		}
+	}
+
+	//without a default no items are selected
+	none, err := r.NewSwitch("test_exec_none").WithValue("type", "prepaid", prepaid).Exec(context.WithValue(context.Background(), CtxSession{}, validateSession()))
+	if err != nil || len(none) != 0 {
+		t.Fatalf("got %v, %+v", none, err)
+	}
+
+	//an expression that cannot be evaluated fails
+	s := validateSession()
+	s.Set("balance", "abc")
+	s.Set("amount", 1)
+	if _, err := r.NewSwitch("test_exec_fail").WithExpr("balance < amount", main).Exec(context.WithValue(context.Background(), CtxSession{}, s)); err == nil {
+		t.Fatalf("expression with a text and a number did not fail")
+	}
+} //TestSwitchExec()
@@ -1,6 +1,12 @@
 package ussd
 
-import "context"
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
 
 //Item is any type of USSD service processing step
 type Item interface {
@@ -28,13 +34,17 @@ type ItemUsrPrompt interface {
 	Process(ctx context.Context, input string) (nextItems []Item, err error) //return self to repeat prompt, err to display to user
 }
 
-var (
-	itemByID = map[string]Item{}
-)
-
-func ItemByID(id string) (Item, bool) {
-	if item, ok := itemByID[id]; ok {
-		return item, true
+//ContentID() returns a content-addressed id for an anonymous item,
+//derived from a hash of its kind and definition, e.g. ContentID("profile_get", names)
+//every instance (also after a restart) that defines the same item gets the same id,
+//which is required to refer to the item in session data
+//the definition is hashed in JSON, which has sorted map keys and no pointer addresses,
+//so it must be JSON encodable, else ContentID() panics
+func ContentID(kind string, def ...interface{}) string {
+	jsonDef, err := json.Marshal(def)
+	if err != nil {
+		panic(fmt.Sprintf("ContentID(%s) definition cannot be encoded: %+v", kind, err))
 	}
-	return nil, false
+	h := sha1.Sum(append([]byte(kind), jsonDef...))
+	return kind + "(" + hex.EncodeToString(h[:8]) + ")"
 }
@@ -0,0 +1,61 @@
+package ussd
+
+import (
+	"testing"
+)
+
+func TestContentID(t *testing.T) {
+	a := ContentID("test", map[string]int{"a": 1, "b": 2}, []string{"x"})
+	b := ContentID("test", map[string]int{"b": 2, "a": 1}, []string{"x"})
+	if a != b {
+		t.Fatalf("%s != %s", a, b)
+	}
+	one, two := 1, 1
+	if ContentID("test", &one) != ContentID("test", &two) {
+		t.Fatalf("pointer address is part of the id")
+	}
+	if ContentID("test", "x") == ContentID("other", "x") {
+		t.Fatalf("kind is not part of the id")
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	for _, value := range []interface{}{nil, true, 1, int64(2), 1.5, "x", Expr("a + 1")} {
+		if err := checkSetValue(value); err != nil {
+			t.Errorf("set value (%T)%v: %+v", value, value, err)
+		}
+	}
+	one := 1
+	for _, value := range []interface{}{&one, []int{1}, map[string]int{"a": 1}, struct{}{}} {
+		if err := checkSetValue(value); err == nil {
+			t.Errorf("set value (%T)%v is allowed", value, value)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Set() with a map did not panic")
+		}
+	}()
+	Set("test_set_map", map[string]int{"a": 1})
+}
+
+func TestSetID(t *testing.T) {
+	r := NewRegistry()
+	ids := map[string]interface{}{}
+	for _, value := range []interface{}{1, int64(1), 1.0, "1", Expr("1"), true, nil} {
+		item := r.Set("x", value)
+		if other, ok := ids[item.ID()]; ok {
+			t.Fatalf("set(x) value (%T)%v and (%T)%v have the same id %s", value, value, other, other, item.ID())
+		}
+		ids[item.ID()] = value
+	}
+	if id := r.Set("x", 1).ID(); id != "set(x=int:1)" {
+		t.Fatalf("id %s", id)
+	}
+	if id := r.Set("x", Expr("a + 1")).ID(); id != "set(x=expr:a + 1)" {
+		t.Fatalf("id %s", id)
+	}
+	if id := r.Set("x", "a").ID(); id != `set(x=string:"a")` {
+		t.Fatalf("id %s", id)
+	}
+}
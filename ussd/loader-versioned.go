@@ -0,0 +1,203 @@
+package ussd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+	"github.com/fsnotify/fsnotify"
+)
+
+//VersionedFile loads items from a file that can be reloaded while sessions are running
+//	each version is defined in namespace "<file namespace>.v<hash of file content>",
+//	so sessions that started on a version continue with the items of that version,
+//	and all instances that load the same file content get the same ids
+//	each item id in the file is also defined as "<file namespace>.<id>" which
+//	always uses the active version, e.g. --init=demo.router starts new sessions
+//	on the latest version and stores the version in session data "items_version"
+//	old versions stay defined, so that sessions using them can still continue
+type VersionedFile struct {
+	sync.Mutex
+	r        *Registry
+	filename string
+	version  string
+	versionR *Registry
+	watcher  *fsnotify.Watcher
+}
+
+//LoadVersionedFile() loads a file into the current registry, see VersionedFile
+func LoadVersionedFile(filename string) (*VersionedFile, error) {
+	return registry.LoadVersionedFile(filename)
+}
+
+//LoadVersionedFile() loads a file into this registry, see VersionedFile
+func (r *Registry) LoadVersionedFile(filename string) (*VersionedFile, error) {
+	vf := &VersionedFile{
+		r:        r,
+		filename: filename,
+	}
+	if err := vf.Reload(); err != nil {
+		return nil, err
+	}
+	return vf, nil
+}
+
+//Version() returns the active version
+func (vf *VersionedFile) Version() string {
+	vf.Lock()
+	defer vf.Unlock()
+	return vf.version
+}
+
+//Reload() loads the file again and makes it the active version for new sessions
+//it does nothing when the file content did not change
+func (vf *VersionedFile) Reload() error {
+	vf.Lock()
+	defer vf.Unlock()
+	data, err := ioutil.ReadFile(vf.filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read file %s", vf.filename)
+	}
+	h := sha1.Sum(data)
+	version := "v" + hex.EncodeToString(h[:4])
+	if version == vf.version {
+		log.Debugf("file %s version %s not changed", vf.filename, version)
+		return nil
+	}
+	f, err := parseItemsFile(vf.filename, data)
+	if err != nil {
+		return err
+	}
+
+	//define the version and the active items in a scratch registry,
+	//so nothing is defined and the active version does not change when any item fails
+	scratch := vf.r.scratch()
+	fileR, scratchFileR := vf.r, scratch
+	if f.Namespace != "" {
+		fileR, scratchFileR = vf.r.Namespace(f.Namespace), scratch.Namespace(f.Namespace)
+	}
+	if len(fileR.Namespace(version).IDs()) == 0 {
+		//not loaded before, e.g. when changed back to an older version
+		if err := scratchFileR.Namespace(version).Load(ItemsFile{Items: f.Items}); err != nil {
+			return errors.Wrapf(err, "failed to load items from file %s", vf.filename)
+		}
+	}
+	for _, def := range f.Items {
+		if err := scratchFileR.Add(activeItem{vf: vf, id: fileR.ID(def.ID), itemID: def.ID}); err != nil {
+			return errors.Wrapf(err, "cannot define active item(%s)", def.ID)
+		}
+	}
+	if err := vf.r.merge(scratch); err != nil {
+		return errors.Wrapf(err, "failed to define items from file %s", vf.filename)
+	}
+	log.Debugf("file %s version %s active (was %s)", vf.filename, version, vf.version)
+	vf.version = version
+	vf.versionR = fileR.Namespace(version)
+	return nil
+} //VersionedFile.Reload()
+
+//reloadDelay is the time Watch() waits after the last change before the file is reloaded
+var reloadDelay = 500 * time.Millisecond
+
+//Watch() reloads the file each time it is written
+func (vf *VersionedFile) Watch() error {
+	vf.Lock()
+	defer vf.Unlock()
+	if vf.watcher != nil {
+		return nil //already watching
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrapf(err, "failed to create file watcher")
+	}
+	//watch the directory, because editors often replace the file rather than write to it
+	if err := watcher.Add(filepath.Dir(vf.filename)); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "failed to watch %s", vf.filename)
+	}
+	vf.watcher = watcher
+	go func() {
+		//an editor or copy writes the file in several events, reload once after the last one,
+		//so that a partly written file is not loaded
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(vf.filename) || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Reset(reloadDelay)
+					continue
+				}
+				timer = time.AfterFunc(reloadDelay, func() {
+					if err := vf.Reload(); err != nil {
+						log.Errorf("failed to reload %s: %+v", vf.filename, err)
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("file watcher(%s) error: %+v", vf.filename, err)
+			}
+		}
+	}()
+	return nil
+} //VersionedFile.Watch()
+
+//Close() stops watching the file
+func (vf *VersionedFile) Close() error {
+	vf.Lock()
+	defer vf.Unlock()
+	if vf.watcher == nil {
+		return nil
+	}
+	err := vf.watcher.Close()
+	vf.watcher = nil
+	return err
+}
+
+//active() returns the active version and its item
+func (vf *VersionedFile) active(itemID string) (string, Item, bool) {
+	vf.Lock()
+	defer vf.Unlock()
+	item, ok := vf.versionR.Get(itemID)
+	return vf.version, item, ok
+}
+
+//activeItem implements ItemSvcExec to continue on the item in the active version of the file
+type activeItem struct {
+	vf     *VersionedFile
+	id     string
+	itemID string
+}
+
+func (ai activeItem) ID() string { return ai.id }
+
+func (ai activeItem) Exec(ctx context.Context) ([]Item, error) {
+	version, item, ok := ai.vf.active(ai.itemID)
+	if !ok {
+		return nil, errors.Errorf("item(%s) not defined in version %s of %s", ai.itemID, version, ai.vf.filename)
+	}
+	s := ctx.Value(CtxSession{}).(Session)
+	s.Set("items_version", version)
+	if svcExec, ok := item.(ItemSvcExec); ok {
+		//exec directly, so the active item can be used to start a session
+		return svcExec.Exec(ctx)
+	}
+	return []Item{item}, nil
+}
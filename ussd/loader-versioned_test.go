@@ -0,0 +1,133 @@
+package ussd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testItemsV1 = `
+namespace: vdemo
+items:
+- id: bye
+  type: final
+  text: Bye
+`
+
+//testItemsBad fails to link after bye was defined
+const testItemsBad = `
+namespace: vdemo
+items:
+- id: bye
+  type: final
+  text: Bye now
+- id: menu
+  type: menu
+  title: Menu
+  options:
+  - caption: Missing
+    next: [missing]
+`
+
+const testItemsV2 = `
+namespace: vdemo
+items:
+- id: bye
+  type: final
+  text: Goodbye
+`
+
+func TestVersionedFileReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "items.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testItemsV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry()
+	vf, err := r.LoadVersionedFile(filename)
+	if err != nil {
+		t.Fatalf("failed to load: %+v", err)
+	}
+	v1 := vf.Version()
+	ids := r.IDs()
+
+	//a failed version is not activated and does not define any items,
+	//also not when it is reloaded again
+	if err := ioutil.WriteFile(filename, []byte(testItemsBad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := vf.Reload(); err == nil {
+			t.Fatalf("reload %d did not fail", i)
+		}
+		if vf.Version() != v1 {
+			t.Fatalf("version %s activated after failed reload", vf.Version())
+		}
+		if strings.Join(r.IDs(), ",") != strings.Join(ids, ",") {
+			t.Fatalf("items %v defined after failed reload (was %v)", r.IDs(), ids)
+		}
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(testItemsV2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vf.Reload(); err != nil {
+		t.Fatalf("failed to reload: %+v", err)
+	}
+	if vf.Version() == v1 {
+		t.Fatalf("version not changed")
+	}
+	if _, item, ok := vf.active("bye"); !ok || item.(*Final).text != "Goodbye" {
+		t.Fatalf("active bye=%+v", item)
+	}
+	//old version is still defined
+	if _, ok := r.Get("vdemo." + v1 + ".bye"); !ok {
+		t.Fatalf("old version not defined: %v", r.IDs())
+	}
+}
+
+func TestVersionedFileWatch(t *testing.T) {
+	defer func(d time.Duration) { reloadDelay = d }(reloadDelay)
+	reloadDelay = 100 * time.Millisecond
+
+	filename := filepath.Join(t.TempDir(), "items.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testItemsV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry()
+	vf, err := r.LoadVersionedFile(filename)
+	if err != nil {
+		t.Fatalf("failed to load: %+v", err)
+	}
+	if err := vf.Watch(); err != nil {
+		t.Fatalf("failed to watch: %+v", err)
+	}
+	defer vf.Close()
+	v1 := vf.Version()
+
+	//write the file in parts: only the complete file is loaded
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(testItemsV2, "\n") {
+		f.WriteString(line)
+		f.Sync()
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Close()
+	for i := 0; i < 50 && vf.Version() == v1; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if vf.Version() == v1 {
+		t.Fatalf("not reloaded")
+	}
+	if _, item, ok := vf.active("bye"); !ok || item.(*Final).text != "Goodbye" {
+		t.Fatalf("active bye=%+v", item)
+	}
+	if len(r.Namespace("vdemo").IDs()) != 3 {
+		t.Fatalf("partly written versions loaded: %v", r.IDs())
+	}
+}
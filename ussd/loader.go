@@ -0,0 +1,530 @@
+package ussd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+	"gopkg.in/yaml.v2"
+)
+
+//ItemsFile is the document loaded by LoadFile()
+//	items may refer to other items by id, whether defined in the same file or in go code,
+//	e.g. "pcm_deliver", as long as the go items are defined before the file is loaded
+//	ids are looked up in the file's namespace first, then as a full id
+//
+//example:
+//	namespace: demo
+//	items:
+//	- id: router
+//	  type: router
+//	  routes:
+//	  - code: "*123#"
+//	    next: [main_menu]
+//	- id: main_menu
+//	  type: menu
+//	  title: "*** Demo ***"
+//	  options:
+//	  - caption: Change name
+//	    next: [ask_name, {type: set, name: changed, value: true}, bye]
+//	- id: ask_name
+//	  type: prompt
+//	  text: "Enter your name"
+//	  name: name
+//	- id: bye
+//	  type: final
+//	  text: "Goodbye"
+type ItemsFile struct {
+	Namespace string    `json:"namespace" yaml:"namespace" doc:"Optional namespace for all items defined in the file"`
+	Items     []ItemDef `json:"items" yaml:"items"`
+}
+
+type ItemDef struct {
+	ID          string         `json:"id" yaml:"id" doc:"Item id, required for all types except set"`
+	Type        string         `json:"type" yaml:"type" doc:"One of router|menu|prompt|set|if|switch|final|redirect|language"`
+	Title       string         `json:"title,omitempty" yaml:"title,omitempty" doc:"Menu or language title"`
+	Text        string         `json:"text,omitempty" yaml:"text,omitempty" doc:"Prompt or final text"`
+	Name        string         `json:"name,omitempty" yaml:"name,omitempty" doc:"Session variable name for prompt and set"`
+	Validators  []ValidatorDef `json:"validators,omitempty" yaml:"validators,omitempty" doc:"Prompt input validators"`
+	MaxAttempts int            `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty" doc:"Prompt invalid inputs before continuing with fail items (default: unlimited)"`
+	Fail        []NextDef      `json:"fail,omitempty" yaml:"fail,omitempty" doc:"Items to process after max_attempts invalid inputs"`
+	Normalise   []string       `json:"normalise,omitempty" yaml:"normalise,omitempty" doc:"Prompt or menu input normalisers (trim|strip_hash|strip_plus|digits|upper), replacing the global normalisers"`
+	Value       interface{}    `json:"value,omitempty" yaml:"value,omitempty" doc:"Value for set"`
+	Expr        string         `json:"expr,omitempty" yaml:"expr,omitempty" doc:"Expression for set (instead of value), if or redirect (instead of code), e.g. \"balance - amount\""`
+	Code        string         `json:"code,omitempty" yaml:"code,omitempty" doc:"USSD code for redirect, e.g. \"*141#\""`
+	Then        []NextDef      `json:"then,omitempty" yaml:"then,omitempty" doc:"Items to process when if expr is true"`
+	Else        []NextDef      `json:"else,omitempty" yaml:"else,omitempty" doc:"Items to process when if expr is false"`
+	Cases       []CaseDef      `json:"cases,omitempty" yaml:"cases,omitempty" doc:"Switch cases, the first match is selected"`
+	Default     []NextDef      `json:"default,omitempty" yaml:"default,omitempty" doc:"Items to process when no switch case matches"`
+	Options     []OptionDef    `json:"options,omitempty" yaml:"options,omitempty" doc:"Menu options"`
+	More        *PageKeyDef    `json:"more,omitempty" yaml:"more,omitempty" doc:"Menu option to show the next page, default 98 More"`
+	Back        *PageKeyDef    `json:"back,omitempty" yaml:"back,omitempty" doc:"Menu option to show the previous page, default 99 Back"`
+	Routes      []RouteDef     `json:"routes,omitempty" yaml:"routes,omitempty" doc:"Router routes"`
+	NavBack     *PageKeyDef    `json:"nav_back,omitempty" yaml:"nav_back,omitempty" doc:"Router key to go back to the previous prompt in any prompt or menu, e.g. key 0 caption Back, default none"`
+	NavHome     *PageKeyDef    `json:"nav_home,omitempty" yaml:"nav_home,omitempty" doc:"Router key to go to the first prompt in any prompt or menu, e.g. key 00 caption Main menu, default none"`
+	Shortcuts   *bool          `json:"shortcuts,omitempty" yaml:"shortcuts,omitempty" doc:"Router accepts inputs in the USSD code, e.g. *140*2*1#, default true"`
+	Languages   []string       `json:"languages,omitempty" yaml:"languages,omitempty" doc:"Language codes to select from, default all languages in the catalog"`
+}
+
+type OptionDef struct {
+	Caption string    `json:"caption" yaml:"caption"`
+	Next    []NextDef `json:"next,omitempty" yaml:"next,omitempty" doc:"Items to process when selected, menu option is not yet implemented when omitted"`
+}
+
+type PageKeyDef struct {
+	Key     string `json:"key" yaml:"key"`
+	Caption string `json:"caption" yaml:"caption"`
+}
+
+type RouteDef struct {
+	Code   string    `json:"code,omitempty" yaml:"code,omitempty" doc:"Exact USSD code"`
+	Prefix string    `json:"prefix,omitempty" yaml:"prefix,omitempty" doc:"USSD code prefix"`
+	Regex  string    `json:"regex,omitempty" yaml:"regex,omitempty" doc:"USSD code pattern (only one next item)"`
+	Names  []string  `json:"names,omitempty" yaml:"names,omitempty" doc:"Names for regex subexpressions"`
+	Next   []NextDef `json:"next" yaml:"next"`
+}
+
+//ValidatorDef is a prompt input validator, see ValidateNumeric() etc.
+type ValidatorDef struct {
+	Type    string  `json:"type" yaml:"type" doc:"One of numeric|length|regex|amount|msisdn|pin|date"`
+	Min     float64 `json:"min,omitempty" yaml:"min,omitempty" doc:"Minimum length or amount"`
+	Max     float64 `json:"max,omitempty" yaml:"max,omitempty" doc:"Maximum length or amount"`
+	Pattern string  `json:"pattern,omitempty" yaml:"pattern,omitempty" doc:"Regex pattern"`
+	Length  int     `json:"length,omitempty" yaml:"length,omitempty" doc:"PIN length"`
+	Layout  string  `json:"layout,omitempty" yaml:"layout,omitempty" doc:"Date layout in go format, e.g. \"02012006\" for ddmmyyyy"`
+	Error   string  `json:"error,omitempty" yaml:"error,omitempty" doc:"Error text (default: standard text of the validator)"`
+}
+
+func (def ValidatorDef) validator() (InputValidator, error) {
+	var v InputValidator
+	switch def.Type {
+	case "numeric":
+		v = ValidateNumeric()
+	case "length":
+		if def.Min < 0 || def.Max < def.Min {
+			return nil, errors.Errorf("length min=%v max=%v is not a valid range", def.Min, def.Max)
+		}
+		v = ValidateLength(int(def.Min), int(def.Max))
+	case "regex":
+		if _, err := regexp.Compile(def.Pattern); err != nil {
+			return nil, errors.Wrapf(err, "invalid regex pattern(%s)", def.Pattern)
+		}
+		v = ValidateRegex(def.Pattern)
+	case "amount":
+		if def.Max < def.Min {
+			return nil, errors.Errorf("amount min=%v max=%v is not a valid range", def.Min, def.Max)
+		}
+		v = ValidateAmount(def.Min, def.Max)
+	case "msisdn":
+		v = ValidateMsisdn(nil)
+	case "pin":
+		if def.Length < 1 {
+			return nil, errors.Errorf("pin length=%d is not valid", def.Length)
+		}
+		v = ValidatePin(def.Length)
+	case "date":
+		if def.Layout == "" {
+			return nil, errors.Errorf("date without layout")
+		}
+		v = ValidateDate(def.Layout)
+	default:
+		return nil, errors.Errorf("unknown validator type(%s)", def.Type)
+	}
+	if def.Error != "" {
+		v = ValidatorText(v, def.Error)
+	}
+	return v, nil
+} //ValidatorDef.validator()
+
+func namedInputNormalisers(names []string) ([]InputNormaliser, error) {
+	normalisers := []InputNormaliser{}
+	for _, name := range names {
+		n, ok := InputNormaliserByName(name)
+		if !ok {
+			return nil, errors.Errorf("unknown normaliser(%s)", name)
+		}
+		normalisers = append(normalisers, n)
+	}
+	return normalisers, nil
+}
+
+//CaseDef is a switch case, one of expr, regex, min/max or value
+type CaseDef struct {
+	Name  string      `json:"name,omitempty" yaml:"name,omitempty" doc:"Session variable name, required except for expr"`
+	Value interface{} `json:"value,omitempty" yaml:"value,omitempty" doc:"Value equals"`
+	Regex string      `json:"regex,omitempty" yaml:"regex,omitempty" doc:"Value matches regex"`
+	Min   *float64    `json:"min,omitempty" yaml:"min,omitempty" doc:"Value is a number >= min"`
+	Max   *float64    `json:"max,omitempty" yaml:"max,omitempty" doc:"Value is a number <= max"`
+	Expr  string      `json:"expr,omitempty" yaml:"expr,omitempty" doc:"Expression is true"`
+	Next  []NextDef   `json:"next,omitempty" yaml:"next,omitempty"`
+}
+
+//NextDef is either an item id or an inline item definition
+type NextDef struct {
+	ID   string
+	Item *ItemDef
+}
+
+func (n *NextDef) UnmarshalJSON(v []byte) error {
+	if len(v) > 0 && v[0] == '"' {
+		return json.Unmarshal(v, &n.ID)
+	}
+	n.Item = &ItemDef{}
+	return json.Unmarshal(v, n.Item)
+}
+
+func (n *NextDef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&n.ID); err == nil {
+		return nil
+	}
+	n.Item = &ItemDef{}
+	return unmarshal(n.Item)
+}
+
+func (n NextDef) MarshalJSON() ([]byte, error) {
+	if n.Item != nil {
+		return json.Marshal(n.Item)
+	}
+	return json.Marshal(n.ID)
+}
+
+//LoadFile() defines items from a YAML or JSON file in the current registry
+func LoadFile(filename string) error {
+	return registry.LoadFile(filename)
+}
+
+//LoadFile() defines items from a YAML or JSON file in this registry
+//	files with extension .json are parsed as JSON, all others as YAML
+func (r *Registry) LoadFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read file %s", filename)
+	}
+	f, err := parseItemsFile(filename, data)
+	if err != nil {
+		return err
+	}
+	if err := r.Load(f); err != nil {
+		return errors.Wrapf(err, "failed to load items from file %s", filename)
+	}
+	return nil
+}
+
+//parseItemsFile() parses JSON when filename has extension .json, else YAML
+func parseItemsFile(filename string, data []byte) (ItemsFile, error) {
+	var f ItemsFile
+	var err error
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &f)
+	} else {
+		err = yaml.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return ItemsFile{}, errors.Wrapf(err, "failed to parse file %s", filename)
+	}
+	return f, nil
+}
+
+//Load() defines the items from a parsed file in this registry
+//	all items are first defined, then linked, so items may refer to items defined later in the file
+//	the items are defined in a scratch registry, so no items are defined when it fails
+func (r *Registry) Load(f ItemsFile) error {
+	scratch := r.scratch()
+	nr := scratch
+	if f.Namespace != "" {
+		nr = scratch.Namespace(f.Namespace)
+	}
+	l := loader{r: nr, items: map[string]Item{}}
+	for i, def := range f.Items {
+		if def.ID == "" {
+			return errors.Errorf("items[%d] missing id", i)
+		}
+		if _, err := l.define(def); err != nil {
+			return errors.Wrapf(err, "items[%d] invalid", i)
+		}
+	}
+	for i, def := range f.Items {
+		if err := l.link(def); err != nil {
+			return errors.Wrapf(err, "items[%d](%s) invalid", i, def.ID)
+		}
+	}
+	return r.merge(scratch)
+} //Registry.Load()
+
+type loader struct {
+	r     *Registry
+	items map[string]Item //defined in this file by full id
+}
+
+//define() creates the item without linking to next items
+func (l loader) define(def ItemDef) (Item, error) {
+	if def.Type != "set" && def.ID == "" {
+		return nil, errors.Errorf("%s without id", def.Type)
+	}
+	var item Item
+	switch def.Type {
+	case "router":
+		router := &Router{
+			id:        l.r.ID(def.ID),
+			byCode:    map[string][]Item{},
+			byPrefix:  map[string][]Item{},
+			byRegex:   []regexRoute{},
+			shortcuts: def.Shortcuts == nil || *def.Shortcuts,
+		}
+		if def.NavBack != nil {
+			router.nav.backKey, router.nav.backCaption = def.NavBack.Key, def.NavBack.Caption
+		}
+		if def.NavHome != nil {
+			router.nav.homeKey, router.nav.homeCaption = def.NavHome.Key, def.NavHome.Caption
+		}
+		if router.nav.backKey != "" && router.nav.backKey == router.nav.homeKey {
+			return nil, errors.Errorf("router(%s) needs different keys for nav_back and nav_home", def.ID)
+		}
+		item = router
+	case "menu":
+		menu := newMenu(l.r.ID(def.ID), def.Title)
+		if def.More != nil {
+			menu.moreKey, menu.moreCaption = def.More.Key, def.More.Caption
+		}
+		if def.Back != nil {
+			menu.backKey, menu.backCaption = def.Back.Key, def.Back.Caption
+		}
+		if menu.moreKey == "" || menu.backKey == "" || menu.moreKey == menu.backKey {
+			return nil, errors.Errorf("menu(%s) needs two different keys for more and back", def.ID)
+		}
+		if def.Normalise != nil {
+			normalisers, err := namedInputNormalisers(def.Normalise)
+			if err != nil {
+				return nil, errors.Wrapf(err, "menu(%s) invalid", def.ID)
+			}
+			menu.WithNormalisers(normalisers...)
+		}
+		item = menu
+	case "language":
+		menu := newMenu(l.r.ID(def.ID), def.Title)
+		if err := l.r.addLanguageOptions(menu, def.Languages); err != nil {
+			return nil, errors.Wrapf(err, "language(%s) invalid", def.ID)
+		}
+		item = menu
+	case "prompt":
+		if def.Name == "" {
+			return nil, errors.Errorf("prompt(%s) without name", def.ID)
+		}
+		prompt := &Prompt{
+			id:   l.r.ID(def.ID),
+			text: def.Text,
+			name: def.Name,
+		}
+		for i, vdef := range def.Validators {
+			v, err := vdef.validator()
+			if err != nil {
+				return nil, errors.Wrapf(err, "prompt(%s) validators[%d] invalid", def.ID, i)
+			}
+			prompt.WithValidator(v)
+		}
+		if def.Normalise != nil {
+			normalisers, err := namedInputNormalisers(def.Normalise)
+			if err != nil {
+				return nil, errors.Wrapf(err, "prompt(%s) invalid", def.ID)
+			}
+			prompt.WithNormalisers(normalisers...)
+		}
+		if def.MaxAttempts < 0 || (def.MaxAttempts > 0) != (len(def.Fail) > 0) {
+			return nil, errors.Errorf("prompt(%s) needs both max_attempts and fail items, or neither", def.ID)
+		}
+		item = prompt
+	case "set":
+		if def.Name == "" {
+			return nil, errors.Errorf("set without name")
+		}
+		value := def.Value
+		if def.Expr != "" {
+			if def.Value != nil {
+				return nil, errors.Errorf("set(%s) with both value and expr", def.Name)
+			}
+			value = Expr(def.Expr)
+		}
+		s, err := l.r.newSet(def.Name, value)
+		if err != nil {
+			return nil, err
+		}
+		//the same set may be used in more than one place
+		if err := l.r.add(s, true); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "if":
+		if err := Expr(def.Expr).Check(); err != nil {
+			return nil, errors.Wrapf(err, "if(%s) invalid", def.ID)
+		}
+		item = &If{
+			id:   l.r.ID(def.ID),
+			expr: Expr(def.Expr),
+		}
+	case "switch":
+		item = &Switch{
+			id:    l.r.ID(def.ID),
+			cases: []switchCase{},
+		}
+	case "final":
+		item = &Final{
+			id:   l.r.ID(def.ID),
+			text: def.Text,
+		}
+	case "redirect":
+		if (def.Code == "") == (def.Expr == "") {
+			return nil, errors.Errorf("redirect(%s) needs either code or expr", def.ID)
+		}
+		if def.Code != "" {
+			if err := checkRedirectCode(def.Code); err != nil {
+				return nil, errors.Wrapf(err, "redirect(%s)", def.ID)
+			}
+		} else if err := Expr(def.Expr).Check(); err != nil {
+			return nil, errors.Wrapf(err, "redirect(%s)", def.ID)
+		}
+		item = &Redirect{
+			id:   l.r.ID(def.ID),
+			code: def.Code,
+			expr: Expr(def.Expr),
+		}
+	default:
+		return nil, errors.Errorf("item(%s) has unknown type(%s)", def.ID, def.Type)
+	}
+	if err := l.r.add(item, false); err != nil {
+		return nil, err
+	}
+	l.items[item.ID()] = item
+	return item, nil
+} //loader.define()
+
+//link() adds next items to menu options, router routes, prompt fail items and if/switch branches
+func (l loader) link(def ItemDef) error {
+	item := l.items[l.r.ID(def.ID)]
+	switch def.Type {
+	case "router":
+		router := item.(*Router)
+		for i, route := range def.Routes {
+			nextItems, err := l.nextItems(route.Next)
+			if err != nil {
+				return errors.Wrapf(err, "routes[%d] invalid", i)
+			}
+			switch {
+			case route.Code != "":
+				router.WithCode(route.Code, nextItems...)
+			case route.Prefix != "":
+				router.WithPrefix(route.Prefix, nextItems...)
+			case route.Regex != "":
+				regex, err := regexp.Compile("^" + route.Regex + "$")
+				if err != nil {
+					return errors.Wrapf(err, "routes[%d] invalid regex(%s)", i, route.Regex)
+				}
+				if regex.NumSubexp() != len(route.Names) {
+					return errors.Errorf("routes[%d] regex(%s) has %d subexpressions but %d names", i, route.Regex, regex.NumSubexp(), len(route.Names))
+				}
+				if len(nextItems) != 1 {
+					return errors.Errorf("routes[%d] regex(%s) needs one next item, not %d", i, route.Regex, len(nextItems))
+				}
+				router.WithRegex(route.Regex, route.Names, nextItems[0])
+			default:
+				return errors.Errorf("routes[%d] without code, prefix or regex", i)
+			}
+		}
+	case "menu":
+		menu := item.(*Menu)
+		for i, option := range def.Options {
+			nextItems, err := l.nextItems(option.Next)
+			if err != nil {
+				return errors.Wrapf(err, "options[%d] invalid", i)
+			}
+			menu.With(option.Caption, nextItems...)
+		}
+	case "prompt":
+		if def.MaxAttempts > 0 {
+			failItems, err := l.nextItems(def.Fail)
+			if err != nil {
+				return errors.Wrapf(err, "fail invalid")
+			}
+			item.(*Prompt).WithMaxAttempts(def.MaxAttempts, failItems...)
+		}
+	case "if":
+		thenItems, err := l.nextItems(def.Then)
+		if err != nil {
+			return errors.Wrapf(err, "then invalid")
+		}
+		elseItems, err := l.nextItems(def.Else)
+		if err != nil {
+			return errors.Wrapf(err, "else invalid")
+		}
+		item.(*If).Then(thenItems...).Else(elseItems...)
+	case "switch":
+		sw := item.(*Switch)
+		for i, c := range def.Cases {
+			nextItems, err := l.nextItems(c.Next)
+			if err != nil {
+				return errors.Wrapf(err, "cases[%d] invalid", i)
+			}
+			if c.Expr == "" && c.Name == "" {
+				return errors.Errorf("cases[%d] without name", i)
+			}
+			switch {
+			case c.Expr != "":
+				if err := Expr(c.Expr).Check(); err != nil {
+					return errors.Wrapf(err, "cases[%d] invalid", i)
+				}
+				sw.WithExpr(c.Expr, nextItems...)
+			case c.Regex != "":
+				if _, err := regexp.Compile(c.Regex); err != nil {
+					return errors.Wrapf(err, "cases[%d] invalid regex(%s)", i, c.Regex)
+				}
+				sw.WithRegex(c.Name, c.Regex, nextItems...)
+			case c.Min != nil || c.Max != nil:
+				min, max := math.Inf(-1), math.Inf(1)
+				if c.Min != nil {
+					min = *c.Min
+				}
+				if c.Max != nil {
+					max = *c.Max
+				}
+				if min > max {
+					return errors.Errorf("cases[%d] invalid range %v..%v", i, min, max)
+				}
+				sw.WithRange(c.Name, min, max, nextItems...)
+			default:
+				sw.WithValue(c.Name, c.Value, nextItems...)
+			}
+		}
+		defaultItems, err := l.nextItems(def.Default)
+		if err != nil {
+			return errors.Wrapf(err, "default invalid")
+		}
+		sw.WithDefault(defaultItems...)
+	}
+	return nil
+} //loader.link()
+
+func (l loader) nextItems(defs []NextDef) ([]Item, error) {
+	nextItems := []Item{}
+	for i, next := range defs {
+		if next.Item != nil {
+			item, err := l.define(*next.Item)
+			if err != nil {
+				return nil, errors.Wrapf(err, "next[%d] invalid", i)
+			}
+			if err := l.link(*next.Item); err != nil {
+				return nil, errors.Wrapf(err, "next[%d] invalid", i)
+			}
+			nextItems = append(nextItems, item)
+			continue
+		}
+		item, ok := l.r.Get(next.ID)
+		if !ok {
+			return nil, errors.Errorf("next[%d] unknown item id(%s)", i, next.ID)
+		}
+		nextItems = append(nextItems, item)
+	}
+	return nextItems, nil
+} //loader.nextItems()
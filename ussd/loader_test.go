@@ -0,0 +1,100 @@
+package ussd
+
+import (
+	"testing"
+)
+
+func TestLoadRollback(t *testing.T) {
+	r := NewRegistry()
+	r.NewFinal("existing", "Existing")
+
+	//fails to link the menu after the final was defined
+	err := r.Load(ItemsFile{
+		Namespace: "demo",
+		Items: []ItemDef{
+			{ID: "bye", Type: "final", Text: "Bye"},
+			{ID: "menu", Type: "menu", Title: "Menu", Options: []OptionDef{
+				{Caption: "Bye", Next: []NextDef{{ID: "bye"}, {Item: &ItemDef{Type: "set", Name: "x", Value: 1}}}},
+				{Caption: "Missing", Next: []NextDef{{ID: "missing"}}},
+			}},
+		},
+	})
+	if err == nil {
+		t.Fatalf("loaded with unknown item id")
+	}
+	if ids := r.IDs(); len(ids) != 1 || ids[0] != "existing" {
+		t.Fatalf("items defined after failed load: %v", ids)
+	}
+
+	//fails to define an item with an id that is already defined
+	err = r.Load(ItemsFile{
+		Items: []ItemDef{
+			{ID: "bye", Type: "final", Text: "Bye"},
+			{ID: "existing", Type: "final", Text: "Other"},
+		},
+	})
+	if err == nil {
+		t.Fatalf("loaded a duplicate id")
+	}
+	if ids := r.IDs(); len(ids) != 1 || ids[0] != "existing" {
+		t.Fatalf("items defined after failed load: %v", ids)
+	}
+
+	//items in the file may refer to items in the registry
+	err = r.Load(ItemsFile{
+		Namespace: "demo",
+		Items: []ItemDef{
+			{ID: "menu", Type: "menu", Title: "Menu", Options: []OptionDef{
+				{Caption: "Existing", Next: []NextDef{{ID: "existing"}, {Item: &ItemDef{Type: "set", Name: "x", Value: 1}}}},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to load: %+v", err)
+	}
+	if _, ok := r.Get("demo.menu"); !ok {
+		t.Fatalf("menu not defined: %v", r.IDs())
+	}
+	if _, ok := r.Get("demo.set(x=int:1)"); !ok {
+		t.Fatalf("set not defined: %v", r.IDs())
+	}
+}
+
+func TestLoadSetValues(t *testing.T) {
+	//the same name with a YAML int, JSON float and expression value
+	r := NewRegistry()
+	err := r.Load(ItemsFile{
+		Namespace: "sets",
+		Items: []ItemDef{
+			{ID: "done", Type: "final", Text: "Done"},
+			{ID: "router", Type: "router", Routes: []RouteDef{
+				{Code: "*1#", Next: []NextDef{{Item: &ItemDef{Type: "set", Name: "x", Value: 1}}, {ID: "done"}}},
+				{Code: "*2#", Next: []NextDef{{Item: &ItemDef{Type: "set", Name: "x", Value: float64(1)}}, {ID: "done"}}},
+				{Code: "*3#", Next: []NextDef{{Item: &ItemDef{Type: "set", Name: "x", Expr: "1"}}, {ID: "done"}}},
+				{Code: "*4#", Next: []NextDef{{Item: &ItemDef{Type: "set", Name: "x", Value: 1}}, {ID: "done"}}},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to load: %+v", err)
+	}
+	for _, id := range []string{"sets.set(x=int:1)", "sets.set(x=float64:1)", "sets.set(x=expr:1)"} {
+		if _, ok := r.Get(id); !ok {
+			t.Fatalf("%s not defined: %v", id, r.IDs())
+		}
+	}
+
+	//a conflicting id is an error, not a panic
+	err = r.Load(ItemsFile{
+		Namespace: "conflict",
+		Items: []ItemDef{
+			{ID: "set(x=int:1)", Type: "final", Text: "Not a set"},
+			{ID: "router", Type: "router", Routes: []RouteDef{
+				{Code: "*1#", Next: []NextDef{{Item: &ItemDef{Type: "set", Name: "x", Value: 1}}}},
+			}},
+		},
+	})
+	if err == nil {
+		t.Fatalf("loaded a set with the id of another item")
+	}
+}
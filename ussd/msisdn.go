@@ -0,0 +1,75 @@
+package ussd
+
+import (
+	"strings"
+	"sync"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//MsisdnRules converts phone numbers entered or displayed in a service
+//set your national rules with SetMsisdnRules()
+type MsisdnRules interface {
+	International(msisdn string) (string, error) //digits only, starting with country code
+	National(msisdn string) (string, error)      //national prefix and subscriber number
+}
+
+//NationalMsisdnRules implements MsisdnRules for a country with fixed length subscriber numbers
+type NationalMsisdnRules struct {
+	CountryCode    string `json:"country_code" doc:"e.g. \"27\""`
+	NationalPrefix string `json:"national_prefix" doc:"e.g. \"0\""`
+	SubscriberLen  int    `json:"subscriber_len" doc:"Nr of digits after country code or national prefix, e.g. 9"`
+}
+
+//International() accepts "+27821234567", "0027821234567", "27821234567", "0821234567" and "821234567"
+//and returns "27821234567"
+func (r NationalMsisdnRules) International(msisdn string) (string, error) {
+	s := strings.Replace(msisdn, " ", "", -1)
+	s = strings.TrimPrefix(s, "+")
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return "", errors.Errorf("msisdn(%s) is not numeric", msisdn)
+		}
+	}
+	switch {
+	case strings.HasPrefix(s, "00"+r.CountryCode) && len(s) == 2+len(r.CountryCode)+r.SubscriberLen:
+		return s[2:], nil
+	case strings.HasPrefix(s, r.CountryCode) && len(s) == len(r.CountryCode)+r.SubscriberLen:
+		return s, nil
+	case r.NationalPrefix != "" && strings.HasPrefix(s, r.NationalPrefix) && len(s) == len(r.NationalPrefix)+r.SubscriberLen:
+		return r.CountryCode + s[len(r.NationalPrefix):], nil
+	case len(s) == r.SubscriberLen:
+		return r.CountryCode + s, nil
+	}
+	return "", errors.Errorf("msisdn(%s) is not a valid number", msisdn)
+}
+
+//National() returns e.g. "0821234567"
+func (r NationalMsisdnRules) National(msisdn string) (string, error) {
+	s, err := r.International(msisdn)
+	if err != nil {
+		return "", err
+	}
+	return r.NationalPrefix + s[len(r.CountryCode):], nil
+}
+
+var (
+	msisdnRulesMutex sync.Mutex
+	msisdnRules      MsisdnRules = NationalMsisdnRules{CountryCode: "27", NationalPrefix: "0", SubscriberLen: 9}
+)
+
+//SetMsisdnRules() changes the rules, default is South Africa (27, 0, 9 digits)
+func SetMsisdnRules(rules MsisdnRules) {
+	if rules == nil {
+		panic("SetMsisdnRules(nil)")
+	}
+	msisdnRulesMutex.Lock()
+	defer msisdnRulesMutex.Unlock()
+	msisdnRules = rules
+}
+
+func GetMsisdnRules() MsisdnRules {
+	msisdnRulesMutex.Lock()
+	defer msisdnRulesMutex.Unlock()
+	return msisdnRules
+}
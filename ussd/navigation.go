@@ -0,0 +1,177 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//navigation lets the user go back to the previous ItemUsrPrompt or home to the first
+//ItemUsrPrompt of the session, by entering a reserved key in any prompt or menu
+//	navigation is off unless the router that started the session defines the keys,
+//	see Router.WithNavigation(), because input equal to a key is never passed to the
+//	prompt, e.g. an amount "0" goes back, so choose keys that are not valid answers
+//	each prompt displayed to the user is pushed onto a stack in session data "nav_stack"
+//	with the items that were queued after it, so the queue is restored when going back
+//	and the session can continue in any instance
+const (
+	DefaultNavBackKey     = "0"
+	DefaultNavBackCaption = "Back"
+	DefaultNavHomeKey     = "00"
+	DefaultNavHomeCaption = "Main menu"
+	navStackMax           = 20 //limit session data, oldest entries after home are dropped
+)
+
+type navigation struct {
+	backKey     string
+	backCaption string
+	homeKey     string
+	homeCaption string
+}
+
+//start() defines the navigation keys for the session
+func (nav navigation) start(s Session) {
+	for name, value := range map[string]string{
+		"nav_back_key":     nav.backKey,
+		"nav_back_caption": nav.backCaption,
+		"nav_home_key":     nav.homeKey,
+		"nav_home_caption": nav.homeCaption,
+	} {
+		if value == "" {
+			s.Del(name)
+		} else {
+			s.Set(name, value)
+		}
+	}
+}
+
+func sessionNavigation(s Session) navigation {
+	nav := navigation{}
+	nav.backKey, _ = s.Get("nav_back_key").(string)
+	nav.backCaption, _ = s.Get("nav_back_caption").(string)
+	nav.homeKey, _ = s.Get("nav_home_key").(string)
+	nav.homeCaption, _ = s.Get("nav_home_caption").(string)
+	return nav
+}
+
+//navStack() returns the stack entries [item id, queued item ids...]
+//which after a round trip through central storage may be []interface{}
+func navStack(s Session) ([][]string, error) {
+	switch stack := s.Get("nav_stack").(type) {
+	case nil:
+		return nil, nil
+	case [][]string:
+		return stack, nil
+	case []interface{}:
+		result := make([][]string, len(stack))
+		for i, entry := range stack {
+			switch ids := entry.(type) {
+			case []string:
+				result[i] = ids
+			case []interface{}:
+				for _, id := range ids {
+					itemID, ok := id.(string)
+					if !ok {
+						return nil, errors.Errorf("nav_stack[%d]=(%T)%v is not a list of ids", i, entry, entry)
+					}
+					result[i] = append(result[i], itemID)
+				}
+			default:
+				return nil, errors.Errorf("nav_stack[%d]=(%T)%v is not a list of ids", i, entry, entry)
+			}
+			if len(result[i]) == 0 {
+				return nil, errors.Errorf("nav_stack[%d] is empty", i)
+			}
+		}
+		return result, nil
+	}
+	return nil, errors.Errorf("nav_stack=(%T) is not a list", s.Get("nav_stack"))
+} //navStack()
+
+//navPush() is called when a prompt is displayed to the user
+//a prompt that is displayed again, e.g. the next page of a menu, replaces the top of the stack
+func navPush(s Session, item Item, nextItems []Item) {
+	nav := sessionNavigation(s)
+	if nav.backKey == "" && nav.homeKey == "" {
+		return //navigation not used
+	}
+	stack, err := navStack(s)
+	if err != nil {
+		log.Errorf("session(%s) reset invalid navigation: %+v", s.ID(), err)
+		stack = nil
+	}
+	entry := []string{item.ID()}
+	for _, next := range nextItems {
+		entry = append(entry, next.ID())
+	}
+	if len(stack) > 0 && stack[len(stack)-1][0] == item.ID() {
+		stack[len(stack)-1] = entry
+	} else {
+		stack = append(stack, entry)
+	}
+	if len(stack) > navStackMax {
+		stack = append(stack[:1], stack[2:]...)
+	}
+	s.Set("nav_stack", stack)
+} //navPush()
+
+//navigate() checks if input is a navigation key and then returns the item to display
+//with its queued items restored in the session
+//keys are only used when there is a previous prompt, else the current item processes the input
+func navigate(ctx context.Context, s Session, input string) (Item, bool, error) {
+	nav := sessionNavigation(s)
+	if input == "" {
+		return nil, false, nil
+	}
+	stack, err := navStack(s)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case input == nav.backKey && len(stack) >= 2:
+		stack = stack[:len(stack)-1]
+	case input == nav.homeKey && len(stack) >= 2:
+		stack = stack[:1]
+	default:
+		return nil, false, nil
+	}
+	target := stack[len(stack)-1]
+	item, ok := ctxRegistry(ctx).Get(target[0])
+	if !ok {
+		return nil, false, errors.Errorf("unknown item(%s) in nav_stack", target[0])
+	}
+	log.Debugf("session(%s) navigate(%s) to item(%s)", s.ID(), input, item.ID())
+	s.Set("nav_stack", stack)
+	if len(target) > 1 {
+		s.Set("next_item_ids", target[1:])
+	} else {
+		s.Del("next_item_ids")
+	}
+	//start the item from scratch
+	s.Del("menu_page")
+	s.Del(promptAttemptsName(item.ID()))
+	return item, true, nil
+} //navigate()
+
+//navLines() returns the navigation options to display in a menu,
+//back when there is a previous prompt and home when that is not the same as back
+func navLines(ctx context.Context) []string {
+	s, ok := ctx.Value(CtxSession{}).(Session)
+	if !ok || s == nil {
+		return nil
+	}
+	nav := sessionNavigation(s)
+	stack, err := navStack(s)
+	if err != nil || len(stack) == 0 {
+		return nil
+	}
+	lines := []string{}
+	if nav.backKey != "" && len(stack) >= 2 {
+		lines = append(lines, fmt.Sprintf("\n%s. %s", nav.backKey, RenderText(ctx, nav.backCaption)))
+	}
+	if nav.homeKey != "" && len(stack) >= 3 && stack[0][0] != stack[len(stack)-1][0] {
+		lines = append(lines, fmt.Sprintf("\n%s. %s", nav.homeKey, RenderText(ctx, nav.homeCaption)))
+	}
+	return lines
+} //navLines()
@@ -0,0 +1,79 @@
+package ussd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNavigation(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	amount := r.NewPrompt("test_nav_amount", "Amount?", "amount")
+	pin := r.NewPrompt("test_nav_pin", "PIN?", "pin")
+	done := r.NewFinal("test_nav_done", "Sent <amount>")
+	menu := r.NewMenu("test_nav_menu", "Menu").
+		With("Send", amount, pin, done)
+	router := r.NewRouter("test_nav_router").
+		WithNavigation(DefaultNavBackKey, DefaultNavBackCaption, DefaultNavHomeKey, DefaultNavHomeCaption).
+		WithCode("*6#", menu)
+
+	//no previous prompt: keys are processed by the item
+	if res := testStart(t, ctx, "nav1", router, "*6#"); res.Type != ResponseTypeResponse || res.Message != "Menu\n1. Send" {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testInput(t, ctx, "nav1", "00"); res.Message != "Menu\n1. Send" {
+		t.Fatalf("home with one prompt got %+v", res)
+	}
+	if data := testJSONRoundTrip(t, "nav1"); len(data["nav_stack"].([]interface{})) != 1 {
+		t.Fatalf("nav_stack=%v", data["nav_stack"])
+	}
+
+	//back restores the queued items of the previous prompt
+	testInput(t, ctx, "nav1", "1")
+	testInput(t, ctx, "nav1", "10")
+	testJSONRoundTrip(t, "nav1")
+	if res := testInput(t, ctx, "nav1", "0"); res.Type != ResponseTypeResponse || res.Message != "Amount?" {
+		t.Fatalf("back got %+v", res)
+	}
+	testInput(t, ctx, "nav1", "20")
+	if res := testInput(t, ctx, "nav1", "1234"); res.Type != ResponseTypeRelease || res.Message != "Sent 20" {
+		t.Fatalf("got %+v", res)
+	}
+
+	//home goes to the first prompt from any depth
+	testStart(t, ctx, "nav2", router, "*6#")
+	testInput(t, ctx, "nav2", "1")
+	testInput(t, ctx, "nav2", "10")
+	if res := testInput(t, ctx, "nav2", "00"); res.Type != ResponseTypeResponse || res.Message != "Menu\n1. Send" {
+		t.Fatalf("home got %+v", res)
+	}
+	if data := testJSONRoundTrip(t, "nav2"); len(data["nav_stack"].([]interface{})) != 1 {
+		t.Fatalf("nav_stack=%v", data["nav_stack"])
+	}
+	if res := testInput(t, ctx, "nav2", "1"); res.Message != "Amount?" {
+		t.Fatalf("got %+v", res)
+	}
+} //TestNavigation()
+
+func TestNavigationOff(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	menu := r.NewMenu("test_navoff_menu", "Menu").
+		With("Send",
+			r.NewPrompt("test_navoff_amount", "Amount?", "amount"),
+			r.NewFinal("test_navoff_done", "Sent <amount>"),
+		)
+	router := r.NewRouter("test_navoff_router").WithCode("*7#", menu)
+
+	//without navigation "0" is a prompt answer and menus show no navigation options
+	testStart(t, ctx, "navoff1", router, "*7#")
+	if res := testInput(t, ctx, "navoff1", "1"); res.Message != "Amount?" {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testInput(t, ctx, "navoff1", "0"); res.Type != ResponseTypeRelease || res.Message != "Sent 0" {
+		t.Fatalf("got %+v", res)
+	}
+	if s, _ := sessions.Get("navoff1"); s != nil {
+		t.Fatalf("session not deleted")
+	}
+} //TestNavigationOff()
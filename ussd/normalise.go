@@ -0,0 +1,103 @@
+package ussd
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//InputNormaliser changes user input before it is processed by an ItemUsrPrompt
+type InputNormaliser func(input string) string
+
+//ItemInputNormaliser is implemented by items that normalise their input differently from
+//the global normalisers (see SetInputNormalisers()), e.g. Prompt.WithNormalisers()
+//return nil to use the global normalisers, or an empty list to use the input as is
+type ItemInputNormaliser interface {
+	InputNormalisers() []InputNormaliser
+}
+
+//standard normalisers, also available by name in files: trim, strip_hash, strip_plus, digits, upper
+var (
+	NormaliseTrim      InputNormaliser = strings.TrimSpace
+	NormaliseStripHash InputNormaliser = func(input string) string { return strings.TrimRight(input, "#") }
+	NormaliseStripPlus InputNormaliser = normaliseStripPlus
+	NormaliseDigits    InputNormaliser = normaliseDigits
+	NormaliseUpper     InputNormaliser = strings.ToUpper
+)
+
+var inputNormaliserByName = map[string]InputNormaliser{
+	"trim":       NormaliseTrim,
+	"strip_hash": NormaliseStripHash,
+	"strip_plus": NormaliseStripPlus,
+	"digits":     NormaliseDigits,
+	"upper":      NormaliseUpper,
+}
+
+//InputNormaliserByName() returns a standard normaliser, see NormaliseTrim etc.
+func InputNormaliserByName(name string) (InputNormaliser, bool) {
+	n, ok := inputNormaliserByName[name]
+	return n, ok
+}
+
+var (
+	inputNormalisersMutex sync.Mutex
+	inputNormalisers      = []InputNormaliser{NormaliseTrim, NormaliseStripHash, NormaliseDigits}
+)
+
+//SetInputNormalisers() changes the normalisers applied to all user input, in order
+//default is trim, strip_hash and digits, which does not change the case of e.g. names
+func SetInputNormalisers(normalisers ...InputNormaliser) {
+	for _, n := range normalisers {
+		if n == nil {
+			panic("SetInputNormalisers(nil)")
+		}
+	}
+	inputNormalisersMutex.Lock()
+	defer inputNormalisersMutex.Unlock()
+	inputNormalisers = normalisers
+}
+
+//normaliseInput() applies the item or global normalisers
+func normaliseInput(item Item, input string) string {
+	var normalisers []InputNormaliser
+	if itemNormaliser, ok := item.(ItemInputNormaliser); ok {
+		normalisers = itemNormaliser.InputNormalisers()
+	}
+	if normalisers == nil {
+		inputNormalisersMutex.Lock()
+		normalisers = inputNormalisers
+		inputNormalisersMutex.Unlock()
+	}
+	normalised := input
+	for _, n := range normalisers {
+		normalised = n(normalised)
+	}
+	if normalised != input {
+		log.Debugf("input(%s) normalised to (%s)", input, normalised)
+	}
+	return normalised
+}
+
+//normaliseDigits() maps unicode digits, e.g. full-width "１２３" or arabic-indic, to ASCII "123"
+func normaliseDigits(input string) string {
+	return strings.Map(func(c rune) rune {
+		if c <= unicode.MaxASCII || !unicode.IsDigit(c) {
+			return c
+		}
+		//unicode decimal digits are in contiguous blocks of 10 from zero to nine,
+		//sometimes more blocks follow each other, e.g. mathematical digits
+		zero := c
+		for unicode.IsDigit(zero - 1) {
+			zero--
+		}
+		return '0' + (c-zero)%10
+	}, input)
+}
+
+//normaliseStripPlus() removes a leading '+' from numbers, e.g. "+27821234567" -> "27821234567"
+func normaliseStripPlus(input string) string {
+	if len(input) > 1 && input[0] == '+' && isDigits(input[1:]) {
+		return input[1:]
+	}
+	return input
+}
@@ -0,0 +1,88 @@
+package ussd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormaliseDigits(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"0123456789", "0123456789"},
+		{"１２３", "123"},               //full-width
+		{"０９", "09"},                 //full-width zero and nine
+		{"٠١٢٣٤٥٦٧٨٩", "0123456789"}, //arabic-indic
+		{"۰۱۹", "019"},               //extended arabic-indic
+		{"०५९", "059"},               //devanagari
+		{"𝟎𝟗𝟘𝟡", "0909"},             //mathematical bold and double-struck follow each other
+		{"*١٢٠*٥#", "*120*5#"},       //only digits are changed
+		{"Jan ² ½", "Jan ² ½"},       //not decimal digits
+		{"", ""},
+	}
+	for _, test := range tests {
+		if normalised := normaliseDigits(test.input); normalised != test.expected {
+			t.Fatalf("normaliseDigits(%q)=%q instead of %q", test.input, normalised, test.expected)
+		}
+	}
+}
+
+func TestNormaliseStripPlus(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"+27821234567", "27821234567"},
+		{"27821234567", "27821234567"},
+		{"+", "+"},
+		{"++27", "++27"},
+		{"+27 82", "+27 82"}, //not a number
+		{"+abc", "+abc"},
+		{"1+2", "1+2"},
+	}
+	for _, test := range tests {
+		if normalised := normaliseStripPlus(test.input); normalised != test.expected {
+			t.Fatalf("normaliseStripPlus(%q)=%q instead of %q", test.input, normalised, test.expected)
+		}
+	}
+}
+
+func TestNormaliseInput(t *testing.T) {
+	r := NewRegistry()
+	global := r.NewPrompt("test_normalise_global", "Amount?", "amount")
+	asIs := r.NewPrompt("test_normalise_as_is", "Name?", "name").WithNormalisers()
+	upper := r.NewPrompt("test_normalise_upper", "Code?", "code").WithNormalisers(NormaliseTrim, NormaliseUpper)
+	menu := r.NewMenu("test_normalise_menu", "Menu")
+
+	tests := []struct {
+		item     Item
+		input    string
+		expected string
+	}{
+		//default global normalisers: trim, strip_hash and digits
+		{global, " １٢3# ", "123"},
+		{global, "Jan#", "Jan"},
+		{menu, " 1# ", "1"},
+		//an empty item list uses the input as is
+		{asIs, " １٢3# ", " １٢3# "},
+		{upper, " ab# ", "AB#"},
+		//items that do not normalise use the global normalisers
+		{r.NewFinal("test_normalise_final", "Final"), " 1 ", "1"},
+	}
+	for _, test := range tests {
+		if normalised := normaliseInput(test.item, test.input); normalised != test.expected {
+			t.Fatalf("item(%s) normalised %q to %q instead of %q", test.item.ID(), test.input, normalised, test.expected)
+		}
+	}
+
+	//processed by the prompt in a session
+	ctx := WithRegistry(context.Background(), r)
+	router := r.NewRouter("test_normalise_router").
+		WithCode("*10#", asIs, global, r.NewFinal("test_normalise_done", "<name>:<amount>"))
+	testStart(t, ctx, "normalise1", router, "*10#")
+	testInput(t, ctx, "normalise1", " Jan# ")
+	if res := testInput(t, ctx, "normalise1", "٥٠#"); res.Type != ResponseTypeRelease || res.Message != " Jan# :50" {
+		t.Fatalf("got %+v", res)
+	}
+} //TestNormaliseInput()
@@ -0,0 +1,249 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//Registry holds all defined items by id, so that a session can continue
+//on the same item in any instance
+//	a namespace of the registry prefixes the ids of items created in it with "<namespace>.",
+//	so that different services can use the same ids in one process, e.g.
+//		ussd.Namespace("soscredit").NewMenu("main_menu", ...) has id "soscredit.main_menu"
+//	all namespaces of a registry share the same items, so items can refer to items in other namespaces
+type Registry struct {
+	items     *registryItems
+	namespace string
+}
+
+type registryItems struct {
+	sync.RWMutex
+	itemByID map[string]Item
+	base     *registryItems //only in a scratch registry, see Registry.scratch()
+}
+
+//get() returns an item from these items or else from the base items
+//	the caller must hold the read lock
+func (ri *registryItems) get(id string) (Item, bool) {
+	if item, ok := ri.itemByID[id]; ok {
+		return item, true
+	}
+	if ri.base != nil {
+		ri.base.RLock()
+		defer ri.base.RUnlock()
+		return ri.base.get(id)
+	}
+	return nil, false
+}
+
+//NewRegistry() creates an empty registry, e.g. to test a service in isolation
+//use SetRegistry() to let sessions use it
+func NewRegistry() *Registry {
+	return &Registry{
+		items: &registryItems{
+			itemByID: map[string]Item{},
+		},
+		namespace: "",
+	}
+}
+
+var (
+	//by default all items are defined in this registry
+	//change it with SetRegistry() before items are defined
+	registry = NewRegistry()
+)
+
+//SetRegistry() changes the registry used by the package level constructors
+//and by sessions to find items by id
+//it panics if sessions have been created before this is called
+func SetRegistry(r *Registry) {
+	if r == nil {
+		panic("SetRegistry(nil)")
+	}
+	if atomic.LoadInt32(&sessionsStarted) != 0 {
+		panic("SetRegistry() called after first session was used")
+	}
+	registry = r
+}
+
+//CtxRegistry is the context key for the registry of a session, see WithRegistry()
+type CtxRegistry struct{}
+
+//WithRegistry() returns a context in which Start(), UserInput() and ServiceResponse()
+//find the items of the session in r rather than in the current registry,
+//e.g. to run services with their own registries in one process
+func WithRegistry(ctx context.Context, r *Registry) context.Context {
+	if r == nil {
+		panic("WithRegistry(nil)")
+	}
+	return context.WithValue(ctx, CtxRegistry{}, r)
+}
+
+//ctxRegistry() returns the registry of WithRegistry(), else the current registry
+func ctxRegistry(ctx context.Context) *Registry {
+	if r, ok := ctx.Value(CtxRegistry{}).(*Registry); ok {
+		return r
+	}
+	return registry
+}
+
+//GetRegistry() returns the current registry
+func GetRegistry() *Registry {
+	return registry
+}
+
+//Namespace() returns a namespace in the current registry
+func Namespace(namespace string) *Registry {
+	return registry.Namespace(namespace)
+}
+
+//Namespace() returns a namespace inside this registry's namespace
+func (r *Registry) Namespace(namespace string) *Registry {
+	if namespace == "" || strings.Contains(namespace, ".") {
+		panic(fmt.Sprintf("invalid namespace(%s) (may not be empty or contain '.')", namespace))
+	}
+	return &Registry{
+		items:     r.items,
+		namespace: r.ID(namespace),
+	}
+}
+
+//ID() returns the full id for an item created in this namespace
+func (r *Registry) ID(id string) string {
+	if r.namespace == "" {
+		return id
+	}
+	return r.namespace + "." + id
+}
+
+//Add() registers an item by its ID()
+//	it fails if another item with the same id was already added,
+//	but adding an item equal to the registered item is allowed, which happens
+//	when items with content based ids (see Set() and ContentID()) are defined more than once
+func (r *Registry) Add(item Item) error {
+	return r.add(item, true)
+}
+
+func (r *Registry) add(item Item, allowEqual bool) error {
+	if item == nil || item.ID() == "" {
+		return errors.Errorf("cannot add %T without id", item)
+	}
+	r.items.Lock()
+	defer r.items.Unlock()
+	if existing, ok := r.items.get(item.ID()); ok {
+		if allowEqual && reflect.DeepEqual(existing, item) {
+			return nil
+		}
+		return errors.Errorf("duplicate item id(%s): %T already defined", item.ID(), existing)
+	}
+	r.items.itemByID[item.ID()] = item
+	log.Debugf("defined item: %T(%s)", item, item.ID())
+	return nil
+}
+
+//scratch() returns an empty registry in the same namespace to define items that
+//refer to items in this registry, which are only defined in this registry with merge(),
+//so that nothing is defined when any of them fails, e.g. in Load()
+//	Get() in the scratch registry also finds the items of this registry,
+//	but IDs() and Items() only list the items defined in the scratch registry
+func (r *Registry) scratch() *Registry {
+	return &Registry{
+		items: &registryItems{
+			itemByID: map[string]Item{},
+			base:     r.items,
+		},
+		namespace: r.namespace,
+	}
+}
+
+//merge() defines all items of a scratch registry in this registry,
+//or none of them if any id is already defined for another item
+func (r *Registry) merge(scratch *Registry) error {
+	scratch.items.RLock()
+	itemByID := make(map[string]Item, len(scratch.items.itemByID))
+	for id, item := range scratch.items.itemByID {
+		itemByID[id] = item
+	}
+	scratch.items.RUnlock()
+
+	r.items.Lock()
+	defer r.items.Unlock()
+	for id, item := range itemByID {
+		if existing, ok := r.items.get(id); ok && !reflect.DeepEqual(existing, item) {
+			return errors.Errorf("duplicate item id(%s): %T already defined", id, existing)
+		}
+	}
+	for id, item := range itemByID {
+		r.items.itemByID[id] = item
+		log.Debugf("defined item: %T(%s)", item, id)
+	}
+	return nil
+} //Registry.merge()
+
+//mustAdd() is used by constructors, where a duplicate id is a programming error
+//	allowEqual must be false for items that are modified after construction, e.g. Menu.With()
+func (r *Registry) mustAdd(item Item, allowEqual bool) {
+	if err := r.add(item, allowEqual); err != nil {
+		panic(fmt.Sprintf("%+v", err))
+	}
+}
+
+//Get() returns the item with the specified id
+//	the id is first looked up in this namespace, then as a full id
+func (r *Registry) Get(id string) (Item, bool) {
+	r.items.RLock()
+	defer r.items.RUnlock()
+	if item, ok := r.items.get(r.ID(id)); ok {
+		return item, true
+	}
+	return r.items.get(id)
+}
+
+//IDs() returns the sorted list of full ids of all items in this namespace
+//including items in namespaces inside it
+func (r *Registry) IDs() []string {
+	r.items.RLock()
+	defer r.items.RUnlock()
+	ids := []string{}
+	for id := range r.items.itemByID {
+		if r.namespace == "" || strings.HasPrefix(id, r.namespace+".") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//Items() returns all items in this namespace, sorted by id
+func (r *Registry) Items() []Item {
+	ids := r.IDs()
+	r.items.RLock()
+	defer r.items.RUnlock()
+	items := []Item{}
+	for _, id := range ids {
+		if item, ok := r.items.itemByID[id]; ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//ItemByID() returns an item from the current registry
+func ItemByID(id string) (Item, bool) {
+	return registry.Get(id)
+}
+
+//AddItem() registers an item that was not created with a ussd.NewXxx() constructor,
+//e.g. a custom ItemSvcExec, so that a session can refer to it by id when it continues
+//it panics if another (not equal) item with the same id is already defined
+func AddItem(item Item) Item {
+	registry.mustAdd(item, true)
+	return item
+}
@@ -0,0 +1,42 @@
+package ussd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTwoRegistries(t *testing.T) {
+	//same ids in both registries, not in the current registry
+	newItems := func(greeting string) (*Registry, ItemSvcExec) {
+		r := NewRegistry()
+		router := r.NewRouter("two_router").
+			WithCode("*3#", r.NewPrompt("two_prompt", greeting+"?", "name"), r.NewFinal("two_done", greeting+" <name>"))
+		return r, router
+	}
+	r1, router1 := newItems("Hello")
+	r2, router2 := newItems("Bye")
+	ctx1 := WithRegistry(context.Background(), r1)
+	ctx2 := WithRegistry(context.Background(), r2)
+
+	if res := testStart(t, ctx1, "two1", router1, "*3#"); res.Message != "Hello?" {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testStart(t, ctx2, "two2", router2, "*3#"); res.Message != "Bye?" {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testInput(t, ctx2, "two2", "Jan"); res.Message != "Bye Jan" {
+		t.Fatalf("got %+v", res)
+	}
+	if res := testInput(t, ctx1, "two1", "Piet"); res.Message != "Hello Piet" {
+		t.Fatalf("got %+v", res)
+	}
+
+	//the current registry does not have the items
+	if _, ok := ItemByID("two_prompt"); ok {
+		t.Fatalf("item defined in the current registry")
+	}
+	testStart(t, ctx1, "two3", router1, "*3#")
+	if err := UserInput(context.Background(), "two3", nil, "Jan", testResponses, "two3"); err == nil {
+		t.Fatalf("continued without the registry")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"sync"
+
+	"bitbucket.org/vservices/utils/v4/errors"
 )
 
 //Responder sends a cont/final response to the user
@@ -26,3 +28,12 @@ func AddResponder(r Responder) {
 	}
 	responderByID[r.ID()] = r
 }
+
+func getResponder(id string) (Responder, error) {
+	responderMutex.Lock()
+	defer responderMutex.Unlock()
+	if r, ok := responderByID[id]; ok {
+		return r, nil
+	}
+	return nil, errors.Errorf("responder[%s] not found", id)
+}
@@ -53,11 +53,11 @@ func (t ResponseType) String() string {
 }
 
 func (t *ResponseType) Parse(s string) error {
-	if v, ok := resTypeValue[strings.ToLower(s)]; ok {
+	if v, ok := resTypeValue[strings.ToUpper(s)]; ok {
 		*t = v
 		return nil
 	}
-	return errors.Errorf("unknown ussd.ResponseType(%d)", t)
+	return errors.Errorf("unknown ussd.ResponseType(%s)", s)
 }
 
 func (t *ResponseType) UnmarshalJSON(v []byte) error {
@@ -65,7 +65,7 @@ func (t *ResponseType) UnmarshalJSON(v []byte) error {
 	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
 		return errors.Errorf("ResponseType(%s) expected quoted value", s)
 	}
-	if err := t.Parse(s[1 : len(s)-2]); err != nil {
+	if err := t.Parse(s[1 : len(s)-1]); err != nil {
 		return errors.Wrapf(err, "unable to unmarshal ResponseType(%s)", s)
 	}
 	return nil
@@ -3,7 +3,6 @@ package ussd
 import (
 	"context"
 
-	"bitbucket.org/vservices/ms-vservices-ussd/examples/pcm"
 	"bitbucket.org/vservices/ms-vservices-ussd/ms"
 	"bitbucket.org/vservices/utils/v4/errors"
 )
@@ -17,55 +16,94 @@ type StartRequest struct {
 	ResponderKey string                 `json:"responder_key" doc:"Key given to the responder to send to the correct user"`
 }
 
+func (req StartRequest) Validate() error {
+	if req.Input == "" {
+		return errors.Errorf("missing input")
+	}
+	if req.ResponderID == "" {
+		return errors.Errorf("missing responder_id")
+	}
+	return nil
+}
+
 type ContinueRequest StartRequest
 
+func (req ContinueRequest) Validate() error {
+	if req.ID == "" {
+		return errors.Errorf("missing id")
+	}
+	if req.ResponderID == "" {
+		return errors.Errorf("missing responder_id")
+	}
+	return nil
+}
+
 type AbortRequest struct {
 	ID string `json:"id" doc:"Unique session ID also used in start/continue Request."`
 }
 
-func NewService() ms.Service {
+func (req AbortRequest) Validate() error {
+	if req.ID == "" {
+		return errors.Errorf("missing id")
+	}
+	return nil
+}
+
+//Service handles USSD requests received by any ms.Handler, e.g. NATS
+//responses are sent asynchronously with the responder named in the request,
+//which must be registered with AddResponder()
+type Service struct {
+	initItem ItemSvcExec //used when a start request does not specify item_id
+}
+
+func NewService(initItem ItemSvcExec) ms.Service {
+	s := Service{initItem: initItem}
 	return ms.NewService().
-		Handle(RequestTypeRequest.String(), s.HandleStart).
-		Handle(RequestTypeResponse.String(), s.HandleInput).
-		Handle(RequestTypeRelease.String(), s.HandleAbort)
+		Handle("start", s.HandleStart).
+		Handle("continue", s.HandleContinue).
+		Handle("abort", s.HandleAbort)
 }
 
-func (s Service) HandleStart(ctx context.Context) error {
+func (s Service) HandleStart(ctx context.Context, req StartRequest) error {
 	//session ID on this provider will only be specified if consumer is continuing
 	//on an existing session
-	// sid := m.Header.Provider.Sid //"ussd:" + m.Request.Msisdn
-	// ...sid.... ussd start open must expect "" while continue/abort expects an id
-	// or ussd still create/get session because other services does not need sesison...
-	// so ignore sid in consumer and provider? I think so...
-
-	switch m.Request.Type {
-	case "START":
-		log.Debugf("Starting")
-		if err = ussd.Start(ctx, id, ussdData, pcm.Item() /*initItem*/, m.Request.Message, responder{ch: s.ch}, m.Header.ReplyAddress); err != nil {
-			err = errors.Wrapf(err, "failed to start USSD")
-			return
+	initItem := s.initItem
+	if req.ItemID != "" {
+		item, ok := ctxRegistry(ctx).Get(req.ItemID)
+		if !ok {
+			return errors.Errorf("unknown item_id(%s)", req.ItemID)
 		}
-
-	case "CONTINUE":
-		if err = ussd.UserInput(ctx, id, ussdData, m.Request.Text, responder{ch: s.ch}, m.Header.ReplyAddress); err != nil {
-			err = errors.Wrapf(err, "failed to continue USSD")
-			return
-		}
-
-	case "ABORT":
-		if err = ussd.UserAbort(ctx, id); err != nil {
-			err = errors.Wrapf(err, "failed to abort USSD")
-			return
+		if initItem, ok = item.(ItemSvcExec); !ok {
+			return errors.Errorf("item_id(%s) of type %T cannot start a session", req.ItemID, item)
 		}
-
-	default:
-		err = errors.Errorf("invalid request (unknown type): %+v", m.Request)
-		return
 	}
-
+	responder, err := getResponder(req.ResponderID)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Starting")
+	if err := Start(ctx, req.ID, req.Data, initItem, req.Input, responder, req.ResponderKey); err != nil {
+		return errors.Wrapf(err, "failed to start USSD")
+	}
 	//handling started successfully
 	//responder will take care of response
-	log.Debugf("processing done")
-	return
+	return nil
+}
+
+func (s Service) HandleContinue(ctx context.Context, req ContinueRequest) error {
+	responder, err := getResponder(req.ResponderID)
+	if err != nil {
+		return err
+	}
+	if err := UserInput(ctx, req.ID, req.Data, req.Input, responder, req.ResponderKey); err != nil {
+		return errors.Wrapf(err, "failed to continue USSD")
+	}
+	return nil
+}
 
+func (s Service) HandleAbort(ctx context.Context, req AbortRequest) error {
+	if err := UserAbort(ctx, req.ID); err != nil {
+		return errors.Wrapf(err, "failed to abort USSD")
+	}
+	return nil
 }
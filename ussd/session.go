@@ -16,16 +16,38 @@ type Session interface {
 	Del(name string)
 	StartTime() time.Time
 	LastTime() time.Time
-	Sync() error //apply all local updates to central storage
+	Revision() int64 //revision in central storage when retrieved or last synced, 0 if never stored
+	Sync() error     //apply all local updates to central storage, StaleSessionError when updated by another instance
 }
 
-func NewSession(ss Sessions, id string, t0, t1 time.Time, data map[string]interface{}) Session {
+//StaleSessionError is returned by Sync() when the session was updated or deleted in central storage
+//after it was retrieved, e.g. by another instance processing a duplicate request for the same session,
+//then the local updates are not applied and the session must be retrieved again
+type StaleSessionError struct {
+	ID       string
+	Revision int64 //revision that was expected in central storage
+}
+
+func (e StaleSessionError) Error() string {
+	return fmt.Sprintf("session(%s) revision %d is stale", e.ID, e.Revision)
+}
+
+//IsStaleSession() is true when err is a StaleSessionError
+func IsStaleSession(err error) bool {
+	_, ok := err.(StaleSessionError)
+	return ok
+}
+
+//NewSession() is called by Sessions implementations to return a session
+//	revision is the revision in central storage, 0 for a new session that was not yet stored
+func NewSession(ss Sessions, id string, revision int64, t0, t1 time.Time, data map[string]interface{}) Session {
 	if ss == nil || id == "" {
 		panic(fmt.Sprintf("invalid parameters for NewSession(%p,%s,%p)", ss, id, data))
 	}
 	s := &session{
 		sessions:   ss,
 		id:         id,
+		revision:   revision,
 		startTime:  t0,
 		lastTime:   t1,
 		data:       data,
@@ -35,7 +57,8 @@ func NewSession(ss Sessions, id string, t0, t1 time.Time, data map[string]interf
 	if s.data == nil {
 		s.data = map[string]interface{}{}
 	}
-	if s.namesToSet == nil {
+	if s.namesToSet == nil || revision != 0 {
+		//only the data of a new session must be stored when synced
 		s.namesToSet = map[string]interface{}{}
 	}
 	log.Debugf("Created Local Session(%s): %+v", s.id, s.data)
@@ -45,6 +68,7 @@ func NewSession(ss Sessions, id string, t0, t1 time.Time, data map[string]interf
 type session struct {
 	sessions   Sessions
 	id         string
+	revision   int64
 	startTime  time.Time
 	lastTime   time.Time
 	data       map[string]interface{}
@@ -60,6 +84,8 @@ func (s session) StartTime() time.Time { return s.startTime }
 
 func (s session) LastTime() time.Time { return s.lastTime }
 
+func (s session) Revision() int64 { return s.revision }
+
 func (s session) Get(name string) interface{} {
 	if v, ok := s.data[name]; ok {
 		return v
@@ -83,8 +109,15 @@ func (s *session) Del(name string) {
 	s.namesToDel[name] = true
 }
 
+//Sync() applies the updates only if the session was not updated in central storage since
+//it was retrieved or last synced (compare-and-set on the revision), else it returns StaleSessionError
+//the updates are kept when sync failed
 func (s *session) Sync() error {
-	s.sessions.Sync(s.id, s.namesToSet, s.namesToDel)
+	revision, err := s.sessions.Sync(s.id, s.revision, s.namesToSet, s.namesToDel)
+	if err != nil {
+		return err
+	}
+	s.revision = revision
 	s.namesToSet = map[string]interface{}{}
 	s.namesToDel = map[string]bool{}
 	return nil
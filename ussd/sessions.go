@@ -1,7 +1,9 @@
 package ussd
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,7 +11,66 @@ type Sessions interface {
 	New(id string, initData map[string]interface{}) (Session, error)
 	Get(id string) (Session, error)
 	Del(id string) error
-	Sync(id string, set map[string]interface{}, del map[string]bool) error
+	//Sync() applies the updates if the stored revision is still revision and returns the new revision,
+	//else it returns StaleSessionError without applying the updates
+	//revision 0 is for a new session and replaces any stored session with the same id
+	//the new revision must never have been used before for the id, also not by a session that was
+	//replaced or deleted, so that an instance still holding the old session cannot overwrite the new one
+	Sync(id string, revision int64, set map[string]interface{}, del map[string]bool) (int64, error)
+	Expire(ttl SessionTTL, onExpired SessionExpiredFunc) //see SetSessionExpiry()
+}
+
+//SessionTTL defines when a session expires, e.g. when the user dropped mid-menu
+//or the gateway never sent RELEASE, so that it does not stay in the store forever
+type SessionTTL struct {
+	Idle time.Duration //since the session was last synced, 0 for no limit
+	Max  time.Duration //since the session started, 0 for no limit
+}
+
+//DefaultSessionTTL is used until SetSessionExpiry() is called
+//USSD gateways typically end a session after 3 minutes without user input
+var DefaultSessionTTL = SessionTTL{Idle: 3 * time.Minute, Max: 10 * time.Minute}
+
+//Expired() is true when a session with the start/last time has expired at time now
+func (ttl SessionTTL) Expired(startTime, lastTime, now time.Time) bool {
+	return (ttl.Idle > 0 && now.Sub(lastTime) > ttl.Idle) ||
+		(ttl.Max > 0 && now.Sub(startTime) > ttl.Max)
+}
+
+//ReapInterval() is how often a store should look for expired sessions, 0 when sessions do not expire
+func (ttl SessionTTL) ReapInterval() time.Duration {
+	shortest := ttl.Idle
+	if shortest == 0 || (ttl.Max > 0 && ttl.Max < shortest) {
+		shortest = ttl.Max
+	}
+	if shortest == 0 {
+		return 0
+	}
+	interval := shortest / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+//SessionExpiredFunc is called after an expired session was deleted,
+//e.g. to write a CDR or release resources reserved for the session
+//	data is the last synced session data
+type SessionExpiredFunc func(id string, startTime, lastTime time.Time, data map[string]interface{})
+
+//SetSessionExpiry() changes when sessions expire (default: DefaultSessionTTL)
+//and the optional function to call for each expired session
+//this applies to the current session manager and to the one set later with SetSessions()
+func SetSessionExpiry(ttl SessionTTL, onExpired SessionExpiredFunc) {
+	if ttl.Idle < 0 || ttl.Max < 0 {
+		panic(fmt.Sprintf("SetSessionExpiry(%+v) negative ttl", ttl))
+	}
+	sessionTTL = ttl
+	onSessionExpired = onExpired
+	sessions.Expire(ttl, onExpired)
 }
 
 //SetSessions() changes the session manager
@@ -18,50 +79,82 @@ func SetSessions(ss Sessions) {
 	if ss == nil {
 		panic("SetSessions(nil)")
 	}
-	if sessionsStarted {
+	if atomic.LoadInt32(&sessionsStarted) != 0 {
 		panic("SetSessions() called after first session was used")
 	}
 	sessions = ss
+	sessions.Expire(sessionTTL, onSessionExpired)
 }
 
 var (
 	//by default sessions are stored in memory
 	//change to another session manager with SetSession()
 	//  (before using any sessions!)
-	sessionsStarted bool     = false
+	sessionsStarted int32    = 0 //set atomically, because sessions are used concurrently
 	sessions        Sessions = &inMemorySessions{
 		sessionByID: map[string]inMemSession{},
+		ttl:         DefaultSessionTTL,
 	}
+	sessionTTL       = DefaultSessionTTL
+	onSessionExpired SessionExpiredFunc
 )
 
+//inMemorySessions are deleted by a background reaper when expired,
+//which is started when the first session is synced
 type inMemorySessions struct {
 	sync.Mutex
 	sessionByID map[string]inMemSession
+	ttl         SessionTTL
+	onExpired   SessionExpiredFunc
+	reaping     bool
+	revision    int64 //last revision of any session, so a replaced session never gets an old revision
 }
 
 type inMemSession struct {
+	revision  int64
 	startTime time.Time
 	lastTime  time.Time
 	data      map[string]interface{}
 }
 
+//copyData() returns a copy, so local updates in a session do not change the stored data before Sync()
+func copyData(data map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(data))
+	for name, value := range data {
+		c[name] = value
+	}
+	return c
+}
+
 func (ss *inMemorySessions) New(id string, initData map[string]interface{}) (Session, error) {
-	sessionsStarted = true
+	atomic.StoreInt32(&sessionsStarted, 1)
 	//create new session in memory only
 	//it does not exist centrally until it is synced
 	//it may even clash with another when synced
 	//unless the caller first checked/deleted existing session
 	//because: we do not want to delete session creation with external calls if not required
 	t0 := time.Now()
-	return NewSession(ss, id, t0, t0, initData), nil
+	return NewSession(ss, id, 0, t0, t0, initData), nil
 }
 
 func (ss *inMemorySessions) Get(id string) (Session, error) {
-	sessionsStarted = true
+	atomic.StoreInt32(&sessionsStarted, 1)
 	ss.Lock()
-	defer ss.Unlock()
-	if ims, ok := ss.sessionByID[id]; ok {
-		s := NewSession(ss, id, ims.startTime, ims.lastTime, ims.data)
+	ims, ok := ss.sessionByID[id]
+	if ok && ss.ttl.Expired(ims.startTime, ims.lastTime, time.Now()) {
+		//do not wait for the reaper, the session must not continue
+		delete(ss.sessionByID, id)
+		onExpired := ss.onExpired
+		ss.Unlock()
+		log.Debugf("ims(%s) expired", id)
+		if onExpired != nil {
+			onExpired(id, ims.startTime, ims.lastTime, ims.data)
+		}
+		return nil, nil
+	}
+	ss.Unlock()
+	if ok {
+		s := NewSession(ss, id, ims.revision, ims.startTime, ims.lastTime, copyData(ims.data))
 		log.Debugf("retrieved ims(%s): %+v", id, ims.data)
 		return s, nil
 	}
@@ -69,24 +162,29 @@ func (ss *inMemorySessions) Get(id string) (Session, error) {
 }
 
 func (ss *inMemorySessions) Del(id string) error {
-	sessionsStarted = true
+	atomic.StoreInt32(&sessionsStarted, 1)
 	ss.Lock()
 	defer ss.Unlock()
 	delete(ss.sessionByID, id)
 	return nil
 }
 
-func (ss *inMemorySessions) Sync(id string, set map[string]interface{}, del map[string]bool) error {
-	sessionsStarted = true
+func (ss *inMemorySessions) Sync(id string, revision int64, set map[string]interface{}, del map[string]bool) (int64, error) {
+	atomic.StoreInt32(&sessionsStarted, 1)
 	ss.Lock()
 	defer ss.Unlock()
 	t := time.Now()
 	ims, ok := ss.sessionByID[id]
-	if !ok {
+	if revision == 0 {
+		//new session replaces a stored session with the same id
 		ims = inMemSession{
 			startTime: t,
 			data:      map[string]interface{}{},
 		}
+	} else if !ok || ims.revision != revision {
+		return 0, StaleSessionError{ID: id, Revision: revision}
+	} else {
+		ims.data = copyData(ims.data)
 	}
 	for name := range del {
 		delete(ims.data, name)
@@ -96,8 +194,63 @@ func (ss *inMemorySessions) Sync(id string, set map[string]interface{}, del map[
 		ims.data[name] = value
 		log.Debugf("  ims[%s]=%v", name, value)
 	}
+	ss.revision++
+	ims.revision = ss.revision
 	ims.lastTime = t
 	ss.sessionByID[id] = ims
-	log.Debugf("synced ims(%s): %+v", id, ims.data)
-	return nil
+	log.Debugf("synced ims(%s) revision %d: %+v", id, ims.revision, ims.data)
+	ss.startReaper()
+	return ims.revision, nil
+}
+
+func (ss *inMemorySessions) Expire(ttl SessionTTL, onExpired SessionExpiredFunc) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.ttl = ttl
+	ss.onExpired = onExpired
+	if len(ss.sessionByID) > 0 {
+		ss.startReaper()
+	}
 }
+
+//startReaper() must be called while locked
+func (ss *inMemorySessions) startReaper() {
+	if ss.reaping || ss.ttl.ReapInterval() == 0 {
+		return
+	}
+	ss.reaping = true
+	go func() {
+		for {
+			ss.Lock()
+			interval := ss.ttl.ReapInterval()
+			if interval == 0 {
+				ss.reaping = false //expiry disabled, started again when enabled
+				ss.Unlock()
+				return
+			}
+			ss.Unlock()
+			time.Sleep(interval)
+			ss.reap(time.Now())
+		}
+	}()
+} //inMemorySessions.startReaper()
+
+//reap() deletes sessions that expired at time now, then notifies
+func (ss *inMemorySessions) reap(now time.Time) {
+	ss.Lock()
+	expired := map[string]inMemSession{}
+	for id, ims := range ss.sessionByID {
+		if ss.ttl.Expired(ims.startTime, ims.lastTime, now) {
+			expired[id] = ims
+			delete(ss.sessionByID, id)
+		}
+	}
+	onExpired := ss.onExpired
+	ss.Unlock()
+	for id, ims := range expired {
+		log.Debugf("ims(%s) expired", id)
+		if onExpired != nil {
+			onExpired(id, ims.startTime, ims.lastTime, ims.data)
+		}
+	}
+} //inMemorySessions.reap()
@@ -0,0 +1,80 @@
+package ussd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInMemorySessionsExpiry(t *testing.T) {
+	expired := []string{}
+	ss := &inMemorySessions{
+		sessionByID: map[string]inMemSession{},
+		ttl:         SessionTTL{Idle: time.Minute},
+		onExpired: func(id string, startTime, lastTime time.Time, data map[string]interface{}) {
+			expired = append(expired, id)
+		},
+		reaping: true, //no background reaper in the test
+	}
+	for _, id := range []string{"fresh", "idle", "reaped"} {
+		if _, err := ss.Sync(id, 0, map[string]interface{}{"a": 1}, nil); err != nil {
+			t.Fatalf("sync(%s): %+v", id, err)
+		}
+	}
+	ss.Lock()
+	for _, id := range []string{"idle", "reaped"} {
+		ims := ss.sessionByID[id]
+		ims.lastTime = ims.lastTime.Add(-2 * time.Minute)
+		ss.sessionByID[id] = ims
+	}
+	ss.Unlock()
+
+	//get does not return an expired session before the reaper deleted it
+	if s, err := ss.Get("fresh"); err != nil || s == nil || s.Get("a") != 1 {
+		t.Fatalf("get(fresh) -> %v, %+v", s, err)
+	}
+	if s, err := ss.Get("idle"); err != nil || s != nil {
+		t.Fatalf("get(idle) -> %v, %+v", s, err)
+	}
+	if len(expired) != 1 || expired[0] != "idle" {
+		t.Fatalf("expired %+v", expired)
+	}
+	if _, err := ss.Sync("idle", 1, map[string]interface{}{"a": 2}, nil); err == nil {
+		t.Fatalf("synced expired session")
+	}
+
+	ss.reap(time.Now())
+	if len(expired) != 2 || expired[1] != "reaped" {
+		t.Fatalf("expired %+v", expired)
+	}
+	if len(ss.sessionByID) != 1 {
+		t.Fatalf("remaining %+v", ss.sessionByID)
+	}
+}
+
+func TestInMemorySessionsReplaced(t *testing.T) {
+	ss := &inMemorySessions{sessionByID: map[string]inMemSession{}, reaping: true}
+	//an instance still holds the old session, e.g. while waiting for a service response
+	old, err := ss.Sync("s1", 0, map[string]interface{}{"a": 1}, nil)
+	if err != nil {
+		t.Fatalf("sync: %+v", err)
+	}
+	//the user dialled again, which deleted and replaced the session
+	ss.Del("s1")
+	if _, err := ss.Sync("s1", 0, map[string]interface{}{"a": 2}, nil); err != nil {
+		t.Fatalf("sync new: %+v", err)
+	}
+	if _, err := ss.Sync("s1", old, map[string]interface{}{"a": 3}, nil); !IsStaleSession(err) {
+		t.Fatalf("old revision %d -> %+v", old, err)
+	}
+	//replaced without deleting first
+	s, _ := ss.Get("s1")
+	if _, err := ss.Sync("s1", 0, map[string]interface{}{"a": 4}, nil); err != nil {
+		t.Fatalf("sync replace: %+v", err)
+	}
+	if _, err := ss.Sync("s1", s.Revision(), map[string]interface{}{"a": 5}, nil); !IsStaleSession(err) {
+		t.Fatalf("replaced revision %d -> %+v", s.Revision(), err)
+	}
+	if s, _ := ss.Get("s1"); s.Get("a") != 4 {
+		t.Fatalf("stale update applied: %+v", s)
+	}
+}
@@ -0,0 +1,44 @@
+package ussd
+
+import "strings"
+
+//shortcut dialling lets the user enter menu selections and prompt values in the USSD code,
+//e.g. "*140*2*1#" is routed as "*140#" and then "2" and "1" are processed by the first
+//two prompts or menus without displaying them, see Router.WithShortcuts()
+
+//splitShortcut() returns the base codes with the inputs that follow them,
+//longest base first, e.g. "*140*2*1#" -> ("*140*2#",["1"]), ("*140#",["2","1"])
+func splitShortcut(code string) (bases []string, inputs [][]string) {
+	if !strings.HasPrefix(code, "*") || !strings.HasSuffix(code, "#") {
+		return nil, nil
+	}
+	parts := strings.Split(code[1:len(code)-1], "*")
+	for n := len(parts) - 1; n >= 1; n-- {
+		bases = append(bases, "*"+strings.Join(parts[:n], "*")+"#")
+		inputs = append(inputs, parts[n:])
+	}
+	return bases, inputs
+}
+
+//nextShortcutInput() removes the next input from the session
+func nextShortcutInput(s Session) (string, bool) {
+	var inputs []string
+	switch values := s.Get("shortcut_inputs").(type) {
+	case []string:
+		inputs = values
+	case []interface{}:
+		for _, value := range values {
+			input, _ := value.(string)
+			inputs = append(inputs, input)
+		}
+	}
+	if len(inputs) == 0 {
+		return "", false
+	}
+	if len(inputs) == 1 {
+		s.Del("shortcut_inputs")
+	} else {
+		s.Set("shortcut_inputs", inputs[1:])
+	}
+	return inputs[0], true
+}
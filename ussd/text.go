@@ -0,0 +1,464 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/vservices/utils/v4/errors"
+)
+
+//RenderText() translates a text that is shown to the user, see Catalog,
+//then substitutes session values into it
+//all ItemUsr items render their text with this, custom items should do the same
+//	<name>                   value of session variable name, "" when not defined
+//	<name|fnc arg ...|...>   value passed through one or more text functions (only default
+//	                         is applied to undefined values), e.g.
+//	                         <name|default friend>
+//	                         <balance|number 2>
+//	                         <balance|currency R 2>
+//	                         <expiry|date 2006-01-02>
+//	                         <bnumber|msisdn national>
+//	<if name>...<else>...<end>          when the value is set and not false/0/""
+//	<if not name>...<end>
+//	<if name == value>...<end>          also !=
+//anything else between <...> is not substituted, e.g. "<3"
+func RenderText(ctx context.Context, text string) string {
+	return renderText(ctx, text, nil)
+}
+
+//renderText() renders with values that are used before session values, e.g. from an InputError
+func renderText(ctx context.Context, text string, values map[string]interface{}) string {
+	return renderParsedText(ctx, text, values, parseText)
+}
+
+//renderUncachedText() renders a text that is not defined in items or a catalog,
+//e.g. an error message that may include ids or values, which must not fill the cache
+func renderUncachedText(ctx context.Context, text string) string {
+	return renderParsedText(ctx, text, nil, parseUncachedText)
+}
+
+func renderParsedText(ctx context.Context, text string, values map[string]interface{}, parse func(string) (*textTemplate, error)) string {
+	text = Translate(ctx, text)
+	t, err := parse(text)
+	if err != nil {
+		log.Errorf("cannot render text(%s): %+v", text, err)
+		return text
+	}
+	s, _ := ctx.Value(CtxSession{}).(Session)
+	if len(values) > 0 {
+		s = valuesSession{Session: s, values: values}
+	}
+	return t.render(s)
+}
+
+//valuesSession is only used to render text
+type valuesSession struct {
+	Session
+	values map[string]interface{}
+}
+
+func (vs valuesSession) Get(name string) interface{} {
+	if value, ok := vs.values[name]; ok {
+		return value
+	}
+	if vs.Session == nil {
+		return nil
+	}
+	return vs.Session.Get(name)
+}
+
+//TextFunc formats a value in a text, args are the words after the function name
+type TextFunc func(value interface{}, args []string) (interface{}, error)
+
+var (
+	textFuncMutex  sync.Mutex
+	textFuncByName = map[string]TextFunc{
+		"default":  textDefault,
+		"number":   textNumber,
+		"currency": textCurrency,
+		"date":     textDate,
+		"msisdn":   textMsisdn,
+		"upper":    func(v interface{}, args []string) (interface{}, error) { return strings.ToUpper(textString(v)), nil },
+		"lower":    func(v interface{}, args []string) (interface{}, error) { return strings.ToLower(textString(v)), nil },
+	}
+)
+
+//AddTextFunc() defines a custom text function, e.g. to format values for a service
+func AddTextFunc(name string, fnc TextFunc) {
+	textFuncMutex.Lock()
+	defer textFuncMutex.Unlock()
+	if _, ok := textFuncByName[name]; ok {
+		panic(fmt.Sprintf("text function(%s) already defined", name))
+	}
+	textFuncByName[name] = fnc
+}
+
+func getTextFunc(name string) (TextFunc, bool) {
+	textFuncMutex.Lock()
+	defer textFuncMutex.Unlock()
+	fnc, ok := textFuncByName[name]
+	return fnc, ok
+}
+
+type textTemplate struct {
+	parts []textPart
+}
+
+//textPart is either literal text, a value or a conditional
+type textPart struct {
+	literal string
+	value   *textValue
+	cond    *textCond
+}
+
+type textValue struct {
+	name  string
+	funcs []textFuncCall
+}
+
+type textFuncCall struct {
+	name string
+	fnc  TextFunc
+	args []string
+}
+
+type textCond struct {
+	name     string
+	not      bool
+	op       string //"", "==" or "!="
+	operand  string
+	thenPart *textTemplate
+	elsePart *textTemplate
+}
+
+const textNamePattern = `[a-zA-Z_][a-zA-Z0-9_.()]*`
+
+var (
+	textTagRegex   = regexp.MustCompile(`<([^<>]+)>`)
+	textValueRegex = regexp.MustCompile(`^(` + textNamePattern + `)\s*(\|.*)?$`)
+	textCondRegex  = regexp.MustCompile(`^if\s+(not\s+)?(` + textNamePattern + `)\s*(?:(==|!=)\s*(.*))?$`)
+
+	//parsed texts are cached, because texts are rendered for every response
+	//the cache is cleared when full, in case texts are not only from items and catalogs
+	parsedTextMutex sync.Mutex
+	parsedText      = map[string]*textTemplate{}
+	maxParsedTexts  = 10000
+)
+
+func parseText(text string) (*textTemplate, error) {
+	parsedTextMutex.Lock()
+	defer parsedTextMutex.Unlock()
+	if t, ok := parsedText[text]; ok {
+		return t, nil
+	}
+	t, err := parseUncachedText(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsedText) >= maxParsedTexts {
+		log.Debugf("cleared cache of %d parsed texts", len(parsedText))
+		parsedText = map[string]*textTemplate{}
+	}
+	parsedText[text] = t
+	return t, nil
+}
+
+func parseUncachedText(text string) (*textTemplate, error) {
+	t, rest, end, err := parseTextParts(text)
+	if err != nil {
+		return nil, err
+	}
+	if end != "" || rest != "" {
+		return nil, errors.Errorf("unexpected <%s> without <if ...>", end)
+	}
+	return t, nil
+}
+
+//parseTextParts() parses until the end of the text or an <else> or <end>
+//which is returned in end with the rest of the text following it
+func parseTextParts(text string) (t *textTemplate, rest string, end string, err error) {
+	t = &textTemplate{}
+	for len(text) > 0 {
+		loc := textTagRegex.FindStringSubmatchIndex(text)
+		if loc == nil {
+			t.parts = append(t.parts, textPart{literal: text})
+			break
+		}
+		tag := strings.TrimSpace(text[loc[2]:loc[3]])
+		raw := text[loc[0]:loc[1]]
+		if loc[0] > 0 {
+			t.parts = append(t.parts, textPart{literal: text[:loc[0]]})
+		}
+		text = text[loc[1]:]
+
+		if tag == "else" || tag == "end" {
+			return t, text, tag, nil
+		}
+		if m := textCondRegex.FindStringSubmatch(tag); m != nil {
+			cond := &textCond{
+				name:    m[2],
+				not:     m[1] != "",
+				op:      m[3],
+				operand: strings.Trim(strings.TrimSpace(m[4]), "\""),
+			}
+			var end string
+			cond.thenPart, text, end, err = parseTextParts(text)
+			if err != nil {
+				return nil, "", "", err
+			}
+			if end == "else" {
+				cond.elsePart, text, end, err = parseTextParts(text)
+				if err != nil {
+					return nil, "", "", err
+				}
+			}
+			if end != "end" {
+				return nil, "", "", errors.Errorf("<%s> without <end>", tag)
+			}
+			t.parts = append(t.parts, textPart{cond: cond})
+			continue
+		}
+		if m := textValueRegex.FindStringSubmatch(tag); m != nil {
+			value := &textValue{name: m[1]}
+			if m[2] != "" {
+				for _, call := range strings.Split(m[2][1:], "|") {
+					words := strings.Fields(call)
+					if len(words) == 0 {
+						return nil, "", "", errors.Errorf("<%s> has empty function", tag)
+					}
+					fnc, ok := getTextFunc(words[0])
+					if !ok {
+						return nil, "", "", errors.Errorf("<%s> has unknown function(%s)", tag, words[0])
+					}
+					value.funcs = append(value.funcs, textFuncCall{name: words[0], fnc: fnc, args: words[1:]})
+				}
+			}
+			t.parts = append(t.parts, textPart{value: value})
+			continue
+		}
+		//not a tag, e.g. "<3"
+		t.parts = append(t.parts, textPart{literal: raw})
+	}
+	return t, "", "", nil
+} //parseTextParts()
+
+func (t textTemplate) render(s Session) string {
+	b := strings.Builder{}
+	for _, part := range t.parts {
+		switch {
+		case part.value != nil:
+			b.WriteString(part.value.render(s))
+		case part.cond != nil:
+			if part.cond.eval(s) {
+				b.WriteString(part.cond.thenPart.render(s))
+			} else if part.cond.elsePart != nil {
+				b.WriteString(part.cond.elsePart.render(s))
+			}
+		default:
+			b.WriteString(part.literal)
+		}
+	}
+	return b.String()
+}
+
+//names() returns the session variable names used in the text
+func (t textTemplate) names() []string {
+	names := []string{}
+	for _, part := range t.parts {
+		switch {
+		case part.value != nil:
+			names = append(names, part.value.name)
+		case part.cond != nil:
+			names = append(names, part.cond.name)
+			names = append(names, part.cond.thenPart.names()...)
+			if part.cond.elsePart != nil {
+				names = append(names, part.cond.elsePart.names()...)
+			}
+		}
+	}
+	return names
+}
+
+func (v textValue) render(s Session) string {
+	var value interface{}
+	if s != nil {
+		value = s.Get(v.name)
+	}
+	for _, call := range v.funcs {
+		if value == nil && call.name != "default" {
+			continue //do not format undefined values
+		}
+		var err error
+		if value, err = call.fnc(value, call.args); err != nil {
+			log.Errorf("text <%s|%s> failed: %+v", v.name, call.name, err)
+			return ""
+		}
+	}
+	return textString(value)
+}
+
+func (c textCond) eval(s Session) bool {
+	var value interface{}
+	if s != nil {
+		value = s.Get(c.name)
+	}
+	var result bool
+	switch c.op {
+	case "==":
+		result = textString(value) == c.operand
+	case "!=":
+		result = textString(value) != c.operand
+	default:
+		result = textTrue(value)
+	}
+	if c.not {
+		return !result
+	}
+	return result
+}
+
+func textString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func textTrue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "0" && strings.ToLower(v) != "false"
+	}
+	if f, err := textFloat(value); err == nil {
+		return f != 0
+	}
+	return true
+}
+
+func textFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	}
+	return strconv.ParseFloat(strings.TrimSpace(textString(value)), 64)
+}
+
+func textDefault(value interface{}, args []string) (interface{}, error) {
+	if textString(value) == "" {
+		return strings.Join(args, " "), nil
+	}
+	return value, nil
+}
+
+//<value|number [decimals] [thousands separator]>
+func textNumber(value interface{}, args []string) (interface{}, error) {
+	f, err := textFloat(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "not a number")
+	}
+	decimals := 0
+	if len(args) > 0 {
+		if decimals, err = strconv.Atoi(args[0]); err != nil || decimals < 0 {
+			return nil, errors.Errorf("invalid decimals(%s)", args[0])
+		}
+	}
+	s := strconv.FormatFloat(f, 'f', decimals, 64)
+	if len(args) > 1 {
+		s = groupThousands(s, args[1])
+	}
+	return s, nil
+}
+
+//<value|currency symbol [decimals]> e.g. "R12.50", default 2 decimals with space separated thousands
+func textCurrency(value interface{}, args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, errors.Errorf("missing currency symbol")
+	}
+	decimals := "2"
+	if len(args) > 1 {
+		decimals = args[1]
+	}
+	s, err := textNumber(value, []string{decimals})
+	if err != nil {
+		return nil, err
+	}
+	return args[0] + groupThousands(s.(string), " "), nil
+}
+
+func groupThousands(s string, sep string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	frac := ""
+	if i := strings.Index(s, "."); i >= 0 {
+		s, frac = s[:i], s[i:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + sep + s[i:]
+	}
+	return sign + s + frac
+}
+
+//<value|date [layout]> with go time layout, default "2006-01-02"
+//value can be time.Time, RFC3339 string or unix seconds
+func textDate(value interface{}, args []string) (interface{}, error) {
+	layout := "2006-01-02"
+	if len(args) > 0 {
+		layout = strings.Join(args, " ")
+	}
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errors.Wrapf(err, "not a date")
+		}
+	default:
+		f, err := textFloat(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "not a date")
+		}
+		t = time.Unix(int64(f), 0)
+	}
+	return t.Format(layout), nil
+}
+
+//<value|msisdn [international|national|plus]> using the current MsisdnRules
+func textMsisdn(value interface{}, args []string) (interface{}, error) {
+	format := "international"
+	if len(args) > 0 {
+		format = args[0]
+	}
+	rules := GetMsisdnRules()
+	msisdn, err := rules.International(textString(value))
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "international":
+		return msisdn, nil
+	case "plus":
+		return "+" + msisdn, nil
+	case "national":
+		return rules.National(msisdn)
+	}
+	return nil, errors.Errorf("unknown msisdn format(%s) expecting international|national|plus", format)
+}
@@ -0,0 +1,36 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestParsedTextCache(t *testing.T) {
+	defer func(n int) { maxParsedTexts = n }(maxParsedTexts)
+	maxParsedTexts = 3
+	cached := func(text string) (int, bool) {
+		parsedTextMutex.Lock()
+		defer parsedTextMutex.Unlock()
+		_, ok := parsedText[text]
+		return len(parsedText), ok
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := parseText(fmt.Sprintf("text %d <name>", i)); err != nil {
+			t.Fatalf("failed to parse: %+v", err)
+		}
+		if n, ok := cached(fmt.Sprintf("text %d <name>", i)); !ok || n > maxParsedTexts {
+			t.Fatalf("text %d cached=%v in %d texts", i, ok, n)
+		}
+	}
+
+	//error messages are not cached
+	ctx := context.Background()
+	if text := inputErrorText(ctx, fmt.Errorf("item(x) failed <1>")); text != "item(x) failed <1>\n" {
+		t.Fatalf("got %q", text)
+	}
+	if _, ok := cached("item(x) failed <1>"); ok {
+		t.Fatalf("error message cached")
+	}
+}
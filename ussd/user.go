@@ -3,18 +3,22 @@ package ussd
 import (
 	"context"
 	"fmt"
+	"reflect"
 
 	"bitbucket.org/vservices/utils/v4/errors"
 	"github.com/google/uuid"
 )
 
 //Start() is called when user initiates a new session
+//	ctx may specify the registry with the items of the session, see WithRegistry(),
+//	then UserInput() and ServiceResponse() must be called with the same registry
 //	id must be unique session id, e.g. made up of "<source>:<msisdn>" when from GSM MAP USSD,
 //		which will prevent multiple sessions to exist for the same subscriber
 //		it could be new uuid for each request, but then you must ensure old sessions are cleaned up
 //	data is optional and added to new session
 //	initItem is first item to exec and it must define next, i.e. must be ItemSvcExec()
-//	initRequest would be the ussd code that was dialed and will be stored in session.Set("init_request",initRequest)
+//	initRequest would be the ussd code that was dialed and will be stored in session.Set("original_request",initRequest)
+//		and after translation (see SetCodeTable()) in session.Set("init_request",...) which is used for routing
 //	responder is used to respond to the user once (redefined each time user provides input)
 func Start(ctx context.Context, id string, data map[string]interface{}, initItem ItemSvcExec, initRequest string, responder Responder, responderKey string) error {
 	if id == "" {
@@ -30,7 +34,8 @@ func Start(ctx context.Context, id string, data map[string]interface{}, initItem
 	if err != nil {
 		return errors.Wrapf(err, "failed to create session(%s)", id)
 	}
-	s.Set("init_request", initRequest)
+	s.Set("original_request", initRequest)
+	s.Set("init_request", translateCode(initRequest))
 	ctx = context.WithValue(ctx, CtxSession{}, s)
 
 	nextItems, err := initItem.Exec(ctx)
@@ -45,7 +50,7 @@ func Start(ctx context.Context, id string, data map[string]interface{}, initItem
 //UserInput() continues a waiting session with input entered by the user
 //	id must be same as was used for UserStart()
 //	data is optional and will be set in existing session
-//	input is from user
+//	input is from user and normalised before it is processed, see SetInputNormalisers()
 //	responder is used to respond to the user (it could be different from previous responder)
 func UserInput(ctx context.Context, id string, data map[string]interface{}, input string, responder Responder, responderKey string) error {
 	if responder == nil {
@@ -62,23 +67,38 @@ func UserInput(ctx context.Context, id string, data map[string]interface{}, inpu
 		s.Set(n, v)
 	}
 	ctx = context.WithValue(ctx, CtxSession{}, s)
-	currentItemID, _ := s.Get("current_item_id").(string)
-	currentItem, ok := itemByID[currentItemID]
-	if !ok {
-		return errors.Errorf("session(%s).currentItemID(%s) not defined", s.ID(), currentItemID)
+	currentItem, err := loadCurrentItem(ctx, s)
+	if err != nil {
+		return errors.Wrapf(err, "cannot continue session(%s)", s.ID())
 	}
 	itemUsrPrompt, ok := currentItem.(ItemUsrPrompt)
 	if !ok {
-		return errors.Errorf("session(%s).currentItemID(%s) type %T does not handle user input", s.ID(), currentItemID, currentItem)
+		return errors.Errorf("session(%s).currentItemID(%s) type %T does not handle user input", s.ID(), currentItem.ID(), currentItem)
+	}
+	input = normaliseInput(currentItem, input)
+
+	//navigation keys are handled before the item processes the input
+	navItem, ok, err := navigate(ctx, s, input)
+	if err != nil {
+		return errors.Wrapf(err, "session(%s) failed to navigate", s.ID())
 	}
+	if ok {
+		s.Set("responder_id", responder.ID())
+		s.Set("responder_key", responderKey)
+		return proceed(ctx, s, []Item{navItem})
+	}
+
 	nextItems, err := itemUsrPrompt.Process(ctx, input)
 	if err != nil {
 		//display error to user and repeat the prompt
-		text := err.Error()
-		if text != "" {
-			text += "\n"
+		//prompts may have updated the session, e.g. to count attempts
+		if err := s.Sync(); err != nil {
+			if IsStaleSession(err) {
+				return err //rejected, see proceed()
+			}
+			log.Errorf("failed to sync session(%s): %+v", s.ID(), err)
 		}
-		text += itemUsrPrompt.Render(ctx)
+		text := inputErrorText(ctx, err) + itemUsrPrompt.Render(ctx)
 		responder.Respond(ctx, responderKey, Response{Type: ResponseTypeResponse, Message: text})
 		return nil
 	}
@@ -89,11 +109,60 @@ func UserInput(ctx context.Context, id string, data map[string]interface{}, inpu
 	return proceed(ctx, s, nextItems)
 }
 
-//process() is called from Start() or Continue() to process the user input or service response
+//ServiceResponse() continues a session that is waiting in an ItemSvcWait
+//	id must be same as was used for Start()
+//	value is the service response and is passed to ItemSvcWait.Process()
+//	the session is loaded from central storage and the responder stored in the session
+//	is used to respond to the user, so this can be called in any instance, not only
+//	the instance that sent the request
+func ServiceResponse(ctx context.Context, id string, value interface{}) error {
+	s, err := sessions.Get(id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get session(%s)", id)
+	}
+	if s == nil {
+		return errors.Errorf("session(%s) does not exist", id)
+	}
+	ctx = context.WithValue(ctx, CtxSession{}, s)
+	currentItem, err := loadCurrentItem(ctx, s)
+	if err != nil {
+		return errors.Wrapf(err, "cannot continue session(%s)", s.ID())
+	}
+	svcWait, ok := currentItem.(ItemSvcWait)
+	if !ok {
+		return errors.Errorf("session(%s).currentItemID(%s) type %T is not waiting for a service response", s.ID(), currentItem.ID(), currentItem)
+	}
+	if err := svcWait.Process(ctx, value); err != nil {
+		//end the session, same as when proceed() fails, but also tell the user,
+		//because the request that is waiting for a response already returned
+		log.Errorf("USSD Failed: %+v", err)
+		respondFailed(ctx, s)
+		if xerr := sessions.Del(s.ID()); xerr != nil {
+			log.Errorf("failed to delete session after error: %+v", xerr)
+		}
+		return errors.Wrapf(err, "item(%s) failed to process service response", currentItem.ID())
+	}
+
+	//response accepted, proceed with the responder stored in the session
+	return proceed(ctx, s, nil)
+}
+
+//process() is called from Start(), UserInput() or ServiceResponse() to process the user input or service response
+//
+//concurrency: when the session was updated by another instance since it was retrieved,
+//e.g. for a duplicate request or a service response that arrived at the same time,
+//the session is synced before the user gets a response or a service request is sent,
+//and the request that lost the race is rejected with StaleSessionError:
+//it does not respond and it does not retry, and the session continues as the other instance left it
 func proceed(ctx context.Context, s Session, moreNextItems []Item) (err error) {
 	var currentItem Item
+	var nextItems []Item
+	synced := false
 	defer func() {
-		if err != nil {
+		if IsStaleSession(err) {
+			//rejected: the session belongs to the instance that updated it
+			log.Errorf("USSD rejected: %+v", err)
+		} else if err != nil {
 			//end the session on error
 			log.Errorf("USSD Failed: %+v", err)
 			if xerr := sessions.Del(s.ID()); xerr != nil {
@@ -105,19 +174,13 @@ func proceed(ctx context.Context, s Session, moreNextItems []Item) (err error) {
 			if xerr := sessions.Del(s.ID()); xerr != nil {
 				log.Errorf("failed to delete session after ended: %+v", xerr)
 			}
-		} else {
-			//responded to user or requested something
-			//now wait for continuation
-			s.Set("current_item_id", currentItem.ID())
-			if xerr := s.Sync(); xerr != nil {
-				log.Errorf("failed to sync session data: %+v", xerr)
-			}
-			log.Debugf("Synced session(%s)", s.ID())
+		} else if !synced {
+			log.Errorf("session(%s) not synced before waiting for item(%s)", s.ID(), currentItem.ID())
 		}
 	}()
 
 	//load next items already queued for this session
-	nextItems, err := loadNextItems(s)
+	nextItems, err = loadNextItems(ctx, s)
 	if err != nil {
 		return errors.Wrapf(err, "failed to load queued next items")
 	}
@@ -128,6 +191,11 @@ func proceed(ctx context.Context, s Session, moreNextItems []Item) (err error) {
 	for len(nextItems) > 0 {
 		currentItem = nextItems[0]
 		nextItems = nextItems[1:]
+		if replace, ok := currentItem.(replaceNextItems); ok {
+			//e.g. prompt fail items discard the items queued after the prompt
+			nextItems = append([]Item{}, replace.items...)
+			continue
+		}
 		{
 			ids := []string{}
 			for _, i := range nextItems {
@@ -144,18 +212,62 @@ func proceed(ctx context.Context, s Session, moreNextItems []Item) (err error) {
 			if responderID == "" {
 				return errors.Errorf("responder_id not defined")
 			}
-			responder := responderByID[responderID]
-			if responder == nil {
-				return errors.Errorf("responder[%s] not found", responderID)
+			responder, err := getResponder(responderID)
+			if err != nil {
+				return err
 			}
-			res := Response{
-				Message: itemUsr.Render(ctx),
+			if redirect, ok := itemUsr.(*Redirect); ok {
+				code, err := redirect.Code(ctx)
+				if err != nil {
+					return err
+				}
+				currentItem = nil //ends the session, then the HLR starts a new session with the code
+				return responder.Respond(ctx, responderKey, Response{Type: ResponseTypeRedirect, Message: code})
 			}
-			if _, ok := itemUsr.(ItemUsrPrompt); !ok {
+			res := Response{}
+			if itemUsrPrompt, ok := itemUsr.(ItemUsrPrompt); !ok {
 				currentItem = nil //final response
 				res.Type = ResponseTypeRelease
 			} else {
+				//push before render, so a menu can display the navigation options
+				navPush(s, currentItem, nextItems)
 				res.Type = ResponseTypeResponse
+
+				//input dialled in a shortcut code is processed without displaying the prompt
+				if input, ok := nextShortcutInput(s); ok {
+					input = normaliseInput(currentItem, input)
+					log.Debugf("item(%s) processing shortcut input(%s)", currentItem.ID(), input)
+					page := s.Get("menu_page")
+					moreNextItems, err := itemUsrPrompt.Process(ctx, input)
+					if err == nil && len(moreNextItems) == 1 && moreNextItems[0].ID() == currentItem.ID() && reflect.DeepEqual(s.Get("menu_page"), page) {
+						//repeated without an error, e.g. an invalid menu option
+						err = InputError{Text: InvalidShortcutText}
+					}
+					if err == nil {
+						if len(moreNextItems) > 0 {
+							nextItems = append(moreNextItems, nextItems...)
+						}
+						continue
+					}
+					//invalid input: display the prompt with the error and let the user continue
+					s.Del("shortcut_inputs")
+					res.Message = inputErrorText(ctx, err)
+				}
+			}
+			res.Message += itemUsr.Render(ctx)
+			if currentItem != nil {
+				//wait for user input: sync before responding, so the user does not
+				//continue from a response that was not stored
+				s.Set("current_item_id", currentItem.ID())
+				saveNextItems(ctx, s, nextItems)
+				if err := s.Sync(); err != nil {
+					if IsStaleSession(err) {
+						return err
+					}
+					return errors.Wrapf(err, "failed to sync session before item(%s) response", currentItem.ID())
+				}
+				synced = true
+				log.Debugf("Synced session(%s)", s.ID())
 			}
 			return responder.Respond(ctx, responderKey, res)
 		} //if user interaction
@@ -175,6 +287,17 @@ func proceed(ctx context.Context, s Session, moreNextItems []Item) (err error) {
 
 		if svcWait, ok := currentItem.(ItemSvcWait); ok {
 			log.Debugf("item(%s)=%T is ItemSvcWait", currentItem.ID(), currentItem)
+			//sync before the request is sent, because the response may be
+			//processed in another instance before this function returns
+			s.Set("current_item_id", currentItem.ID())
+			saveNextItems(ctx, s, nextItems)
+			if err := s.Sync(); err != nil {
+				if IsStaleSession(err) {
+					return err
+				}
+				return errors.Wrapf(err, "failed to sync session before item(%s) request", currentItem.ID())
+			}
+			synced = true //do not sync again after the request, another instance may already have continued
 			if err := svcWait.Request(ctx); err != nil {
 				return errors.Wrapf(err, "item(%s) failed to request", currentItem.ID())
 			}
@@ -186,6 +309,43 @@ func proceed(ctx context.Context, s Session, moreNextItems []Item) (err error) {
 	return errors.Errorf("not expected to get here - should have ended with final response!")
 } //proceed()
 
+//InvalidShortcutText is displayed before the prompt or menu when an input dialled in a
+//shortcut code (see Router) is not accepted, e.g. an invalid menu option,
+//it is translated and rendered like other texts, see RenderText()
+var InvalidShortcutText = "Invalid input."
+
+//ServiceFailedText is the final response when a session ends because a service response
+//could not be processed, it is translated and rendered like other texts, see RenderText()
+var ServiceFailedText = "Service not available. Please try again later."
+
+//respondFailed() ends the session for the user with ServiceFailedText
+func respondFailed(ctx context.Context, s Session) {
+	responderID, _ := s.Get("responder_id").(string)
+	responderKey, _ := s.Get("responder_key").(string)
+	responder, err := getResponder(responderID)
+	if err != nil {
+		log.Errorf("session(%s) cannot respond: %+v", s.ID(), err)
+		return
+	}
+	if err := responder.Respond(ctx, responderKey, Response{Type: ResponseTypeRelease, Message: RenderText(ctx, ServiceFailedText)}); err != nil {
+		log.Errorf("session(%s) failed to respond: %+v", s.ID(), err)
+	}
+}
+
+//inputErrorText() returns the error text to display before the prompt is repeated
+func inputErrorText(ctx context.Context, err error) string {
+	var text string
+	if inputErr, ok := err.(InputError); ok {
+		text = renderText(ctx, inputErr.Text, inputErr.Values)
+	} else {
+		text = renderUncachedText(ctx, err.Error())
+	}
+	if text != "" {
+		text += "\n"
+	}
+	return text
+}
+
 func UserAbort(ctx context.Context, id string) error {
 	log.Errorf("USSD Aborted by user")
 	if xerr := sessions.Del(id); xerr != nil {
@@ -194,11 +354,30 @@ func UserAbort(ctx context.Context, id string) error {
 	return nil
 }
 
-func loadNextItems(s Session) ([]Item, error) {
-	nextItemIDs, _ := s.Get("next_item_ids").([]string)
+//loadNextItems() returns the items that were still queued when the session was suspended
+//the queue is stored as a list of item ids, which after a round trip through central
+//storage may be []interface{} rather than []string
+func loadNextItems(ctx context.Context, s Session) ([]Item, error) {
+	var nextItemIDs []string
+	switch ids := s.Get("next_item_ids").(type) {
+	case nil:
+	case []string:
+		nextItemIDs = ids
+	case []interface{}:
+		for i, id := range ids {
+			itemID, ok := id.(string)
+			if !ok {
+				return nil, errors.Errorf("next_item_ids[%d]=(%T)%v is not a string", i, id, id)
+			}
+			nextItemIDs = append(nextItemIDs, itemID)
+		}
+	default:
+		return nil, errors.Errorf("next_item_ids=(%T)%v is not a list of ids", ids, ids)
+	}
+	r := ctxRegistry(ctx)
 	nextItems := []Item{}
 	for i, itemID := range nextItemIDs {
-		if item, ok := ItemByID(itemID); !ok {
+		if item, ok := r.Get(itemID); !ok {
 			return nil, errors.Errorf("unknown item(%s) in next_item_ids[%d]=%v", itemID, i, nextItemIDs)
 		} else {
 			nextItems = append(nextItems, item)
@@ -206,3 +385,31 @@ func loadNextItems(s Session) ([]Item, error) {
 	}
 	return nextItems, nil
 } //loadNextItems()
+
+//saveNextItems() stores the ids of items not yet processed when the session is suspended
+//so that the queue can be restored with loadNextItems() in any instance when the session continues
+func saveNextItems(ctx context.Context, s Session, nextItems []Item) {
+	if len(nextItems) == 0 {
+		s.Del("next_item_ids")
+		return
+	}
+	r := ctxRegistry(ctx)
+	nextItemIDs := make([]string, len(nextItems))
+	for i, item := range nextItems {
+		if _, ok := r.Get(item.ID()); !ok {
+			//will fail when the session continues
+			log.Errorf("session(%s) queued item %T(%s) is not registered and cannot be loaded by id", s.ID(), item, item.ID())
+		}
+		nextItemIDs[i] = item.ID()
+	}
+	s.Set("next_item_ids", nextItemIDs)
+} //saveNextItems()
+
+func loadCurrentItem(ctx context.Context, s Session) (Item, error) {
+	currentItemID, _ := s.Get("current_item_id").(string)
+	currentItem, ok := ctxRegistry(ctx).Get(currentItemID)
+	if !ok {
+		return nil, errors.Errorf("session(%s).currentItemID(%s) not defined", s.ID(), currentItemID)
+	}
+	return currentItem, nil
+} //loadCurrentItem()
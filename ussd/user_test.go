@@ -0,0 +1,241 @@
+package ussd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+//testResponder records the responses by responder key,
+//tests use the session id as key
+type testResponder struct {
+	sync.Mutex
+	responses map[string][]Response
+}
+
+var testResponses = &testResponder{responses: map[string][]Response{}}
+
+func init() {
+	AddResponder(testResponses)
+}
+
+func (r *testResponder) ID() string { return "test" }
+
+func (r *testResponder) Respond(ctx context.Context, key interface{}, res Response) error {
+	r.Lock()
+	defer r.Unlock()
+	r.responses[key.(string)] = append(r.responses[key.(string)], res)
+	return nil
+}
+
+//last() returns the last response sent to key and the number of responses
+func (r *testResponder) last(key string) (Response, int) {
+	r.Lock()
+	defer r.Unlock()
+	responses := r.responses[key]
+	if len(responses) == 0 {
+		return Response{}, 0
+	}
+	return responses[len(responses)-1], len(responses)
+}
+
+//reset() discards the responses sent to key
+func (r *testResponder) reset(key string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.responses, key)
+}
+
+//testStart() starts session id with the USSD code and returns the response
+func testStart(t *testing.T, ctx context.Context, id string, initItem ItemSvcExec, code string) Response {
+	t.Helper()
+	testResponses.reset(id)
+	if err := Start(ctx, id, nil, initItem, code, testResponses, id); err != nil {
+		t.Fatalf("Start(%s) failed: %+v", code, err)
+	}
+	res, n := testResponses.last(id)
+	if n == 0 {
+		t.Fatalf("Start(%s) did not respond", code)
+	}
+	return res
+}
+
+//testInput() continues session id with the input and returns the response
+func testInput(t *testing.T, ctx context.Context, id string, input string) Response {
+	t.Helper()
+	_, before := testResponses.last(id)
+	if err := UserInput(ctx, id, nil, input, testResponses, id); err != nil {
+		t.Fatalf("UserInput(%s) failed: %+v", input, err)
+	}
+	res, n := testResponses.last(id)
+	if n == before {
+		t.Fatalf("UserInput(%s) did not respond", input)
+	}
+	return res
+}
+
+//testWait is an ItemSvcWait that sets the service response in session value "result",
+//or fails when the response is "fail"
+type testWait struct {
+	id string
+}
+
+func (w testWait) ID() string { return w.id }
+
+func (w testWait) Request(ctx context.Context) error { return nil }
+
+func (w testWait) Process(ctx context.Context, value interface{}) error {
+	if value == "fail" {
+		return fmt.Errorf("service failed")
+	}
+	ctx.Value(CtxSession{}).(Session).Set("result", value)
+	return nil
+}
+
+func TestServiceResponse(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	wait := testWait{id: "test_svc_wait"}
+	if err := r.Add(wait); err != nil {
+		t.Fatal(err)
+	}
+	router := r.NewRouter("test_svc_router").
+		WithCode("*1#", wait, r.NewFinal("test_svc_done", "Result: <result>"))
+
+	testResponses.reset("svc1")
+	testResponses.reset("svc2")
+	if err := Start(ctx, "svc1", nil, router, "*1#", testResponses, "svc1"); err != nil {
+		t.Fatalf("Start failed: %+v", err)
+	}
+	if _, n := testResponses.last("svc1"); n != 0 {
+		t.Fatalf("responded before the service response")
+	}
+	if err := ServiceResponse(ctx, "svc1", "ok"); err != nil {
+		t.Fatalf("ServiceResponse failed: %+v", err)
+	}
+	if res, _ := testResponses.last("svc1"); res.Type != ResponseTypeRelease || res.Message != "Result: ok" {
+		t.Fatalf("got %+v", res)
+	}
+	if s, _ := sessions.Get("svc1"); s != nil {
+		t.Fatalf("session not deleted after final response")
+	}
+
+	//a failed service response ends the session with a response to the user
+	if err := Start(ctx, "svc2", nil, router, "*1#", testResponses, "svc2"); err != nil {
+		t.Fatalf("Start failed: %+v", err)
+	}
+	if err := ServiceResponse(ctx, "svc2", "fail"); err == nil {
+		t.Fatalf("ServiceResponse did not fail")
+	}
+	if res, n := testResponses.last("svc2"); n != 1 || res.Type != ResponseTypeRelease || res.Message != ServiceFailedText {
+		t.Fatalf("got %d responses, last %+v", n, res)
+	}
+	if s, _ := sessions.Get("svc2"); s != nil {
+		t.Fatalf("session not deleted after service failed")
+	}
+
+	//not waiting
+	if err := ServiceResponse(ctx, "svc3", "ok"); err == nil {
+		t.Fatalf("ServiceResponse for unknown session did not fail")
+	}
+}
+
+//testJSONRoundTrip() replaces the stored data of session id with a JSON decoded copy,
+//as a central session store would return it to another instance, and returns the decoded data
+func testJSONRoundTrip(t *testing.T, id string) map[string]interface{} {
+	t.Helper()
+	ss := sessions.(*inMemorySessions)
+	ss.Lock()
+	defer ss.Unlock()
+	ims, ok := ss.sessionByID[id]
+	if !ok {
+		t.Fatalf("session(%s) not stored", id)
+	}
+	jsonData, err := json.Marshal(ims.data)
+	if err != nil {
+		t.Fatalf("cannot encode session data: %+v", err)
+	}
+	ims.data = map[string]interface{}{}
+	if err := json.Unmarshal(jsonData, &ims.data); err != nil {
+		t.Fatalf("cannot decode session data: %+v", err)
+	}
+	ss.sessionByID[id] = ims
+	return ims.data
+}
+
+func TestNextItemsAfterPrompt(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	router := r.NewRouter("test_next_router").
+		WithCode("*2#",
+			r.NewPrompt("test_next_prompt", "Name?", "name"),
+			r.Set("greeting", "Hello"),
+			r.NewFinal("test_next_done", "<greeting> <name>"),
+		)
+
+	if res := testStart(t, ctx, "next1", router, "*2#"); res.Type != ResponseTypeResponse || res.Message != "Name?" {
+		t.Fatalf("got %+v", res)
+	}
+	data := testJSONRoundTrip(t, "next1")
+	if ids, ok := data["next_item_ids"].([]interface{}); !ok || len(ids) != 2 {
+		t.Fatalf("next_item_ids=%#v", data["next_item_ids"])
+	}
+	if res := testInput(t, ctx, "next1", "Jan"); res.Type != ResponseTypeRelease || res.Message != "Hello Jan" {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestPromptMaxAttempts(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	ask := r.NewPrompt("test_attempts_ask", "Amount?", "amount").
+		WithValidator(ValidateNumeric()).
+		WithMaxAttempts(2, r.NewFinal("test_attempts_failed", "Too many attempts."))
+	router := r.NewRouter("test_attempts_router").
+		WithCode("*4#", ask, r.NewFinal("test_attempts_done", "Done <amount>"))
+
+	testStart(t, ctx, "attempts1", router, "*4#")
+	if res := testInput(t, ctx, "attempts1", "x"); res.Type != ResponseTypeResponse {
+		t.Fatalf("got %+v", res)
+	}
+	if data := testJSONRoundTrip(t, "attempts1"); data[promptAttemptsName(ask.ID())] != float64(1) {
+		t.Fatalf("attempts not counted for the prompt: %+v", data)
+	}
+	//fail items replace the queued items
+	if res := testInput(t, ctx, "attempts1", "y"); res.Type != ResponseTypeRelease || res.Message != "Too many attempts." {
+		t.Fatalf("got %+v", res)
+	}
+
+	testStart(t, ctx, "attempts2", router, "*4#")
+	testInput(t, ctx, "attempts2", "x")
+	if res := testInput(t, ctx, "attempts2", "12"); res.Type != ResponseTypeRelease || res.Message != "Done 12" {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestShortcutInvalidOption(t *testing.T) {
+	r := NewRegistry()
+	ctx := WithRegistry(context.Background(), r)
+	menu := r.NewMenu("test_shortcut_menu", "Menu").
+		With("A", r.NewFinal("test_shortcut_a", "A"))
+	router := r.NewRouter("test_shortcut_router").WithCode("*5#", menu)
+	menuText := RenderText(ctx, "Menu\n1. A")
+
+	if res := testStart(t, ctx, "shortcut1", router, "*5*1#"); res.Type != ResponseTypeRelease || res.Message != "A" {
+		t.Fatalf("got %+v", res)
+	}
+
+	//invalid option: show the menu with an error and discard the other inputs
+	res := testStart(t, ctx, "shortcut2", router, "*5*7*1#")
+	if res.Type != ResponseTypeResponse || res.Message != InvalidShortcutText+"\n"+menuText {
+		t.Fatalf("got %+v", res)
+	}
+	if data := testJSONRoundTrip(t, "shortcut2"); data["shortcut_inputs"] != nil {
+		t.Fatalf("shortcut_inputs=%v", data["shortcut_inputs"])
+	}
+	if res := testInput(t, ctx, "shortcut2", "1"); res.Type != ResponseTypeRelease || res.Message != "A" {
+		t.Fatalf("got %+v", res)
+	}
+}
@@ -0,0 +1,267 @@
+package ussd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//Problem is reported by Validate()
+type Problem struct {
+	Level   ProblemLevel
+	ItemID  string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: item(%s): %s", p.Level, p.ItemID, p.Message)
+}
+
+type ProblemLevel int
+
+const (
+	ProblemLevelWarning ProblemLevel = iota //may work, e.g. custom go code may use a prompt value
+	ProblemLevelError                       //will fail at runtime
+)
+
+func (l ProblemLevel) String() string {
+	if l == ProblemLevelError {
+		return "ERROR"
+	}
+	return "WARNING"
+}
+
+//Validate() checks all items in the registry (or namespace) and returns the problems found:
+//	errors:
+//	- menu options without next items, which are shown as not implemented
+//	- routes and menu options that can end without a final response, following every
+//	  path through if and switch items (custom go items are assumed to respond)
+//	- next items that are not registered, so a session cannot continue on them
+//	- rendered text longer than maxl (not checked if maxl<=0), for menus on any page
+//	- texts or translations that cannot be parsed, see RenderText()
+//	warnings:
+//	- texts that are translated, but not to all languages in the catalog (except the fallback)
+//	- items that cannot be reached from any router
+//	- prompts with a session variable that is not used in any text as <name> or expression
+//items with custom go code (ItemSvcExec/ItemSvcWait) return next items at runtime
+//and cannot be checked
+func Validate(r *Registry, maxl int) []Problem {
+	problems := []Problem{}
+	add := func(level ProblemLevel, itemID string, format string, args ...interface{}) {
+		problems = append(problems, Problem{Level: level, ItemID: itemID, Message: fmt.Sprintf(format, args...)})
+	}
+
+	items := r.Items()
+	languages := GetLanguages()
+	fallback := getFallbackLanguage()
+	roots := []Item{}
+	usedNames := map[string]bool{}
+	for _, item := range items {
+		texts := []string{}
+		switch i := item.(type) {
+		case *Router, activeItem:
+			roots = append(roots, item)
+		case *Menu:
+			texts = append(texts, i.title)
+			for _, option := range i.options {
+				texts = append(texts, option.caption)
+			}
+		case *Prompt:
+			texts = append(texts, i.text)
+		case *Final:
+			texts = append(texts, i.text)
+		case *Redirect:
+			for _, name := range i.expr.names() {
+				usedNames[name] = true
+			}
+		case *If:
+			for _, name := range i.expr.names() {
+				usedNames[name] = true
+			}
+		case *Switch:
+			for _, c := range i.cases {
+				if c.expr != "" {
+					for _, name := range c.expr.names() {
+						usedNames[name] = true
+					}
+				} else {
+					usedNames[c.name] = true
+				}
+			}
+		case set:
+			if expr, ok := i.value.(Expr); ok {
+				for _, name := range expr.names() {
+					usedNames[name] = true
+				}
+			}
+		}
+		for _, text := range texts {
+			//check the text and all its translations
+			textByLanguage := translations(text)
+			if len(textByLanguage) > 0 {
+				for _, language := range languages {
+					//the text itself is displayed when not translated to the fallback language
+					if _, ok := textByLanguage[language.Code]; !ok && language.Code != fallback {
+						add(ProblemLevelWarning, item.ID(), "text(%s) is not translated to language(%s)", text, language.Code)
+					}
+				}
+			} else {
+				textByLanguage[""] = text
+			}
+			codes := []string{}
+			for code := range textByLanguage {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for _, code := range codes {
+				translated := textByLanguage[code]
+				t, err := parseText(translated)
+				if err != nil {
+					if code == "" {
+						add(ProblemLevelError, item.ID(), "invalid text(%s): %v", translated, err)
+					} else {
+						add(ProblemLevelError, item.ID(), "invalid text(%s) language(%s): %v", translated, code, err)
+					}
+					continue
+				}
+				for _, name := range t.names() {
+					usedNames[name] = true
+				}
+			}
+		}
+	}
+
+	//render with an empty session that is not stored
+	vs := validateSession()
+	if maxl > 0 {
+		vs.Set("maxl", maxl)
+	}
+	ctx := context.WithValue(context.Background(), CtxSession{}, vs)
+	for _, item := range items {
+		for _, link := range itemLinks(item) {
+			what := fmt.Sprintf("%s(%s)", link.kind, link.label)
+			if link.kind == "option" && len(link.next) == 0 {
+				add(ProblemLevelError, item.ID(), "menu %s is not implemented (no next items)", what)
+				continue
+			}
+			switch link.kind {
+			case "then", "else", "case", "default":
+				//if/switch branches may be empty, then the session
+				//continues with the items queued after the item
+				for _, next := range link.next {
+					if !r.isRegistered(next) {
+						add(ProblemLevelError, item.ID(), "%s next item %T(%s) is not registered", what, next, next.ID())
+					}
+				}
+				continue
+			}
+
+			if len(link.next) == 0 {
+				add(ProblemLevelError, item.ID(), "%s has no next items", what)
+				continue
+			}
+			for _, next := range link.next {
+				if !r.isRegistered(next) {
+					add(ProblemLevelError, item.ID(), "%s next item %T(%s) is not registered", what, next, next.ID())
+				}
+			}
+			if menu, ok := item.(*Menu); ok && menu.continues {
+				continue
+			}
+			if last, ok := endsWithResponse(link.next, map[string]bool{}); !ok {
+				add(ProblemLevelError, item.ID(), "%s can end with %T(%s) without a final response", what, last, last.ID())
+			}
+		}
+
+		if menu, ok := item.(*Menu); ok && maxl > 0 {
+			//pages are split to fit maxl, unless a single option does not fit
+			for n, page := range menu.pages(ctx, maxl) {
+				if l := len([]rune(page.text)); l > maxl {
+					add(ProblemLevelError, item.ID(), "rendered page %d length %d exceeds maxl=%d", n+1, l, maxl)
+				}
+			}
+		} else if itemUsr, ok := item.(ItemUsr); ok && maxl > 0 {
+			if l := len([]rune(itemUsr.Render(ctx))); l > maxl {
+				add(ProblemLevelError, item.ID(), "rendered text length %d exceeds maxl=%d", l, maxl)
+			}
+		}
+
+		if prompt, ok := item.(*Prompt); ok {
+			if !usedNames[prompt.name] {
+				add(ProblemLevelWarning, item.ID(), "prompt value <%s> is not used in any text (may be used in go code)", prompt.name)
+			}
+		}
+	}
+
+	reachable := map[string]bool{}
+	walkItems(roots, func(item Item) {
+		reachable[item.ID()] = true
+	})
+	for _, item := range items {
+		if !reachable[item.ID()] {
+			add(ProblemLevelWarning, item.ID(), "%T cannot be reached from any router", item)
+		}
+	}
+	return problems
+} //Validate()
+
+//endsWithResponse() checks that every path through the items ends with a response to the user,
+//else it returns false with the last item of the path that does not
+//	if and switch items continue with each branch followed by the rest of the items
+//	prompts, set and func items continue with the rest of the items
+//	menus respond (their options are checked separately), unless the options continue
+//	with the rest of the items, e.g. select language
+//	custom go items cannot be checked and are assumed to respond
+//	items already on the path (loops) are assumed to respond on another path
+func endsWithResponse(items []Item, onPath map[string]bool) (Item, bool) {
+	for n, item := range items {
+		rest := items[n+1:]
+		switch i := item.(type) {
+		case *Prompt, set, ussdFunc:
+			if len(rest) == 0 {
+				return item, false
+			}
+		case *Menu:
+			if !i.continues {
+				return nil, true
+			}
+			if len(rest) == 0 {
+				return item, false
+			}
+		case *If, *Switch:
+			if onPath[item.ID()] {
+				return nil, true
+			}
+			onPath[item.ID()] = true
+			defer delete(onPath, item.ID())
+			for _, link := range itemLinks(item) {
+				path := append(append([]Item{}, link.next...), rest...)
+				if len(path) == 0 {
+					return item, false
+				}
+				if last, ok := endsWithResponse(path, onPath); !ok {
+					return last, false
+				}
+			}
+			return nil, true
+		default:
+			//final, redirect or custom go item
+			return nil, true
+		}
+	}
+	return nil, true //not expected: items is never empty
+} //endsWithResponse()
+
+//isRegistered() checks that the item can be found by its full id
+func (r *Registry) isRegistered(item Item) bool {
+	r.items.RLock()
+	defer r.items.RUnlock()
+	_, ok := r.items.itemByID[item.ID()]
+	return ok
+}
+
+func validateSession() Session {
+	t0 := time.Now()
+	return NewSession(&inMemorySessions{sessionByID: map[string]inMemSession{}}, "validate", 0, t0, t0, nil)
+}
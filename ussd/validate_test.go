@@ -0,0 +1,44 @@
+package ussd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	r := NewRegistry()
+	bye := r.NewFinal("bye", "Bye <name>")
+	ask := r.NewPrompt("ask", "Name?", "name")
+	menu := r.NewMenu("menu", "Menu").
+		With("no final", ask, r.Set("x", 1)).
+		With("no else", r.NewIf("no_else", "x == 1").Then(bye)).
+		With("if", ask, r.NewIf("both", "x == 1").Then(bye).Else(r.NewFinal("other", "Other"))).
+		With("switch", r.NewSwitch("sw").WithValue("x", 1, ask).WithDefault(), bye).
+		With("switch no final", r.NewSwitch("sw2").WithValue("x", 1, bye).WithDefault(ask)).
+		With("not implemented")
+	r.NewRouter("router").WithCode("*1#", menu)
+	r.NewFinal("long", strings.Repeat("é", 60))
+	r.NewFinal("too_long", strings.Repeat("é", 101))
+
+	got := map[string]bool{}
+	for _, problem := range Validate(r, 100) {
+		if problem.Level == ProblemLevelError {
+			got[problem.ItemID+": "+problem.Message] = true
+		}
+	}
+	for _, expected := range []string{
+		"menu: option(no final) can end with ussd.set(set(x=int:1)) without a final response",
+		"menu: option(no else) can end with *ussd.If(no_else) without a final response",
+		"menu: option(switch no final) can end with *ussd.Prompt(ask) without a final response",
+		"menu: menu option(not implemented) is not implemented (no next items)",
+		"too_long: rendered text length 101 exceeds maxl=100",
+	} {
+		if !got[expected] {
+			t.Errorf("missing error: %s", expected)
+		}
+		delete(got, expected)
+	}
+	for problem := range got {
+		t.Errorf("unexpected error: %s", problem)
+	}
+}
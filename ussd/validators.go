@@ -0,0 +1,193 @@
+package ussd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//InputError is returned by validators to display a text to the user before repeating the prompt
+//the text is translated and rendered like other texts (see RenderText()),
+//with the values, e.g. "Enter <min> to <max> digits."
+type InputError struct {
+	Text   string
+	Values map[string]interface{}
+}
+
+func (e InputError) Error() string { return e.Text }
+
+//ValidatorText() returns the validator with a different error text,
+//e.g. a text id in the catalog for the language of the service
+func ValidatorText(v InputValidator, text string) InputValidator {
+	return textValidator{v: v, text: text}
+}
+
+type textValidator struct {
+	v    InputValidator
+	text string
+}
+
+func (tv textValidator) Validate(input string) error {
+	err := tv.v.Validate(input)
+	if err == nil {
+		return nil
+	}
+	e := InputError{Text: tv.text}
+	if inputErr, ok := err.(InputError); ok {
+		e.Values = inputErr.Values
+	}
+	return e
+}
+
+//ValidateNumeric() accepts only digits
+func ValidateNumeric() InputValidator {
+	return numericValidator{}
+}
+
+type numericValidator struct{}
+
+func (numericValidator) Validate(input string) error {
+	if input == "" || !isDigits(input) {
+		return InputError{Text: "Enter digits only."}
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//ValidateLength() accepts min..max characters
+func ValidateLength(min, max int) InputValidator {
+	if min < 0 || max < min {
+		panic(fmt.Sprintf("ValidateLength(%d,%d) invalid range", min, max))
+	}
+	return lengthValidator{min: min, max: max}
+}
+
+type lengthValidator struct {
+	min, max int
+}
+
+func (v lengthValidator) Validate(input string) error {
+	if l := len([]rune(input)); l < v.min || l > v.max {
+		return InputError{Text: "Enter <min> to <max> characters.", Values: map[string]interface{}{"min": v.min, "max": v.max}}
+	}
+	return nil
+}
+
+//ValidateRegex() accepts input that matches the pattern, e.g. `^[A-Z]{2}[0-9]{4}$`
+func ValidateRegex(pattern string) InputValidator {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("ValidateRegex(%s): %+v", pattern, err))
+	}
+	return regexValidator{regex: regex}
+}
+
+type regexValidator struct {
+	regex *regexp.Regexp
+}
+
+func (v regexValidator) Validate(input string) error {
+	if !v.regex.MatchString(input) {
+		return InputError{Text: "Invalid input."}
+	}
+	return nil
+}
+
+//ValidateAmount() accepts a number with at most 2 decimals in the range min..max
+func ValidateAmount(min, max float64) InputValidator {
+	if max < min {
+		panic(fmt.Sprintf("ValidateAmount(%v,%v) invalid range", min, max))
+	}
+	return amountValidator{min: min, max: max}
+}
+
+var amountRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+type amountValidator struct {
+	min, max float64
+}
+
+func (v amountValidator) Validate(input string) error {
+	if amountRegex.MatchString(input) {
+		if f, err := strconv.ParseFloat(input, 64); err == nil && f >= v.min && f <= v.max {
+			return nil
+		}
+	}
+	return InputError{Text: "Enter an amount from <min> to <max>.", Values: map[string]interface{}{"min": v.min, "max": v.max}}
+}
+
+//ValidateMsisdn() accepts a phone number that is valid with the rules,
+//or with the current rules (see SetMsisdnRules()) when rules is nil
+func ValidateMsisdn(rules MsisdnRules) InputValidator {
+	return msisdnValidator{rules: rules}
+}
+
+type msisdnValidator struct {
+	rules MsisdnRules
+}
+
+func (v msisdnValidator) Validate(input string) error {
+	rules := v.rules
+	if rules == nil {
+		rules = GetMsisdnRules()
+	}
+	if _, err := rules.International(input); err != nil {
+		return InputError{Text: "Enter a valid phone number."}
+	}
+	return nil
+}
+
+//ValidatePin() accepts a PIN of length digits that is not easy to guess,
+//i.e. not all the same digit and not a sequence like 1234 or 9876
+func ValidatePin(length int) InputValidator {
+	if length < 1 {
+		panic(fmt.Sprintf("ValidatePin(%d) invalid length", length))
+	}
+	return pinValidator{length: length}
+}
+
+type pinValidator struct {
+	length int
+}
+
+func (v pinValidator) Validate(input string) error {
+	if len(input) != v.length || !isDigits(input) {
+		return InputError{Text: "Enter a <length> digit PIN.", Values: map[string]interface{}{"length": v.length}}
+	}
+	same, up, down := true, true, true
+	for i := 1; i < len(input); i++ {
+		same = same && input[i] == input[0]
+		up = up && input[i] == input[i-1]+1
+		down = down && input[i] == input[i-1]-1
+	}
+	if len(input) > 1 && (same || up || down) {
+		return InputError{Text: "PIN is too easy to guess."}
+	}
+	return nil
+}
+
+//ValidateDate() accepts a date in the go time layout, e.g. "02012006" for ddmmyyyy
+func ValidateDate(layout string) InputValidator {
+	return dateValidator{layout: layout}
+}
+
+type dateValidator struct {
+	layout string
+}
+
+func (v dateValidator) Validate(input string) error {
+	if _, err := time.Parse(v.layout, strings.TrimSpace(input)); err != nil {
+		return InputError{Text: "Enter a valid date."}
+	}
+	return nil
+}